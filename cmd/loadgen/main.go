@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Log progress with this interval.
+const progressInterval = 10 * time.Second
+
+// How virtual users behave. Matches the tests in README.
+type scenario struct {
+	name string
+
+	description string
+
+	// Whether client disconnects after a random session duration and
+	// reconnects. Otherwise it stays until the end of the run.
+	hasSessionDuration bool
+
+	// Whether client connects again after it's logged in or told not
+	// to queue. Otherwise it stays away until the end of the run.
+	reconnectAfterLogin bool
+
+	// Use a new id on every connection, so server sees each of them as
+	// a different user.
+	isNewIdPerSession bool
+}
+
+var scenarios = []*scenario{
+	{
+		name:        "simple",
+		description: "Connect, request login and stay until the end.",
+	},
+	{
+		name:                "dequeue",
+		description:         "Like simple, but connect back and request login again once logged in, so CCU stays the same.",
+		reconnectAfterLogin: true,
+	},
+	{
+		name:                "reconnect",
+		description:         "Disconnect after a random session duration and reconnect with the same id.",
+		hasSessionDuration:  true,
+		reconnectAfterLogin: true,
+	},
+	{
+		name:                "dau",
+		description:         "Like reconnect, but with a new id on every reconnect, so every connection is a different user.",
+		hasSessionDuration:  true,
+		reconnectAfterLogin: true,
+		isNewIdPerSession:   true,
+	},
+}
+
+type settings struct {
+	url string
+
+	scenario *scenario
+
+	clients int
+
+	// Time to start all clients, linearly.
+	ramp time.Duration
+
+	// Time of the whole run, including ramp.
+	duration time.Duration
+
+	minSession time.Duration
+	maxSession time.Duration
+
+	idPrefix string
+
+	platform string
+
+	loginType msg.LoginTypeCode
+
+	seed int64
+
+	dialer *websocket.Dialer
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:5487/ws", "Websocket url of the queue server.")
+	scenarioName := flag.String("scenario", "simple", "Scenario to run, one of "+scenarioNames()+".")
+	clients := flag.Int("clients", 1000, "Number of concurrent virtual users.")
+	ramp := flag.Duration("ramp", time.Minute, "Time to start all virtual users, linearly.")
+	duration := flag.Duration("duration", 10*time.Minute, "Time of the whole run, including ramp.")
+	minSession := flag.Duration("min-session", time.Minute, "Min session duration of reconnect and dau scenarios.")
+	maxSession := flag.Duration("max-session", 10*time.Minute, "Max session duration of reconnect and dau scenarios.")
+	idPrefix := flag.String("id-prefix", "loadgen", "Prefix of client ids, so that runs don't share ids.")
+	platform := flag.String("platform", "Android", "Platform header of clients.")
+	loginType := flag.Uint("login-type", uint(msg.DeviceLogin), "Login type of login requests. Token, account and device id are generated from client id.")
+	seed := flag.Int64("seed", 1, "Seed of session durations.")
+	insecure := flag.Bool("insecure", false, "Skip verifying TLS certificate of the queue server.")
+	compression := flag.Bool("compression", false, "Offer permessage-deflate, used if server enables ws-compression.")
+	format := flag.String("format", "json", "Format of the report, json or csv.")
+	output := flag.String("output", "-", "File to write the report to. - means stdout.")
+	flag.Parse()
+
+	var selected *scenario
+	for _, s := range scenarios {
+		if s.name == *scenarioName {
+			selected = s
+		}
+	}
+	if selected == nil {
+		log.Fatalf("unknown scenario[%v], must be one of %v", *scenarioName, scenarioNames())
+	}
+
+	if *format != "json" && *format != "csv" {
+		log.Fatalf("unknown format[%v], must be json or csv", *format)
+	}
+
+	if *clients <= 0 || *minSession <= 0 || *maxSession < *minSession {
+		log.Fatalf("clients must be positive and 0 < min session <= max session")
+	}
+
+	settings := &settings{
+		url:        *url,
+		scenario:   selected,
+		clients:    *clients,
+		ramp:       *ramp,
+		duration:   *duration,
+		minSession: *minSession,
+		maxSession: *maxSession,
+		idPrefix:   *idPrefix,
+		platform:   *platform,
+		loginType:  msg.LoginTypeCode(*loginType),
+		seed:       *seed,
+		dialer: &websocket.Dialer{
+			HandshakeTimeout:  30 * time.Second,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: *insecure},
+			EnableCompression: *compression,
+		},
+	}
+
+	// Interrupt stops the run early, report is still written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result := run(ctx, settings)
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("cannot create output file %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var err error
+	if *format == "csv" {
+		err = result.writeCsv(w)
+	} else {
+		err = result.writeJson(w)
+	}
+	if err != nil {
+		log.Fatalf("cannot write report %v", err)
+	}
+}
+
+func scenarioNames() string {
+	names := make([]string, 0, len(scenarios))
+	for _, s := range scenarios {
+		names = append(names, s.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func run(ctx context.Context, settings *settings) *report {
+	ctx, cancel := context.WithTimeout(ctx, settings.duration)
+	defer cancel()
+
+	recorder := newRecorder()
+	startTime := time.Now()
+	log.Printf("run scenario[%v] with clients[%v] ramp[%v] duration[%v] against url[%v]. %v", settings.scenario.name, settings.clients, settings.ramp, settings.duration, settings.url, settings.scenario.description)
+
+	go logProgress(ctx, recorder)
+
+	var wg sync.WaitGroup
+	interval := settings.ramp / time.Duration(settings.clients)
+	for i := 0; i < settings.clients && ctx.Err() == nil; i++ {
+		user := &virtualUser{
+			id:       fmt.Sprintf("%v-%v", settings.idPrefix, i),
+			random:   rand.New(rand.NewSource(settings.seed + int64(i))),
+			settings: settings,
+			recorder: recorder,
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user.run(ctx)
+		}()
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+		}
+	}
+
+	wg.Wait()
+	return recorder.report(settings, startTime)
+}
+
+func logProgress(ctx context.Context, recorder *recorder) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			activeConns, loginCnt, errorCnt := recorder.progress()
+			log.Printf("activeConns[%v] logins[%v] errors[%v]", activeConns, loginCnt, errorCnt)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of histogram buckets in milliseconds. Samples over the
+// last one are counted in an overflow bucket.
+var bucketBoundsMs = []int64{
+	1, 2, 5, 10, 20, 50, 100, 200, 500,
+	1000, 2000, 5000, 10000, 20000, 30000, 60000,
+	120000, 300000, 600000, 1200000, 1800000, 3600000,
+}
+
+// Names of latency histograms.
+const (
+	// Dial until websocket handshake completes.
+	connectLatency = "connect"
+
+	// Handshake until the first ShouldQueue event.
+	shouldQueueLatency = "shouldQueue"
+
+	// Login request sent until the first Ticket event.
+	ticketLatency = "ticket"
+
+	// Login request sent until Login event with jwt, ie. time waited
+	// in queue.
+	waitLatency = "wait"
+)
+
+// Names of counters.
+const (
+	connects           = "connects"
+	connectErrors      = "connectErrors"
+	unexpectedCloses   = "unexpectedCloses"
+	shouldQueueTrue    = "shouldQueueTrue"
+	shouldQueueFalse   = "shouldQueueFalse"
+	tickets            = "tickets"
+	queueStats         = "queueStats"
+	logins             = "logins"
+	loginsRejected     = "loginsRejected"
+	credentialsExpired = "credentialsExpired"
+	invalidEvents      = "invalidEvents"
+
+	// Prefix of error event counters, followed by reason code.
+	errorEventsPrefix = "errorEvents."
+)
+
+// Collect samples and counters from all virtual users.
+type recorder struct {
+	// Key value: histogram name -> samples in milliseconds.
+	samples map[string][]int64
+
+	// Key value: counter name -> value.
+	counters map[string]int64
+
+	// Number of ws connections currently open.
+	activeConns int64
+
+	mux sync.Mutex
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		samples:  make(map[string][]int64),
+		counters: make(map[string]int64),
+	}
+}
+
+func (r *recorder) observe(name string, d time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.samples[name] = append(r.samples[name], d.Milliseconds())
+}
+
+func (r *recorder) count(name string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.counters[name]++
+}
+
+func (r *recorder) connOpened() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.activeConns++
+	r.counters[connects]++
+}
+
+func (r *recorder) connClosed() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.activeConns--
+}
+
+// Numbers for progress log.
+func (r *recorder) progress() (activeConns int64, loginCnt int64, errorCnt int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.activeConns, r.counters[logins], r.counters[connectErrors] + r.counters[unexpectedCloses]
+}
+
+type bucket struct {
+	// Upper bound, inclusive. -1 for the overflow bucket.
+	LeMs int64 `json:"leMs"`
+
+	Count int64 `json:"count"`
+}
+
+type histogram struct {
+	Count int64 `json:"count"`
+
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  int64   `json:"p50Ms"`
+	P90Ms  int64   `json:"p90Ms"`
+	P99Ms  int64   `json:"p99Ms"`
+	MaxMs  int64   `json:"maxMs"`
+
+	Buckets []*bucket `json:"buckets"`
+}
+
+func newHistogram(samples []int64) *histogram {
+	h := &histogram{Count: int64(len(samples))}
+	for _, le := range bucketBoundsMs {
+		h.Buckets = append(h.Buckets, &bucket{LeMs: le})
+	}
+	overflow := &bucket{LeMs: -1}
+	h.Buckets = append(h.Buckets, overflow)
+
+	if len(samples) == 0 {
+		return h
+	}
+
+	sorted := append([]int64(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum int64
+	for _, sample := range sorted {
+		sum += sample
+
+		i := sort.Search(len(bucketBoundsMs), func(i int) bool { return bucketBoundsMs[i] >= sample })
+		h.Buckets[i].Count++
+	}
+
+	percentile := func(p float64) int64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+
+	h.MeanMs = float64(sum) / float64(len(sorted))
+	h.P50Ms = percentile(0.5)
+	h.P90Ms = percentile(0.9)
+	h.P99Ms = percentile(0.99)
+	h.MaxMs = sorted[len(sorted)-1]
+	return h
+}
+
+// Result of a run. Same settings give comparable reports, eg. between
+// commits.
+type report struct {
+	Scenario string `json:"scenario"`
+
+	Url string `json:"url"`
+
+	Clients int `json:"clients"`
+
+	Ramp string `json:"ramp"`
+
+	Duration string `json:"duration"`
+
+	StartTime time.Time `json:"startTime"`
+
+	// Actual duration, shorter than Duration if interrupted.
+	Elapsed string `json:"elapsed"`
+
+	Counters map[string]int64 `json:"counters"`
+
+	Histograms map[string]*histogram `json:"histograms"`
+}
+
+func (r *recorder) report(settings *settings, startTime time.Time) *report {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	result := &report{
+		Scenario:   settings.scenario.name,
+		Url:        settings.url,
+		Clients:    settings.clients,
+		Ramp:       settings.ramp.String(),
+		Duration:   settings.duration.String(),
+		StartTime:  startTime,
+		Elapsed:    time.Since(startTime).Round(time.Second).String(),
+		Counters:   make(map[string]int64, len(r.counters)),
+		Histograms: make(map[string]*histogram),
+	}
+	for name, value := range r.counters {
+		result.Counters[name] = value
+	}
+	for _, name := range []string{connectLatency, shouldQueueLatency, ticketLatency, waitLatency} {
+		result.Histograms[name] = newHistogram(r.samples[name])
+	}
+	return result
+}
+
+func (r *report) writeJson(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// One row per counter, histogram summary and histogram bucket, sorted
+// by name so that reports can be diffed.
+func (r *report) writeCsv(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	rows := [][]string{{"type", "name", "leMs", "count", "meanMs", "p50Ms", "p90Ms", "p99Ms", "maxMs"}}
+
+	counterNames := make([]string, 0, len(r.Counters))
+	for name := range r.Counters {
+		counterNames = append(counterNames, name)
+	}
+	sort.Strings(counterNames)
+	for _, name := range counterNames {
+		rows = append(rows, []string{"counter", name, "", strconv.FormatInt(r.Counters[name], 10), "", "", "", "", ""})
+	}
+
+	histogramNames := make([]string, 0, len(r.Histograms))
+	for name := range r.Histograms {
+		histogramNames = append(histogramNames, name)
+	}
+	sort.Strings(histogramNames)
+	for _, name := range histogramNames {
+		h := r.Histograms[name]
+		rows = append(rows, []string{
+			"histogram", name, "",
+			strconv.FormatInt(h.Count, 10),
+			strconv.FormatFloat(h.MeanMs, 'f', 1, 64),
+			strconv.FormatInt(h.P50Ms, 10),
+			strconv.FormatInt(h.P90Ms, 10),
+			strconv.FormatInt(h.P99Ms, 10),
+			strconv.FormatInt(h.MaxMs, 10),
+		})
+		for _, b := range h.Buckets {
+			rows = append(rows, []string{"bucket", name, strconv.FormatInt(b.LeMs, 10), strconv.FormatInt(b.Count, 10), "", "", "", "", ""})
+		}
+	}
+
+	return writer.WriteAll(rows)
+}
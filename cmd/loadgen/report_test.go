@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	var samples []int64
+	for i := int64(1); i <= 100; i++ {
+		samples = append(samples, i*10)
+	}
+	samples = append(samples, 5000000)
+
+	h := newHistogram(samples)
+	if h.Count != 101 || h.P50Ms != 510 || h.P90Ms != 910 || h.P99Ms != 1000 || h.MaxMs != 5000000 {
+		t.Fatalf("histogram %+v, want count 101 p50 510 p90 910 p99 1000 max 5000000", h)
+	}
+
+	var total int64
+	for _, b := range h.Buckets {
+		total += b.Count
+	}
+	overflow := h.Buckets[len(h.Buckets)-1]
+	if total != h.Count || overflow.LeMs != -1 || overflow.Count != 1 {
+		t.Fatalf("[%v] samples in buckets with overflow %+v, want all with 1 overflow", total, overflow)
+	}
+
+	// Upper bound is inclusive.
+	for _, b := range newHistogram([]int64{10}).Buckets {
+		if (b.LeMs == 10) != (b.Count == 1) {
+			t.Fatalf("bucket %+v, want sample of 10 in bucket le 10 only", b)
+		}
+	}
+
+	if empty := newHistogram(nil); empty.Count != 0 || empty.MaxMs != 0 || len(empty.Buckets) != len(bucketBoundsMs)+1 {
+		t.Fatalf("empty histogram %+v", empty)
+	}
+}
+
+func TestReportCsv(t *testing.T) {
+	r := &report{
+		Counters: map[string]int64{logins: 3, connects: 5},
+		Histograms: map[string]*histogram{
+			waitLatency:    newHistogram([]int64{100, 200}),
+			connectLatency: newHistogram([]int64{1}),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeCsv(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Header, counters, then each histogram followed by its buckets,
+	// sorted by name.
+	buckets := len(bucketBoundsMs) + 1
+	if len(rows) != 1+2+2*(1+buckets) {
+		t.Fatalf("[%v] rows", len(rows))
+	}
+	for i, want := range map[int][]string{
+		1:           {"counter", connects, "", "5"},
+		2:           {"counter", logins, "", "3"},
+		3:           {"histogram", connectLatency, "", "1", "1.0"},
+		4 + buckets: {"histogram", waitLatency, "", "2", "150.0", "100", "200", "200", "200"},
+	} {
+		for j, value := range want {
+			if rows[i][j] != value {
+				t.Fatalf("row[%v] %v, want %v", i, rows[i], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Wait before reconnecting after connection fails or closes
+	// unexpectedly, so a struggling server is not hammered.
+	reconnectBackoff = time.Second
+
+	// Time allowed to write a message to server.
+	writeWait = 10 * time.Second
+)
+
+// How a session ended.
+type sessionEnd int
+
+const (
+	// Run is over.
+	runOver sessionEnd = iota
+
+	// Session duration is reached.
+	sessionOver
+
+	// Logged in, or told not to queue so client logins by itself.
+	loggedIn
+
+	// Connection failed or closed by server.
+	failed
+)
+
+// Client that keeps connecting to the queue server until the run is
+// over.
+type virtualUser struct {
+	id string
+
+	// Only used by this user's goroutine.
+	random *rand.Rand
+
+	settings *settings
+
+	recorder *recorder
+}
+
+func (u *virtualUser) run(ctx context.Context) {
+	for session := 0; ctx.Err() == nil; session++ {
+		id := u.id
+		if u.settings.scenario.isNewIdPerSession {
+			id = fmt.Sprintf("%v-%v", u.id, session)
+		}
+
+		var sessionEndTime time.Time
+		if u.settings.scenario.hasSessionDuration {
+			sessionEndTime = time.Now().Add(u.sessionDuration())
+		}
+
+		var wait time.Duration
+		switch u.session(ctx, id, sessionEndTime) {
+		case runOver:
+			return
+		case loggedIn:
+			if !u.settings.scenario.reconnectAfterLogin {
+				<-ctx.Done()
+				return
+			}
+			// Stay on main server for the rest of session.
+			if !sessionEndTime.IsZero() {
+				wait = time.Until(sessionEndTime)
+			}
+		case failed:
+			wait = reconnectBackoff
+		}
+
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (u *virtualUser) sessionDuration() time.Duration {
+	return u.settings.minSession + time.Duration(u.random.Int63n(int64(u.settings.maxSession-u.settings.minSession)+1))
+}
+
+// Connect, request login and wait until the session ends. Zero end
+// time means no session duration.
+func (u *virtualUser) session(ctx context.Context, id string, endTime time.Time) sessionEnd {
+	header := http.Header{}
+	header.Set("id", id)
+	header.Set("platform", u.settings.platform)
+	header.Set("protocolVersion", fmt.Sprint(msg.LatestProtocolVersion))
+
+	dialTime := time.Now()
+	conn, _, err := u.settings.dialer.DialContext(ctx, u.settings.url, header)
+	if err != nil {
+		if ctx.Err() != nil {
+			return runOver
+		}
+		u.recorder.count(connectErrors)
+		return failed
+	}
+	connectTime := time.Now()
+	u.recorder.observe(connectLatency, connectTime.Sub(dialTime))
+	u.recorder.connOpened()
+	defer u.recorder.connClosed()
+	defer conn.Close()
+
+	// Reader goroutine ends when conn is closed.
+	messages := make(chan *msg.WsMessage, 16)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			wsMessage := &msg.WsMessage{}
+			if err := conn.ReadJSON(wsMessage); err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case messages <- wsMessage:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var sessionTimeout <-chan time.Time
+	if !endTime.IsZero() {
+		timer := time.NewTimer(time.Until(endTime))
+		defer timer.Stop()
+		sessionTimeout = timer.C
+	}
+
+	var loginTime time.Time
+	hasShouldQueue, hasTicket := false, false
+	for {
+		select {
+		case <-ctx.Done():
+			u.close(conn)
+			return runOver
+
+		case <-sessionTimeout:
+			u.close(conn)
+			return sessionOver
+
+		case <-readErr:
+			u.recorder.count(unexpectedCloses)
+			return failed
+
+		case wsMessage := <-messages:
+			switch wsMessage.EventCode {
+			case msg.ShouldQueueCode:
+				event := &msg.ShouldQueueEvent{}
+				if err := json.Unmarshal(wsMessage.EventData, event); err != nil {
+					u.recorder.count(invalidEvents)
+					continue
+				}
+				if !hasShouldQueue {
+					hasShouldQueue = true
+					u.recorder.observe(shouldQueueLatency, time.Since(connectTime))
+				}
+
+				if !event.ShouldQueue {
+					u.recorder.count(shouldQueueFalse)
+					u.close(conn)
+					return loggedIn
+				}
+				u.recorder.count(shouldQueueTrue)
+
+				if loginTime.IsZero() {
+					loginTime = time.Now()
+					if err := u.login(conn, id); err != nil {
+						u.recorder.count(unexpectedCloses)
+						return failed
+					}
+				}
+
+			case msg.TicketCode:
+				u.recorder.count(tickets)
+				if !hasTicket && !loginTime.IsZero() {
+					hasTicket = true
+					u.recorder.observe(ticketLatency, time.Since(loginTime))
+				}
+
+			case msg.QueueStatsCode:
+				u.recorder.count(queueStats)
+
+			case msg.CredentialExpiredCode:
+				// Generated token never expires, send it again anyway
+				// like a real client.
+				u.recorder.count(credentialsExpired)
+				if err := u.login(conn, id); err != nil {
+					u.recorder.count(unexpectedCloses)
+					return failed
+				}
+
+			case msg.ErrorCode:
+				event := &msg.ErrorServerEvent{}
+				if err := json.Unmarshal(wsMessage.EventData, event); err != nil {
+					u.recorder.count(invalidEvents)
+					continue
+				}
+				u.recorder.count(fmt.Sprintf("%v%v", errorEventsPrefix, event.Reason))
+
+			case msg.LoginCode:
+				event := &msg.LoginServerEvent{}
+				if err := json.Unmarshal(wsMessage.EventData, event); err != nil {
+					u.recorder.count(invalidEvents)
+					continue
+				}
+				if event.Jwt == "" {
+					u.recorder.count(loginsRejected)
+					u.close(conn)
+					return failed
+				}
+
+				u.recorder.count(logins)
+				u.recorder.observe(waitLatency, time.Since(loginTime))
+				u.close(conn)
+				return loggedIn
+			}
+		}
+	}
+}
+
+func (u *virtualUser) login(conn *websocket.Conn, id string) error {
+	rawEvent, err := json.Marshal(&msg.LoginClientEvent{
+		Type:      u.settings.loginType,
+		Token:     "token-" + id,
+		Account:   id + "@loadgen.test",
+		DeviceId:  "device-" + id,
+		SessionId: fmt.Sprintf("session-%v-%v", id, time.Now().UnixNano()),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(&msg.WsMessage{
+		EventCode: msg.LoginCode,
+		EventData: rawEvent,
+	})
+}
+
+// Close like a well behaved client, errors are ignored since the
+// connection is being discarded.
+func (u *virtualUser) close(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+}
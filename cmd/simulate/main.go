@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/simulation"
+	"log"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Run built-in scenarios against queue with virtual time and print
+// reports. Queue flags of the server, eg. --dequeue-interval-seconds,
+// can be given to compare settings.
+func main() {
+	scenarioName := flag.String("scenario", "", "Name of the scenario to run. Empty runs all.")
+	logLevel := flag.String("log-level", "warn", "Log level of queue and queue config.")
+	flag.Parse()
+
+	loggerFactory := infra.ProvideLoggerFactory()
+	level, err := zapcore.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("invalid log level %v", err)
+	}
+	loggerFactory.SetLevel("", level)
+
+	// Server settings such as main server host are not needed, so
+	// config is used without validation.
+	metrics := infra.ProvideMetrics()
+
+	var names []string
+	isFound := false
+	for _, scenario := range simulation.Scenarios() {
+		names = append(names, scenario.Name)
+		if *scenarioName != "" && *scenarioName != scenario.Name {
+			continue
+		}
+		isFound = true
+
+		report, err := simulation.Run(scenario, config.CFG, metrics, loggerFactory)
+		if err != nil {
+			log.Fatalf("simulation of scenario[%v] failed %v", scenario.Name, err)
+		}
+		fmt.Printf("# %v\n%v\n", scenario.Description, report)
+	}
+
+	if !isFound {
+		log.Fatalf("unknown scenario[%v], must be one of %v", *scenarioName, strings.Join(names, ", "))
+	}
+}
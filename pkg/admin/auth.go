@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	ErrInvalidRole      = errors.New("invalid role")
+	ErrNoCredential     = errors.New("principal has neither key nor commonName")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Header carrying api key of admin requests.
+const apiKeyHeader = "X-Api-Key"
+
+type Role string
+
+const (
+	// Can read state of server.
+	ViewerRole Role = "viewer"
+
+	// Can also change state of server, eg. toggle debug logging.
+	OperatorRole Role = "operator"
+)
+
+// Return true if role can do what required role can.
+func (r Role) includes(required Role) bool {
+	return r == OperatorRole || r == required
+}
+
+// Who is allowed to call admin api. Authenticated by api key, or by
+// common name of client certificate if mTLS is enabled.
+type Principal struct {
+	// Shown in audit log.
+	Name string `json:"name"`
+
+	Role Role `json:"role"`
+
+	Key string `json:"key,omitempty"`
+
+	CommonName string `json:"commonName,omitempty"`
+}
+
+// Principals file is a json array of Principal.
+func loadPrincipals(path string) ([]*Principal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var principals []*Principal
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return nil, err
+	}
+
+	for _, principal := range principals {
+		if principal.Role != ViewerRole && principal.Role != OperatorRole {
+			return nil, fmt.Errorf("%w [%v] of principal[%v]", ErrInvalidRole, principal.Role, principal.Name)
+		}
+		if principal.Key == "" && principal.CommonName == "" {
+			return nil, fmt.Errorf("%w [%v]", ErrNoCredential, principal.Name)
+		}
+	}
+
+	return principals, nil
+}
+
+type authenticator struct {
+	principals []*Principal
+}
+
+// Return principal of the request. Verified client certificate is
+// preferred over api key.
+func (a *authenticator) authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, principal := range a.principals {
+			if principal.CommonName != "" && principal.CommonName == commonName {
+				return principal, nil
+			}
+		}
+	}
+
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	// Compare hashes in constant time, so neither content nor length
+	// of keys leaks through timing.
+	keyHash := sha256.Sum256([]byte(key))
+	for _, principal := range a.principals {
+		if principal.Key == "" {
+			continue
+		}
+
+		principalKeyHash := sha256.Sum256([]byte(principal.Key))
+		if subtle.ConstantTimeCompare(keyHash[:], principalKeyHash[:]) == 1 {
+			return principal, nil
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
@@ -0,0 +1,346 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/certs"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/imroc/req/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	ErrInvalidClientCa = errors.New("no certificate found in admin client ca file")
+	ErrInsecureAdmin   = errors.New("admin api on non-loopback address needs tls certificate")
+)
+
+// Key of authenticated principal in echo context.
+const principalKey = "principal"
+
+// Admin api on a separate listener, so it can be bound to an internal
+// interface instead of the public port.
+type Server struct {
+	config *config.Config
+
+	// Nil if admin api is disabled.
+	server *http.Server
+
+	echo *echo.Echo
+
+	authenticator *authenticator
+
+	queueConfig *config.QueueConfig
+
+	metrics *infra.Metrics
+
+	httpClient *req.Client
+
+	loggerFactory *infra.LoggerFactory
+
+	logger *zap.SugaredLogger
+
+	// Records every admin request, including rejected ones.
+	auditLogger *zap.SugaredLogger
+}
+
+func ProvideServer(config *config.Config, certStore *certs.Store, queueConfig *config.QueueConfig, metrics *infra.Metrics, httpClient *req.Client, loggerFactory *infra.LoggerFactory) (*Server, error) {
+	s := &Server{
+		config:        config,
+		authenticator: &authenticator{},
+		queueConfig:   queueConfig,
+		metrics:       metrics,
+		httpClient:    httpClient,
+		loggerFactory: loggerFactory,
+		logger:        loggerFactory.Create("AdminServer").Sugar(),
+		auditLogger:   loggerFactory.Create("Audit").Sugar(),
+	}
+
+	if *config.AdminAddr == "" {
+		s.logger.Infof("admin api disabled")
+		return s, nil
+	}
+
+	if *config.AdminPrincipalsFile != "" {
+		principals, err := loadPrincipals(*config.AdminPrincipalsFile)
+		if err != nil {
+			s.logger.Errorf("cannot load admin principals file[%v] %v", *config.AdminPrincipalsFile, err)
+			return nil, err
+		}
+		s.authenticator.principals = principals
+	}
+
+	if len(s.authenticator.principals) == 0 {
+		s.logger.Warnf("no admin principal, every admin request will be rejected")
+	}
+
+	tlsConfig, err := s.provideTlsConfig(certStore)
+	if err != nil {
+		s.logger.Errorf("cannot provide admin tls config addr[%v] clientCaFile[%v] %v", *config.AdminAddr, *config.AdminClientCaFile, err)
+		return nil, err
+	}
+
+	s.echo = echo.New()
+	s.echo.HideBanner = true
+	s.echo.Use(middleware.RequestID())
+	s.echo.Use(s.audit)
+	s.echo.Use(middleware.Recover())
+	s.echo.Use(s.authenticate)
+
+	s.echo.GET("/metrics", s.getMetrics, requireRole(ViewerRole))
+	s.echo.PUT("/debug", s.enableDebug, requireRole(OperatorRole))
+	s.echo.DELETE("/debug", s.disableDebug, requireRole(OperatorRole))
+	s.echo.GET("/log-level", s.getLogLevels, requireRole(ViewerRole))
+	s.echo.PUT("/log-level/:name", s.setLogLevel, requireRole(OperatorRole))
+	s.echo.GET("/queue-config", s.getQueueSettings, requireRole(ViewerRole))
+	s.echo.PUT("/queue-config", s.updateQueueSettings, requireRole(OperatorRole))
+	s.echo.GET("/queue-config/history", s.getQueueConfigHistory, requireRole(ViewerRole))
+	s.echo.POST("/queue-config/rollback", s.rollbackQueueSettings, requireRole(OperatorRole))
+
+	s.server = &http.Server{
+		Addr:      *config.AdminAddr,
+		Handler:   s.echo,
+		TLSConfig: tlsConfig,
+	}
+
+	return s, nil
+}
+
+// Api keys and queue settings must not travel in plain text over the
+// network, so admin api is served over TLS unless it only listens on
+// loopback. Client certificate is verified if admin client ca is set.
+// It's optional, so that api key still works. Server certificate is
+// the same as public port.
+func (s *Server) provideTlsConfig(certStore *certs.Store) (*tls.Config, error) {
+	if *s.config.AdminClientCaFile == "" && isLoopbackAddr(*s.config.AdminAddr) {
+		return nil, nil
+	}
+
+	if certStore.IsEmpty() {
+		return nil, ErrInsecureAdmin
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certStore.GetCertificate,
+	}
+	if *s.config.AdminClientCaFile == "" {
+		return tlsConfig, nil
+	}
+
+	caCert, err := os.ReadFile(*s.config.AdminClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(caCert) {
+		return nil, ErrInvalidClientCa
+	}
+
+	tlsConfig.ClientCAs = clientCas
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// Whether addr only accepts connections from the same host. Empty
+// host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) Run() {
+	if s.server == nil {
+		return
+	}
+
+	var err error
+	if s.server.TLSConfig != nil {
+		s.logger.Infof("admin server starts listening on addr[%v] with TLS clientCa[%v]", s.server.Addr, s.server.TLSConfig.ClientCAs != nil)
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		s.logger.Infof("admin server starts listening on addr[%v]", s.server.Addr)
+		err = s.server.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		s.logger.Error(err)
+	}
+}
+
+func (s *Server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		principal, err := s.authenticator.authenticate(c.Request())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+
+		c.Set(principalKey, principal)
+		return next(c)
+	}
+}
+
+func requireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal := c.Get(principalKey).(*Principal)
+			if !principal.Role.includes(role) {
+				return echo.NewHTTPError(http.StatusForbidden, ErrPermissionDenied.Error())
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *Server) audit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Handle error here so that response status is known.
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		fields := []interface{}{
+			"method", c.Request().Method,
+			"uri", c.Request().RequestURI,
+			"status", c.Response().Status,
+			"ip", c.RealIP(),
+			"requestId", c.Response().Header().Get(echo.HeaderXRequestID),
+		}
+		if principal, ok := c.Get(principalKey).(*Principal); ok {
+			fields = append(fields, "principal", principal.Name, "role", principal.Role)
+		}
+
+		s.auditLogger.Infow("admin request", fields...)
+		return nil
+	}
+}
+
+func (s *Server) getMetrics(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, []byte(s.metrics.String()))
+}
+
+func (s *Server) enableDebug(c echo.Context) error {
+	s.loggerFactory.SetLevel("", zapcore.DebugLevel)
+	s.httpClient.EnableDumpAll()
+	s.logger.Info("debug logging enabled")
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) disableDebug(c echo.Context) error {
+	s.loggerFactory.SetLevel("", zapcore.InfoLevel)
+	s.httpClient.DisableDumpAll()
+	s.logger.Info("debug logging disabled")
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) getLogLevels(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.loggerFactory.Levels())
+}
+
+// Set level of one named logger, eg. PUT /log-level/Hub?level=debug
+func (s *Server) setLogLevel(c echo.Context) error {
+	level, err := zapcore.ParseLevel(c.QueryParam("level"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	s.loggerFactory.SetLevel(c.Param("name"), level)
+	s.logger.Infow("log level changed", "logger", c.Param("name"), "level", level)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) getQueueSettings(c echo.Context) error {
+	settings, err := s.queueConfig.GetSettings(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+// Version is the one client read, update is rejected if others have
+// changed settings since then.
+type updateQueueSettingsRequest struct {
+	Version int64 `json:"version"`
+
+	config.QueueSettingsUpdate
+}
+
+func (s *Server) updateQueueSettings(c echo.Context) error {
+	request := &updateQueueSettingsRequest{}
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+
+	principal := c.Get(principalKey).(*Principal)
+	change, err := s.queueConfig.UpdateSettings(c.Request().Context(), request.Version, &request.QueueSettingsUpdate, principal.Name)
+	if err != nil {
+		return queueSettingsError(err)
+	}
+	return c.JSON(http.StatusOK, change)
+}
+
+// Newest first, eg. GET /queue-config/history?limit=20. No limit means
+// all.
+func (s *Server) getQueueConfigHistory(c echo.Context) error {
+	var limit int64
+	if c.QueryParam("limit") != "" {
+		var err error
+		if limit, err = strconv.ParseInt(c.QueryParam("limit"), 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	history, err := s.queueConfig.History(c.Request().Context(), limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+type rollbackQueueSettingsRequest struct {
+	Version int64 `json:"version"`
+
+	ToVersion int64 `json:"toVersion"`
+}
+
+func (s *Server) rollbackQueueSettings(c echo.Context) error {
+	request := &rollbackQueueSettingsRequest{}
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+
+	principal := c.Get(principalKey).(*Principal)
+	change, err := s.queueConfig.RollbackSettings(c.Request().Context(), request.Version, request.ToVersion, principal.Name)
+	if err != nil {
+		return queueSettingsError(err)
+	}
+	return c.JSON(http.StatusOK, change)
+}
+
+func queueSettingsError(err error) error {
+	switch {
+	case errors.Is(err, config.ErrVersionConflict):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, config.ErrInvalidQueueSettings), errors.Is(err, config.ErrVersionNotFound):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		return err
+	}
+}
@@ -0,0 +1,233 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/certs"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+// Write principals file and use it for the test.
+func setPrincipals(t *testing.T, principals string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(path, []byte(principals), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "admin-principals-file", path)
+}
+
+// Write a self-signed certificate and use it as certificate of public
+// port for the test.
+func setTestCert(t *testing.T) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "admin.example.com"},
+		DNSNames:     []string{"admin.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "public.crt"), filepath.Join(dir, "private.key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "tls-cert-path", certPath)
+	setFlag(t, "tls-private-key-path", keyPath)
+}
+
+func newTestServer(t *testing.T) (*Server, error) {
+	t.Helper()
+
+	certStore, err := certs.ProvideStore(config.CFG, testMetrics, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ProvideServer(config.CFG, certStore, nil, testMetrics, nil, testLoggerFactory)
+}
+
+func TestAdminTls(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		addr    string
+		hasCert bool
+		isTls   bool
+		err     error
+	}{
+		{name: "loopback", addr: "127.0.0.1:5488", isTls: false},
+		{name: "localhost", addr: "localhost:5488", isTls: false},
+		{name: "ipv6 loopback", addr: "[::1]:5488", isTls: false},
+		{name: "every interface", addr: ":5488", err: ErrInsecureAdmin},
+		{name: "internal interface", addr: "10.0.0.1:5488", err: ErrInsecureAdmin},
+		{name: "internal interface with cert", addr: "10.0.0.1:5488", hasCert: true, isTls: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, "admin-addr", tc.addr)
+			if tc.hasCert {
+				setTestCert(t)
+			}
+
+			s, err := newTestServer(t)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if isTls := s.server.TLSConfig != nil; isTls != tc.isTls {
+				t.Fatalf("tls [%v], want [%v]", isTls, tc.isTls)
+			}
+		})
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	setPrincipals(t, `[
+		{"name": "viewer", "role": "viewer", "key": "viewer-key"},
+		{"name": "operator", "role": "operator", "key": "operator-key"}
+	]`)
+
+	s, err := newTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		statusCode int
+	}{
+		{name: "no key", method: http.MethodGet, path: "/log-level", statusCode: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/log-level", key: "other-key", statusCode: http.StatusUnauthorized},
+		{name: "viewer reads", method: http.MethodGet, path: "/log-level", key: "viewer-key", statusCode: http.StatusOK},
+		{name: "viewer changes", method: http.MethodPut, path: "/log-level/Hub?level=warn", key: "viewer-key", statusCode: http.StatusForbidden},
+		{name: "operator reads", method: http.MethodGet, path: "/log-level", key: "operator-key", statusCode: http.StatusOK},
+		{name: "operator changes", method: http.MethodPut, path: "/log-level/Hub?level=warn", key: "operator-key", statusCode: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.key != "" {
+				req.Header.Set(apiKeyHeader, tc.key)
+			}
+
+			rec := httptest.NewRecorder()
+			s.echo.ServeHTTP(rec, req)
+			if rec.Code != tc.statusCode {
+				t.Fatalf("status code[%v] body[%s], want [%v]", rec.Code, rec.Body, tc.statusCode)
+			}
+		})
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	setPrincipals(t, `[{"name": "viewer", "role": "viewer", "key": "viewer-key"}]`)
+	testMetrics.Set("adminTestGauge", 3)
+
+	s, err := newTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(apiKeyHeader, "viewer-key")
+	rec := httptest.NewRecorder()
+	s.echo.ServeHTTP(rec, req)
+
+	// Only metrics of this server, without command line of expvar.
+	vars := map[string]any{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("status code[%v] body[%s] %v", rec.Code, rec.Body, err)
+	}
+	if vars["adminTestGauge"] != float64(3) {
+		t.Fatalf("metrics %v, want adminTestGauge of 3", vars)
+	}
+	for _, name := range []string{"cmdline", "memstats"} {
+		if _, ok := vars[name]; ok {
+			t.Fatalf("metrics include [%v]", name)
+		}
+	}
+}
+
+func TestLoadPrincipals(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		principals string
+		err        error
+	}{
+		{name: "valid", principals: `[{"name": "a", "role": "viewer", "key": "k"}, {"name": "b", "role": "operator", "commonName": "b.internal"}]`},
+		{name: "unknown role", principals: `[{"name": "a", "role": "admin", "key": "k"}]`, err: ErrInvalidRole},
+		{name: "no credential", principals: `[{"name": "a", "role": "viewer"}]`, err: ErrNoCredential},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "principals.json")
+			if err := os.WriteFile(path, []byte(tc.principals), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := loadPrincipals(path); !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+		})
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/client"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
-	"os"
+	"io"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/imroc/req/v3"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -21,21 +29,36 @@ type Application struct {
 	queueConfig   *config.QueueConfig
 	clientFactory *client.ClientFactory
 	hub           *client.Hub
+	rejecter      *client.Rejecter
+	sseSessions   *client.SseSessions
+	versionPolicy *client.VersionPolicy
 	queue         *queue.Queue
 	wsUpgrader    *websocket.Upgrader
 	httpClient    *req.Client
+	metrics       *infra.Metrics
+	tracerFactory *infra.TracerFactory
+	tracer        trace.Tracer
 	logger        *zap.SugaredLogger
 }
 
-func ProvideApplication(config *config.Config, queueConfig *config.QueueConfig, clientFactory *client.ClientFactory, hub *client.Hub, queue *queue.Queue, httpClient *req.Client, loggerFactory *infra.LoggerFactory) *Application {
+func ProvideApplication(config *config.Config, queueConfig *config.QueueConfig, clientFactory *client.ClientFactory, hub *client.Hub, rejecter *client.Rejecter, sseSessions *client.SseSessions, versionPolicy *client.VersionPolicy, queue *queue.Queue, httpClient *req.Client, metrics *infra.Metrics, tracerFactory *infra.TracerFactory, loggerFactory *infra.LoggerFactory) *Application {
 	return &Application{
 		config:        config,
 		queueConfig:   queueConfig,
 		clientFactory: clientFactory,
 		hub:           hub,
+		rejecter:      rejecter,
+		sseSessions:   sseSessions,
+		versionPolicy: versionPolicy,
 		queue:         queue,
-		wsUpgrader:    &websocket.Upgrader{},
+		wsUpgrader: &websocket.Upgrader{
+			Subprotocols:      msg.CodecNames(),
+			EnableCompression: *config.WsCompression,
+		},
 		httpClient:    httpClient,
+		metrics:       metrics,
+		tracerFactory: tracerFactory,
+		tracer:        tracerFactory.Create("Application"),
 		logger:        loggerFactory.Create("Application").Sugar(),
 	}
 }
@@ -44,72 +67,328 @@ func (a *Application) Run() {
 	go a.queueConfig.Run()
 	go a.hub.Run()
 	go a.queue.Run()
+	go a.rejecter.Run()
+}
+
+// Header of ws request asking server to decide before upgrade. Server
+// replies ShouldQueueEvent with 200 instead of upgrading if client
+// doesn't need queue, or an error with 400/409 if client would be
+// rejected, or 426 if client has to update. Old clients without it are
+// upgraded and rejected over ws.
+const precheckHeader = "precheck"
+
+type errorResponse struct {
+	Message string `json:"message"`
 }
 
 func (a *Application) HandleWs(c echo.Context) error {
+	// Root span of the ws session. Not derived from request context
+	// since it's canceled once this handler returns, while the session
+	// lasts until client closes.
+	metadata := client.NewConnMetadata(c)
+	isPrecheck := c.Request().Header.Get(precheckHeader) == "true"
+	ctx, span := a.tracer.Start(a.tracerFactory.Extract(context.Background(), c.Request().Header), "ws session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("clientId", c.Request().Header.Get("id")),
+			attribute.String("requestId", metadata.RequestId),
+			attribute.String("ip", metadata.Ip),
+			attribute.Bool("precheck", isPrecheck),
+		),
+	)
+
+	protocol, updateNotice, protocolErr := a.versionPolicy.Check(c.Request().Header)
+	if protocol != nil {
+		span.SetAttributes(attribute.Int("protocolVersion", int(protocol.Version)))
+	}
+
+	// Decide before upgrade, so that client which doesn't need queue
+	// never opens a ws connection.
+	var shouldQueue bool
+	if isPrecheck {
+		if protocolErr != nil {
+			a.logger.Infof("reject ip[%v] before upgrade %v", metadata.Ip, protocolErr)
+			span.SetStatus(codes.Error, protocolErr.Error())
+			span.End()
+			return a.replyProtocolError(c, updateNotice, protocolErr)
+		}
+
+		if err := a.clientFactory.Precheck(c); err != nil {
+			a.logger.Infof("reject ip[%v] before upgrade %v", metadata.Ip, err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			return c.JSON(precheckStatusCode(err), &errorResponse{Message: err.Error()})
+		}
+
+		shouldQueue = a.shouldQueue(ctx, c.Request().Header.Get("jwt"), metadata)
+		if !shouldQueue {
+			a.metrics.Add("rejectedBeforeUpgrade", 1)
+			span.SetAttributes(attribute.Bool("shouldQueue", false))
+			span.End()
+			return c.JSON(http.StatusOK, &msg.ShouldQueueEvent{ShouldQueue: false})
+		}
+	}
+
 	conn, err := a.wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 		return err
 	}
+	// Level is validated by config, and only used if permessage-deflate
+	// is negotiated.
+	conn.SetCompressionLevel(*a.config.WsCompressionLevel)
 
-	// Close connection right away if this client doesn't need to be
-	// in queue.
-	// 1. queue is disabled
-	// 2. queue is enabled, but current online users has not reach threshold.
-	// 2. client jwt's last heartbeat < 5 min or is in game
-	// 3. main server under maintenance
-	if !a.queueConfig.ShouldQueue() {
-		a.rejectWs(conn, websocket.CloseNormalClosure, "No need queue", true)
+	if protocolErr != nil {
+		a.logger.Infof("reject ip[%v] %v", metadata.Ip, protocolErr)
+		span.SetStatus(codes.Error, protocolErr.Error())
+		defer span.End()
+		a.rejectProtocolWs(conn, updateNotice, protocolErr)
 		return nil
 	}
 
-	jwt := c.Request().Header.Get("jwt")
-	if needQueue := a.sessionNeedQueue(jwt); !needQueue {
+	if !isPrecheck {
+		shouldQueue = a.shouldQueue(ctx, c.Request().Header.Get("jwt"), metadata)
+	}
+	span.SetAttributes(attribute.Bool("shouldQueue", shouldQueue))
+	if !shouldQueue {
+		defer span.End()
 		a.rejectWs(conn, websocket.CloseNormalClosure, "No need queue", true)
 		return nil
 	}
 
-	client, err := a.clientFactory.Create(c, conn)
-	if err != nil {
+	newClient, err := a.clientFactory.Create(ctx, c, conn)
+	if errors.Is(err, client.ErrTooManyConnections) {
+		a.logger.Infof("reject ip[%v] %v", c.RealIP(), err)
+		span.SetStatus(codes.Error, err.Error())
+		defer span.End()
+		a.rejectWs(conn, websocket.ClosePolicyViolation, err.Error(), false)
+		return nil
+	} else if err != nil {
 		a.logger.Errorf("cannot create client %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		defer span.End()
 		a.rejectWs(conn, websocket.CloseUnsupportedData, err.Error(), false)
 		return nil
 	}
 
-	go client.Run()
+	go newClient.Run()
 
 	return nil
 }
 
+// Tell client whether it needs queue without opening a ws connection.
+// Client that doesn't need queue logins main server directly, otherwise
+// it connects /ws. Decision may change in between, so /ws still rejects
+// client that no longer needs queue.
+func (a *Application) HandleShouldQueue(c echo.Context) error {
+	metadata := client.NewConnMetadata(c)
+	ctx, span := a.tracer.Start(a.tracerFactory.Extract(c.Request().Context(), c.Request().Header), "should queue",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("clientId", c.Request().Header.Get("id")),
+			attribute.String("requestId", metadata.RequestId),
+			attribute.String("ip", metadata.Ip),
+		),
+	)
+	defer span.End()
+
+	if _, updateNotice, err := a.versionPolicy.Check(c.Request().Header); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return a.replyProtocolError(c, updateNotice, err)
+	}
+
+	shouldQueue := a.shouldQueue(ctx, c.Request().Header.Get("jwt"), metadata)
+	span.SetAttributes(attribute.Bool("shouldQueue", shouldQueue))
+	return c.JSON(http.StatusOK, &msg.ShouldQueueEvent{ShouldQueue: shouldQueue})
+}
+
+// Client doesn't need to be in queue if
+// 1. queue is disabled
+// 2. queue is enabled, but current online users has not reach threshold.
+// 3. client jwt's last heartbeat < 5 min or is in game
+// 4. main server under maintenance
+func (a *Application) shouldQueue(ctx context.Context, jwt string, metadata *client.ConnMetadata) bool {
+	if !a.queueConfig.ShouldQueue() {
+		return false
+	}
+	return a.sessionNeedQueue(ctx, jwt, metadata)
+}
+
+func precheckStatusCode(err error) int {
+	if errors.Is(err, client.ErrTooManyConnections) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// Close connection in background, so that handler returns right away.
 func (a *Application) rejectWs(conn *websocket.Conn, closeCode int, closeReason string, shouldSendEvent bool) {
+	var wsMessage *msg.WsMessage
 	if shouldSendEvent {
-		rawEvent, err := json.Marshal(&msg.ShouldQueueEvent{
-			ShouldQueue: false,
-		})
-		if err != nil {
+		var err error
+		if wsMessage, err = noNeedQueueMessage(); err != nil {
 			a.logger.Errorf("cannot marshal ShouldQueueEvent %v", err)
 			return
 		}
+	}
 
-		wsMessage := &msg.WsMessage{
-			EventCode: msg.ShouldQueueCode,
-			EventData: rawEvent,
-		}
-		if err := conn.WriteJSON(wsMessage); err != nil {
-			a.logger.Errorf("cannot write json to ws conn %v", err)
+	a.rejecter.Reject(conn, wsMessage, closeCode, closeReason)
+}
+
+// Reject client whose protocol is not accepted. Outdated client is told
+// to update by UpdateRequired event and close code.
+func (a *Application) rejectProtocolWs(conn *websocket.Conn, updateNotice *msg.UpdateRequiredServerEvent, err error) {
+	if !errors.Is(err, client.ErrUpdateRequired) {
+		a.rejecter.Reject(conn, nil, websocket.CloseUnsupportedData, err.Error())
+		return
+	}
+
+	a.metrics.Add("rejectedByProtocolVersion", 1)
+	wsMessage, err := client.UpdateRequiredMessage(updateNotice)
+	if err != nil {
+		a.logger.Errorf("cannot marshal UpdateRequiredServerEvent %v", err)
+	}
+	a.rejecter.Reject(conn, wsMessage, client.CloseUpdateRequired, "Update required")
+}
+
+// Reply 426 with the forced UpdateRequiredServerEvent to outdated client,
+// or 400 if protocol headers are invalid.
+func (a *Application) replyProtocolError(c echo.Context, updateNotice *msg.UpdateRequiredServerEvent, err error) error {
+	if errors.Is(err, client.ErrUpdateRequired) {
+		a.metrics.Add("rejectedByProtocolVersion", 1)
+		return c.JSON(http.StatusUpgradeRequired, updateNotice)
+	}
+	return c.JSON(http.StatusBadRequest, &errorResponse{Message: err.Error()})
+}
+
+func noNeedQueueMessage() (*msg.WsMessage, error) {
+	rawEvent, err := json.Marshal(&msg.ShouldQueueEvent{
+		ShouldQueue: false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg.WsMessage{
+		EventCode: msg.ShouldQueueCode,
+		EventData: rawEvent,
+	}, nil
+}
+
+// Fallback of /ws for networks that break websockets. Server events
+// are streamed as server-sent events and client events are posted to
+// /sse/messages. A broken stream is resumed with ticketId and
+// sessionToken headers.
+func (a *Application) HandleSse(c echo.Context) error {
+	if ticketId := c.Request().Header.Get("ticketId"); ticketId != "" {
+		return a.resumeSse(c, ticketId)
+	}
+
+	// Root span of the sse session, lasts until client closes like ws
+	// session.
+	metadata := client.NewConnMetadata(c)
+	ctx, span := a.tracer.Start(a.tracerFactory.Extract(context.Background(), c.Request().Header), "sse session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("clientId", c.Request().Header.Get("id")),
+			attribute.String("requestId", metadata.RequestId),
+			attribute.String("ip", metadata.Ip),
+		),
+	)
+
+	if _, updateNotice, err := a.versionPolicy.Check(c.Request().Header); err != nil {
+		a.logger.Infof("reject ip[%v] sse %v", metadata.Ip, err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return a.replyProtocolError(c, updateNotice, err)
+	}
+
+	if err := a.clientFactory.Precheck(c); err != nil {
+		a.logger.Infof("reject ip[%v] sse %v", metadata.Ip, err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return c.JSON(precheckStatusCode(err), &errorResponse{Message: err.Error()})
+	}
+
+	shouldQueue := a.shouldQueue(ctx, c.Request().Header.Get("jwt"), metadata)
+	span.SetAttributes(attribute.Bool("shouldQueue", shouldQueue))
+	if !shouldQueue {
+		defer span.End()
+		wsMessage, err := noNeedQueueMessage()
+		if err != nil {
+			return err
 		}
+		return client.RejectSse(c.Response(), wsMessage, websocket.CloseNormalClosure, "No need queue")
 	}
 
-	time.Sleep(client.CloseGracePeriod) // Ensure that other message is sent.
-	if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason)); err != nil {
-		a.logger.Debugf("cannot write close message to ws conn %v", err)
+	newClient, transport, err := a.clientFactory.CreateSse(ctx, c)
+	if err != nil {
+		a.logger.Infof("cannot create sse client %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return c.JSON(precheckStatusCode(err), &errorResponse{Message: err.Error()})
 	}
 
-	time.Sleep(client.CloseGracePeriod)
-	conn.Close() // Ensure that close message is sent.
+	go newClient.Run()
+
+	return a.streamSse(c, transport, 0)
+}
+
+// Attach stream to the session of ticketId. Events after Last-Event-ID
+// are replayed, all of them if it's missing.
+func (a *Application) resumeSse(c echo.Context, ticketId string) error {
+	transport, err := a.sseSessions.Get(ticketId, c.Request().Header.Get("sessionToken"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, &errorResponse{Message: err.Error()})
+	}
+
+	lastEventId, _ := strconv.ParseUint(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+	a.metrics.Add("sseResumes", 1)
+	return a.streamSse(c, transport, lastEventId)
+}
+
+// Block until stream ends. Session is kept for resumption if request
+// is canceled first.
+func (a *Application) streamSse(c echo.Context, transport *client.SseTransport, lastEventId uint64) error {
+	end, detach, err := transport.Attach(c.Response(), lastEventId)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, &errorResponse{Message: err.Error()})
+	}
+
+	select {
+	case <-end:
+	case <-c.Request().Context().Done():
+		detach()
+	}
+	return nil
+}
+
+// Client event of a sse session, same as a ws message.
+func (a *Application) HandleSseMessage(c echo.Context) error {
+	transport, err := a.sseSessions.Get(c.Request().Header.Get("ticketId"), c.Request().Header.Get("sessionToken"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, &errorResponse{Message: err.Error()})
+	}
+
+	maxBytes := *a.config.MaxMessageBytes
+	message, err := io.ReadAll(io.LimitReader(c.Request().Body, int64(maxBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(message) > maxBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, &errorResponse{Message: fmt.Sprintf("message exceeds %v bytes", maxBytes)})
+	}
+
+	if err := transport.Post(message); errors.Is(err, client.ErrTooManyMessages) {
+		return c.JSON(http.StatusTooManyRequests, &errorResponse{Message: err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusNotFound, &errorResponse{Message: err.Error()})
+	}
+	return c.NoContent(http.StatusAccepted)
 }
 
-func (a *Application) sessionNeedQueue(jwt string) bool {
+func (a *Application) sessionNeedQueue(ctx context.Context, jwt string, metadata *client.ConnMetadata) bool {
 
 	roomSessionResult := &struct {
 		Data struct {
@@ -119,9 +398,11 @@ func (a *Application) sessionNeedQueue(jwt string) bool {
 	}{}
 
 	resp, err := a.httpClient.R().
+		SetContext(ctx).
+		SetHeaders(metadata.Headers()).
 		SetHeader("jwt", jwt).
 		SetResult(roomSessionResult).
-		Get(os.Getenv("MAIN_SERVER_HOST") + "/api/room/session")
+		Get(*a.config.MainServerHost + "/api/room/session")
 
 	if err != nil {
 		a.logger.Errorf("request failed %v", err)
@@ -149,9 +430,11 @@ func (a *Application) sessionNeedQueue(jwt string) bool {
 	}{}
 
 	resp, err = a.httpClient.R().
+		SetContext(ctx).
+		SetHeaders(metadata.Headers()).
 		SetHeader("jwt", jwt).
 		SetResult(userSessionResult).
-		Get(os.Getenv("MAIN_SERVER_HOST") + "/api/user/session")
+		Get(*a.config.MainServerHost + "/api/user/session")
 
 	if err != nil {
 		a.logger.Errorf("request failed %v", err)
@@ -175,7 +458,7 @@ func (a *Application) sessionNeedQueue(jwt string) bool {
 		// main server. However, he has to stay online. If he goes offline
 		// over a period of time, he has to go into login queue again.
 		// This constant controls the time period.
-		if time.Since(lastHeartbeatTime) < time.Duration(*a.config.SessionStaleSeconds)*time.Second {
+		if time.Since(lastHeartbeatTime) < time.Duration(a.config.SessionStaleSeconds.Get())*time.Second {
 			a.logger.Debugf("no need que since client has userSessionResult[%+v]", userSessionResult)
 			return false
 		}
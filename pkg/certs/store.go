@@ -0,0 +1,310 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+var ErrNoCertificate = errors.New("no certificate loaded")
+
+const (
+	// File names of certificate and private key in each domain
+	// directory of cert dir.
+	certFileName = "public.crt"
+	keyFileName  = "private.key"
+
+	// Wait for files to settle before reloading, since a renewal
+	// usually writes several files.
+	reloadDelay = time.Second
+
+	// Interval to check expiry of loaded certificates.
+	expiryCheckInterval = time.Hour
+
+	// Warn if a certificate expires within this period.
+	expiryWarningPeriod = 30 * 24 * time.Hour
+)
+
+// Certificates loaded at the same time. Replaced as a whole on reload,
+// so handshakes never see a half loaded set.
+type certSet struct {
+	// Key value: dns name (may be wildcard, eg. *.example.com) ->
+	// certificate.
+	byName map[string]*tls.Certificate
+
+	// Used when client sends no SNI or an unknown name.
+	defaultCert *tls.Certificate
+
+	certs []*tls.Certificate
+}
+
+// Store of TLS certificates selected by SNI. Reloaded when files change
+// or on SIGHUP. Reload only affects new handshakes, established
+// websocket connections are kept.
+type Store struct {
+	// Directory of domain directories, each holds public.crt and
+	// private.key. Empty if a single certificate is loaded from
+	// certPath and keyPath.
+	dir string
+
+	certPath string
+
+	keyPath string
+
+	certs atomic.Pointer[certSet]
+
+	metrics *infra.Metrics
+
+	logger *zap.SugaredLogger
+}
+
+func ProvideStore(config *config.Config, metrics *infra.Metrics, loggerFactory *infra.LoggerFactory) (*Store, error) {
+	s := &Store{
+		dir:      *config.TlsCertDir,
+		certPath: *config.TlsCertPath,
+		keyPath:  *config.TlsPrivateKeyPath,
+		metrics:  metrics,
+		logger:   loggerFactory.Create("CertStore").Sugar(),
+	}
+	s.certs.Store(&certSet{byName: make(map[string]*tls.Certificate)})
+
+	if s.dir == "" && s.certPath == "" {
+		s.logger.Infof("no certificate configured")
+		return s, nil
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) IsEmpty() bool {
+	return s.certs.Load().defaultCert == nil
+}
+
+// Select certificate by SNI. Used as tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.certs.Load()
+	if set.defaultCert == nil {
+		return nil, ErrNoCertificate
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	return set.defaultCert, nil
+}
+
+// Load all certificates again. Current certificates are kept if any of
+// them fails to load.
+func (s *Store) Reload() error {
+	var pairs [][2]string
+	if s.dir != "" {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			s.logger.Errorf("cannot read cert dir[%v] %v", s.dir, err)
+			return err
+		}
+
+		for _, entry := range entries {
+			domainDir := filepath.Join(s.dir, entry.Name())
+			if isHidden(entry.Name()) || !isDir(domainDir) {
+				continue
+			}
+
+			certPath, keyPath := filepath.Join(domainDir, certFileName), filepath.Join(domainDir, keyFileName)
+			if _, err := os.Stat(keyPath); err != nil {
+				s.logger.Warnf("skip domain dir[%v] without private key", domainDir)
+				continue
+			}
+			pairs = append(pairs, [2]string{certPath, keyPath})
+		}
+	} else {
+		pairs = append(pairs, [2]string{s.certPath, s.keyPath})
+	}
+
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			s.logger.Errorf("cannot load certificate[%v] %v", pair[0], err)
+			return err
+		}
+
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			s.logger.Errorf("cannot parse certificate[%v] %v", pair[0], err)
+			return err
+		}
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			set.byName[strings.ToLower(name)] = &cert
+		}
+
+		if set.defaultCert == nil {
+			set.defaultCert = &cert
+		}
+		set.certs = append(set.certs, &cert)
+		s.logger.Infof("loaded certificate[%v] names%v expireTime[%v]", pair[0], names, cert.Leaf.NotAfter)
+	}
+
+	if set.defaultCert == nil {
+		s.logger.Errorf("no certificate found in cert dir[%v]", s.dir)
+		return ErrNoCertificate
+	}
+
+	s.certs.Store(set)
+	s.checkExpiry()
+	return nil
+}
+
+// Reload certificates on file change or SIGHUP, and check expiry
+// periodically. Runs forever.
+func (s *Store) Watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	expiryTicker := time.NewTicker(expiryCheckInterval)
+	defer expiryTicker.Stop()
+
+	// Never fires until a file changes.
+	reloadTimer := time.NewTimer(reloadDelay)
+	reloadTimer.Stop()
+
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	watcher, err := s.newWatcher()
+	if err != nil {
+		s.logger.Errorf("cannot watch certificate files, only reload on SIGHUP %v", err)
+	} else {
+		defer watcher.Close()
+		fileEvents, fileErrors = watcher.Events, watcher.Errors
+	}
+
+	for {
+		select {
+		case event := <-fileEvents:
+			s.logger.Debugf("certificate file changed event[%v]", event)
+			reloadTimer.Reset(reloadDelay)
+
+		case err := <-fileErrors:
+			s.logger.Errorf("certificate watcher error %v", err)
+
+		case <-reloadTimer.C:
+			s.logger.Infof("reload certificates since files changed")
+			if s.Reload() == nil && watcher != nil {
+				s.watchDomainDirs(watcher)
+			}
+
+		case <-hangup:
+			s.logger.Infof("reload certificates on SIGHUP")
+			if s.Reload() == nil && watcher != nil {
+				s.watchDomainDirs(watcher)
+			}
+
+		case <-expiryTicker.C:
+			s.checkExpiry()
+		}
+	}
+}
+
+// Watch directories instead of files, since renewal tools and k8s
+// secrets replace files by rename, which drops watches on files.
+func (s *Store) newWatcher() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.dir == "" {
+		for _, dir := range []string{filepath.Dir(s.certPath), filepath.Dir(s.keyPath)} {
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return nil, err
+			}
+		}
+		return watcher, nil
+	}
+
+	if err := watcher.Add(s.dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	s.watchDomainDirs(watcher)
+	return watcher, nil
+}
+
+// Watch domain directories, including ones added after start. Adding
+// an already watched directory is a no-op.
+func (s *Store) watchDomainDirs(watcher *fsnotify.Watcher) {
+	if s.dir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.logger.Errorf("cannot read cert dir[%v] %v", s.dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		domainDir := filepath.Join(s.dir, entry.Name())
+		if isHidden(entry.Name()) || !isDir(domainDir) {
+			continue
+		}
+		if err := watcher.Add(domainDir); err != nil {
+			s.logger.Errorf("cannot watch domain dir[%v] %v", domainDir, err)
+		}
+	}
+}
+
+func (s *Store) checkExpiry() {
+	for _, cert := range s.certs.Load().certs {
+		name := cert.Leaf.Subject.CommonName
+		expireIn := time.Until(cert.Leaf.NotAfter)
+		s.metrics.Set(fmt.Sprintf("certExpiryHours[%v]", name), int64(expireIn.Hours()))
+
+		if expireIn <= 0 {
+			s.logger.Errorf("certificate[%v] expired at [%v]", name, cert.Leaf.NotAfter)
+		} else if expireIn < expiryWarningPeriod {
+			s.logger.Warnf("certificate[%v] expires in [%v] at [%v]", name, expireIn.Round(time.Hour), cert.Leaf.NotAfter)
+		}
+	}
+}
+
+// Follow symlinks, since k8s mounts secrets as symlinked directories.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Such as ..data directory of k8s secret volume.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
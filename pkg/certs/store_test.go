@@ -0,0 +1,166 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+// Write a self-signed certificate of the dns names into domain dir of
+// cert dir.
+func writeTestCert(t *testing.T, dir string, domain string, names ...string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domainDir := filepath.Join(dir, domain)
+	if err := os.MkdirAll(domainDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(domainDir, certFileName), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(domainDir, keyFileName), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Common name of certificate selected for the server name.
+func selectedCert(t *testing.T, store *Store, serverName string) string {
+	t.Helper()
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("no certificate for [%v] %v", serverName, err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "a-default", "default.example.com")
+	writeTestCert(t, dir, "b-exact", "queue.example.com")
+	writeTestCert(t, dir, "c-wildcard", "*.example.com")
+	writeTestCert(t, dir, "d-other", "queue.example.org", "queue2.example.org")
+	setFlag(t, "tls-cert-dir", dir)
+
+	store, err := ProvideStore(config.CFG, testMetrics, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "queue.example.com", want: "b-exact"},
+		{serverName: "QUEUE.example.com.", want: "b-exact"},
+		{serverName: "login.example.com", want: "c-wildcard"},
+		{serverName: "queue2.example.org", want: "d-other"},
+		// Wildcard only matches one label.
+		{serverName: "a.login.example.com", want: "a-default"},
+		{serverName: "example.com", want: "a-default"},
+		{serverName: "", want: "a-default"},
+	} {
+		if got := selectedCert(t, store, tc.serverName); got != tc.want {
+			t.Fatalf("selected [%v] for [%v], want [%v]", got, tc.serverName, tc.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "a-default", "queue.example.com")
+	setFlag(t, "tls-cert-dir", dir)
+
+	store, err := ProvideStore(config.CFG, testMetrics, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCert(t, dir, "b-new", "new.example.com")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := selectedCert(t, store, "new.example.com"); got != "b-new" {
+		t.Fatalf("selected [%v] after reload, want [b-new]", got)
+	}
+
+	// Current certificates are kept if any fails to load.
+	if err := os.WriteFile(filepath.Join(dir, "b-new", keyFileName), []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatalf("reload with broken key succeeded")
+	}
+	if got := selectedCert(t, store, "new.example.com"); got != "b-new" {
+		t.Fatalf("selected [%v] after failed reload, want [b-new] kept", got)
+	}
+}
+
+func TestEmptyStore(t *testing.T) {
+	store, err := ProvideStore(config.CFG, testMetrics, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.IsEmpty() {
+		t.Fatalf("store not empty without cert configured")
+	}
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "queue.example.com"}); err != ErrNoCertificate {
+		t.Fatalf("err[%v], want [%v]", err, ErrNoCertificate)
+	}
+}
@@ -0,0 +1,77 @@
+package challenge
+
+import (
+	"errors"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+
+	"github.com/imroc/req/v3"
+	"go.uber.org/zap"
+)
+
+var ErrCaptchaNotConfigured = errors.New("captcha verify url not configured")
+
+// Verify captcha token solved by client with a captcha provider.
+type CaptchaVerifier interface {
+	Verify(token string, ip string) (bool, error)
+}
+
+func ProvideCaptchaVerifier(config *config.Config, httpClient *req.Client, loggerFactory *infra.LoggerFactory) CaptchaVerifier {
+	logger := loggerFactory.Create("CaptchaVerifier").Sugar()
+	if *config.CaptchaVerifyUrl == "" {
+		logger.Infof("no captcha verify url provided, captcha challenge can't be enabled")
+	}
+
+	return &HttpCaptchaVerifier{
+		url:        *config.CaptchaVerifyUrl,
+		secret:     *config.CaptchaSecret,
+		httpClient: httpClient,
+		logger:     logger,
+	}
+}
+
+// Verify token through siteverify api, which is shared by reCAPTCHA,
+// hCaptcha and Turnstile.
+type HttpCaptchaVerifier struct {
+	url string
+
+	secret string
+
+	httpClient *req.Client
+
+	logger *zap.SugaredLogger
+}
+
+func (v *HttpCaptchaVerifier) Verify(token string, ip string) (bool, error) {
+	verifyResult := &struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}{}
+
+	if v.url == "" {
+		return false, ErrCaptchaNotConfigured
+	}
+
+	resp, err := v.httpClient.R().
+		SetFormData(map[string]string{
+			"secret":   v.secret,
+			"response": token,
+			"remoteip": ip,
+		}).
+		SetSuccessResult(verifyResult).
+		Post(v.url)
+
+	if err != nil {
+		return false, err
+	}
+
+	if resp.IsErrorState() {
+		v.logger.Errorf("verify captcha failed with http status[%v]", resp.Status)
+		return false, nil
+	}
+
+	if !verifyResult.Success {
+		v.logger.Debugf("captcha rejected errorCodes[%v]", verifyResult.ErrorCodes)
+	}
+	return verifyResult.Success, nil
+}
@@ -0,0 +1,115 @@
+package challenge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+
+	"go.uber.org/zap"
+)
+
+type Type string
+
+const (
+	NoneType    Type = ""
+	PowType     Type = "pow"
+	CaptchaType Type = "captcha"
+)
+
+const (
+	// Upper bound of pow difficulty. Prevent a typo in config from
+	// making challenge unsolvable.
+	maxPowDifficulty = 32
+
+	// Number of random bytes in the seed of a challenge.
+	seedBytes = 16
+)
+
+type Challenge struct {
+	Type Type
+
+	// Random seed of the challenge. For pow challenge, solution is
+	// appended to it before hashing.
+	Seed string
+
+	// Number of leading zero bits sha256(Seed + solution) must have.
+	// Only used by pow challenge.
+	Difficulty uint
+}
+
+type Issuer struct {
+	queueConfig *config.QueueConfig
+
+	captchaVerifier CaptchaVerifier
+
+	logger *zap.SugaredLogger
+}
+
+func ProvideIssuer(queueConfig *config.QueueConfig, captchaVerifier CaptchaVerifier, loggerFactory *infra.LoggerFactory) *Issuer {
+	return &Issuer{
+		queueConfig:     queueConfig,
+		captchaVerifier: captchaVerifier,
+		logger:          loggerFactory.Create("ChallengeIssuer").Sugar(),
+	}
+}
+
+// Issue a new challenge according to current queue config. Return nil
+// if client does not need to solve any challenge.
+func (i *Issuer) Issue() (*Challenge, error) {
+	settings := i.queueConfig.Challenge()
+	challengeType := Type(settings.Type)
+	switch challengeType {
+	case NoneType:
+		return nil, nil
+	case PowType:
+		difficulty := settings.Difficulty
+		if difficulty == 0 {
+			return nil, nil
+		}
+		if difficulty > maxPowDifficulty {
+			difficulty = maxPowDifficulty
+		}
+
+		seed, err := newSeed()
+		if err != nil {
+			return nil, err
+		}
+		return &Challenge{Type: PowType, Seed: seed, Difficulty: difficulty}, nil
+	case CaptchaType:
+		seed, err := newSeed()
+		if err != nil {
+			return nil, err
+		}
+		return &Challenge{Type: CaptchaType, Seed: seed}, nil
+	default:
+		i.logger.Warnf("unknown challengeType[%v], skip challenge", challengeType)
+		return nil, nil
+	}
+}
+
+// Verify solution of the challenge. Might block on network for
+// captcha challenge, so don't call it from hub goroutines.
+func (i *Issuer) Verify(challenge *Challenge, solution string, ip string) bool {
+	switch challenge.Type {
+	case PowType:
+		return verifyPow(challenge.Seed, solution, challenge.Difficulty)
+	case CaptchaType:
+		ok, err := i.captchaVerifier.Verify(solution, ip)
+		if err != nil {
+			i.logger.Errorf("cannot verify captcha %v", err)
+			return false
+		}
+		return ok
+	default:
+		return false
+	}
+}
+
+func newSeed() (string, error) {
+	seed := make([]byte, seedBytes)
+	if _, err := rand.Read(seed); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(seed), nil
+}
@@ -0,0 +1,105 @@
+package challenge
+
+import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Accept only ValidToken. Empty ValidToken rejects every token.
+type FakeCaptchaVerifier struct {
+	ValidToken string
+}
+
+func (v *FakeCaptchaVerifier) Verify(token string, ip string) (bool, error) {
+	return v.ValidToken != "" && token == v.ValidToken, nil
+}
+
+func newTestIssuer(captchaVerifier CaptchaVerifier) *Issuer {
+	queueConfig := config.ProvideQueueConfig(config.CFG, nil, nil, infra.ProvideHealth(), testMetrics, infra.ProvideClock(), testLoggerFactory)
+	return ProvideIssuer(queueConfig, captchaVerifier, testLoggerFactory)
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		want uint
+	}{
+		{data: []byte{0x80}, want: 0},
+		{data: []byte{0x01}, want: 7},
+		{data: []byte{0x00, 0x40}, want: 9},
+		{data: []byte{0x00, 0x00}, want: 16},
+		{data: nil, want: 0},
+	} {
+		if got := leadingZeroBits(tc.data); got != tc.want {
+			t.Fatalf("leadingZeroBits(%x) = %v, want %v", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyPow(t *testing.T) {
+	const (
+		seed       = "0123456789abcdef"
+		difficulty = 12
+	)
+	solution := SolvePow(seed, difficulty)
+
+	for _, tc := range []struct {
+		name       string
+		challenge  *Challenge
+		solution   string
+		isVerified bool
+	}{
+		{name: "solved", challenge: &Challenge{Type: PowType, Seed: seed, Difficulty: difficulty}, solution: solution, isVerified: true},
+		{name: "lower difficulty", challenge: &Challenge{Type: PowType, Seed: seed, Difficulty: difficulty - 4}, solution: solution, isVerified: true},
+		{name: "empty solution", challenge: &Challenge{Type: PowType, Seed: seed, Difficulty: difficulty}, solution: "", isVerified: false},
+		{name: "other seed", challenge: &Challenge{Type: PowType, Seed: "fedcba9876543210", Difficulty: difficulty}, solution: solution, isVerified: false},
+		{name: "unknown type", challenge: &Challenge{Type: "unknown", Seed: seed, Difficulty: difficulty}, solution: solution, isVerified: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newTestIssuer(&FakeCaptchaVerifier{})
+
+			if isVerified := issuer.Verify(tc.challenge, tc.solution, "127.0.0.1"); isVerified != tc.isVerified {
+				t.Fatalf("verified [%v], want [%v]", isVerified, tc.isVerified)
+			}
+		})
+	}
+}
+
+func TestVerifyCaptcha(t *testing.T) {
+	issuer := newTestIssuer(&FakeCaptchaVerifier{ValidToken: "token"})
+	challenge := &Challenge{Type: CaptchaType, Seed: "seed"}
+
+	if !issuer.Verify(challenge, "token", "127.0.0.1") {
+		t.Fatalf("valid token rejected")
+	}
+	if issuer.Verify(challenge, "other", "127.0.0.1") {
+		t.Fatalf("invalid token accepted")
+	}
+
+	// Captcha can't pass without verify url.
+	issuer = newTestIssuer(ProvideCaptchaVerifier(config.CFG, nil, testLoggerFactory))
+	if issuer.Verify(challenge, "token", "127.0.0.1") {
+		t.Fatalf("token accepted without verify url")
+	}
+}
+
+func TestIssueWithoutChallenge(t *testing.T) {
+	challenge, err := newTestIssuer(&FakeCaptchaVerifier{}).Issue()
+	if err != nil || challenge != nil {
+		t.Fatalf("issued %+v err[%v], want no challenge by default", challenge, err)
+	}
+}
@@ -0,0 +1,38 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// Hashcash style proof of work. Client must find a solution such that
+// sha256(seed + solution) has at least difficulty leading zero bits.
+// Finding it takes 2^difficulty hashes on average while verifying it
+// only takes one.
+func verifyPow(seed string, solution string, difficulty uint) bool {
+	hash := sha256.Sum256([]byte(seed + solution))
+	return leadingZeroBits(hash[:]) >= difficulty
+}
+
+// Brute force a solution of pow challenge. Used by load testing and
+// simulation clients, real clients implement their own.
+func SolvePow(seed string, difficulty uint) string {
+	for nonce := uint64(0); ; nonce++ {
+		solution := strconv.FormatUint(nonce, 10)
+		if verifyPow(seed, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+func leadingZeroBits(data []byte) uint {
+	var count uint
+	for _, b := range data {
+		if b != 0 {
+			return count + uint(bits.LeadingZeros8(b))
+		}
+		count += 8
+	}
+	return count
+}
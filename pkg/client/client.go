@@ -1,17 +1,24 @@
 package client
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/challenge"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -24,44 +31,126 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait = pingInterval * 5 / 2
 
-	// Grace time before shutting down ws connection.
+	// Time allowed for peer to reply close message before connection
+	// is closed.
 	CloseGracePeriod = 3 * time.Second
 )
 
+var (
+	ErrMissingHeader      = errors.New("missing header")
+	ErrTooManyConnections = errors.New("too many connections from this ip")
+)
+
 type ClientFactory struct {
 	hub           *Hub
+	sseSessions   *SseSessions
+	versionPolicy *VersionPolicy
+	config        *config.Config
 	loggerFactory *infra.LoggerFactory
 }
 
-func ProvideClientFactory(hub *Hub, loggerFactory *infra.LoggerFactory) *ClientFactory {
+func ProvideClientFactory(hub *Hub, sseSessions *SseSessions, versionPolicy *VersionPolicy, config *config.Config, loggerFactory *infra.LoggerFactory) *ClientFactory {
 	return &ClientFactory{
 		hub:           hub,
+		sseSessions:   sseSessions,
+		versionPolicy: versionPolicy,
+		config:        config,
 		loggerFactory: loggerFactory,
 	}
 }
 
-func (f *ClientFactory) Create(c echo.Context, conn *websocket.Conn) (*Client, error) {
-	if c.Request().Header.Get("id") == "" {
-		return nil, errors.New("no id in header")
+// Create client of a ws session. Ctx carries root span of the session,
+// which is ended when client closes.
+func (f *ClientFactory) Create(ctx context.Context, c echo.Context, conn *websocket.Conn) (*Client, error) {
+	client, err := f.create(ctx, c)
+	if err != nil {
+		return nil, err
 	}
 
-	if c.Request().Header.Get("platform") == "" {
-		return nil, errors.New("no platform in header")
+	client.transport = newWsTransport(conn, f.config, client.logger)
+	return client, nil
+}
+
+// Create client of a sse session, whose stream is attached to the
+// returned transport by caller.
+func (f *ClientFactory) CreateSse(ctx context.Context, c echo.Context) (*Client, *SseTransport, error) {
+	client, err := f.create(ctx, c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport, err := f.sseSessions.create(client.id)
+	if err != nil {
+		f.hub.releaseIpConnection(client.ip)
+		return nil, nil, err
+	}
+
+	client.transport = transport
+	return client, transport, nil
+}
+
+// Client without transport.
+func (f *ClientFactory) create(ctx context.Context, c echo.Context) (*Client, error) {
+	if err := checkHeaders(c); err != nil {
+		return nil, err
+	}
+
+	protocol, updateNotice, err := f.versionPolicy.Check(c.Request().Header)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := NewConnMetadata(c)
+	if !f.hub.acquireIpConnection(metadata.Ip) {
+		return nil, ErrTooManyConnections
 	}
 
 	return &Client{
 		id:            c.Request().Header.Get("id"),
 		platform:      c.Request().Header.Get("platform"),
-		ip:            c.RealIP(),
-		conn:          conn,
+		ip:            metadata.Ip,
+		metadata:      metadata,
+		protocol:      protocol,
+		updateNotice:  updateNotice,
+		ctx:           ctx,
+		span:          trace.SpanFromContext(ctx),
 		sendWsMessage: make(chan *msg.WsMessage, 64),
-		close:         make(chan []byte, 1),
+		close:         make(chan *closeRequest, 1),
+		recvDone:      make(chan struct{}),
+		limiter:       rate.NewLimiter(rate.Limit(*f.config.MessageRatePerSecond), *f.config.MessageBurst),
+		config:        f.config,
 		hub:           f.hub,
-		logger:        f.loggerFactory.Create("Client[" + c.Request().Header.Get("id") + "]").Sugar(),
+		logger:        f.loggerFactory.Create("Client").Sugar().With(logFields(c.Request().Header.Get("id"), metadata)...),
 	}, nil
 }
 
-// Client is a middleman between the websocket connection and the hub.
+// Check before upgrade whether Create would reject the request. Ip
+// connection is not reserved, so Create may still fail if other
+// connections of the ip come in between.
+func (f *ClientFactory) Precheck(c echo.Context) error {
+	if err := checkHeaders(c); err != nil {
+		return err
+	}
+
+	if !f.hub.hasIpCapacity(c.RealIP()) {
+		return ErrTooManyConnections
+	}
+	return nil
+}
+
+func checkHeaders(c echo.Context) error {
+	if c.Request().Header.Get("id") == "" {
+		return fmt.Errorf("%w [id]", ErrMissingHeader)
+	}
+
+	if c.Request().Header.Get("platform") == "" {
+		return fmt.Errorf("%w [platform]", ErrMissingHeader)
+	}
+	return nil
+}
+
+// Client is a middleman between the transport, websocket or sse, and
+// the hub.
 type Client struct {
 	// Id generated by frontend client. Use as identifier across
 	// multiple frontend sessions. Should be unique enough.
@@ -71,25 +160,80 @@ type Client struct {
 
 	ip string
 
-	// The websocket connection.
-	conn *websocket.Conn
+	// Forwarded to main server on requests made for this client.
+	metadata *ConnMetadata
+
+	// Protocol client speaks. Messages are adapted to it before written.
+	protocol *msg.Protocol
+
+	// Sent after ShouldQueue if client is outdated but still accepted.
+	// Nil otherwise.
+	updateNotice *msg.UpdateRequiredServerEvent
+
+	// Context carrying root span of the ws session. Spans of work done
+	// for this client are children of it.
+	ctx context.Context
+
+	// Root span of the ws session. Lifecycle of client is recorded as
+	// events of it.
+	span trace.Span
+
+	transport Transport
 
 	// Buffered channel of outbound messages.
 	sendWsMessage chan *msg.WsMessage
 
-	// Notification channel of closing ws and optionally sending ws close message.
-	close chan []byte
+	// Notification channel of closing transport. Handled by sendLoop, so
+	// that whoever closes client never blocks.
+	close chan *closeRequest
 
 	closeOnce sync.Once
 
+	// True once client starts closing. Messages received afterwards
+	// are discarded.
+	isClosing atomic.Bool
+
+	// Closed when recvLoop exits, ie. client has replied close message
+	// or connection is gone.
+	recvDone chan struct{}
+
+	// Token bucket limiting inbound ws messages. Messages over the
+	// limit are dropped.
+	limiter *rate.Limiter
+
+	// Number of inbound ws messages dropped by limiter within the
+	// current violation window.
+	rateViolations int
+
+	// End of the current violation window. Violations are counted
+	// from zero again after it.
+	rateViolationsResetTime time.Time
+
+	// Challenge sent to client and waiting for solution. Nil if no
+	// challenge is pending. Only accessed by hub.
+	challenge *challenge.Challenge
+
+	// True if client has solved a challenge. Only accessed by hub.
+	isChallengePassed bool
+
+	// Position of client's ticket in queue. Zero if client has no
+	// ticket yet. Only accessed by hub when handling queue.
+	ticketPosition int32
+
+	// Login request that client has been asked to refresh credential
+	// for. Only accessed by hub when handling queue.
+	refreshRequestedFor *msg.LoginClientEvent
+
+	config *config.Config
+
 	hub *Hub
 
 	logger *zap.SugaredLogger
 }
 
 func (c *Client) Run() {
-	// WebSocket connections support one concurrent reader and one
-	// concurrent writer. The application ensures that these concurrency
+	// Transports support one concurrent reader and one concurrent
+	// writer. The application ensures that these concurrency
 	// requirements are met by executing all reads from one goroutine and
 	// all writes from the other goroutine.
 	go c.recvLoop()
@@ -97,6 +241,19 @@ func (c *Client) Run() {
 	c.hub.register <- c
 }
 
+type closeRequest struct {
+	// Close code sent to client. Zero if client has closed, then
+	// connection is closed right away.
+	closeCode int
+
+	closeReason string
+
+	// Recorded on close event of the session span.
+	attributes []attribute.KeyValue
+}
+
+// Start closing client without blocking the caller. Closing is
+// finished by sendLoop.
 func (c *Client) TryClose(isClosedByClient bool) {
 	// Closed scenarios:
 	// 1. Hub close. -> Need to send close message to client.
@@ -105,54 +262,130 @@ func (c *Client) TryClose(isClosedByClient bool) {
 
 	// Do nothing if client is already in the process of closing.
 	c.closeOnce.Do(func() {
+		c.isClosing.Store(true)
+
+		req := &closeRequest{
+			attributes: []attribute.KeyValue{attribute.Bool("isClosedByClient", isClosedByClient)},
+		}
 		if isClosedByClient {
 			c.hub.unregister <- c
-			c.close <- nil
 		} else {
-			time.Sleep(CloseGracePeriod) // Ensure that other message is sent.
-			c.close <- websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Closed by server")
-			time.Sleep(CloseGracePeriod) // Ensure that close message is sent.
+			req.closeCode = websocket.CloseNormalClosure
+			req.closeReason = "Closed by server"
 		}
+		c.close <- req
+	})
+}
 
-		c.conn.Close()
+// Close connection with the close code, eg. policy violation. Unlike
+// TryClose, it's initiated by server but hub is not aware of it, so
+// need to notify hub.
+func (c *Client) closeByServer(closeCode int, reason string) {
+	c.closeOnce.Do(func() {
+		c.isClosing.Store(true)
+		c.hub.unregister <- c
+		c.close <- &closeRequest{
+			closeCode:   closeCode,
+			closeReason: reason,
+			attributes:  []attribute.KeyValue{attribute.String("reason", reason)},
+		}
 	})
 }
 
-// Infinite loop that read message from ws connection. Also, detect
-// connection liveness by listening to pong message.
+// Close handshake of server initiated close: write messages already
+// queued, send close message and wait for client to reply or timeout.
+// Then release connection.
+func (c *Client) shutdown(req *closeRequest) {
+	if req.closeCode != 0 {
+		c.flush()
+
+		if err := c.transport.WriteClose(req.closeCode, req.closeReason); err != nil {
+			c.logger.Debugf("cannot write close message to transport %v", err)
+		} else {
+			select {
+			case <-c.recvDone:
+			case <-time.After(CloseGracePeriod):
+				c.logger.Debugw("client did not reply close message in time")
+			}
+		}
+	}
+
+	c.transport.Close()
+	c.hub.releaseIpConnection(c.ip)
+
+	c.span.AddEvent("close", trace.WithAttributes(req.attributes...))
+	c.span.End()
+}
+
+// Write messages queued before close, eg. Login event.
+func (c *Client) flush() {
+	for {
+		select {
+		case wsMessage := <-c.sendWsMessage:
+			if err := c.write(wsMessage); err != nil {
+				c.logger.Debugf("cannot write message to transport %v", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Infinite loop that read message from transport. Liveness is
+// detected by transport, eg. ws pong message.
 func (c *Client) recvLoop() {
-	// Heartbeat. Set read timeout if client does not respond to ping
-	// for too long. This will in turn make conn.ReadMessage get an io
-	// timeout error and thus closing the connection.
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.logger.Debugf("receive pong id[%v]", c.id)
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
+	defer close(c.recvDone)
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.transport.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				c.logger.Debugf("recv normal close message")
+				c.logger.Debugw("recv normal close message")
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				c.logger.Warnw("recv message exceeds max size", "maxMessageBytes", *c.config.MaxMessageBytes)
 			} else if err, ok := err.(net.Error); ok && err.Timeout() {
-				c.logger.Warnf("recv timeout %v", err) // Possibly heartbeat timeout.
+				c.logger.Warnw("recv timeout", "err", err) // Possibly heartbeat timeout.
+			} else if errors.Is(err, ErrSessionExpired) {
+				c.logger.Infow("sse session not resumed in time")
 			} else {
-				c.logger.Debugf("recv error %v", err)
+				c.logger.Debugw("recv error", "err", err)
 			}
 
 			c.TryClose(true)
 			return
 		}
 
+		// Keep reading until client replies close message.
+		if c.isClosing.Load() {
+			continue
+		}
+
+		if !c.limiter.Allow() {
+			c.countRateViolation(time.Now())
+			c.hub.metrics.Add("rateLimitedMessages", 1)
+			c.logger.Debugw("drop message by rate limit", "rateViolations", c.rateViolations)
+
+			if c.rateViolations >= *c.config.MessageRateDisconnectViolations {
+				c.logger.Warnw("disconnect since too many messages are dropped by rate limit", "rateViolations", c.rateViolations)
+				c.hub.metrics.Add("disconnectedByRateLimit", 1)
+				c.closeByServer(websocket.ClosePolicyViolation, "Too many messages")
+				continue
+			}
+
+			if c.rateViolations == *c.config.MessageRateWarnViolations {
+				c.hub.sendError(c, msg.RateLimitedReason, "Too many messages, slow down or will be disconnected")
+			}
+			continue
+		}
+
 		wsMessage := &msg.WsMessage{}
-		err = json.Unmarshal(message, wsMessage)
+		err = c.transport.Codec().Unmarshal(message, wsMessage)
 		if err != nil {
-			c.logger.Errorf("id[%v] message[%s] %v", c.id, message, err)
+			c.logger.Errorw("cannot unmarshal message", "message", string(message), "err", err)
 			continue
 		}
-		c.logger.Debugf("received msg id[%v] eventCode[%v]", c.id, wsMessage.EventCode)
+		c.logger.Debugw("received msg", "eventCode", wsMessage.EventCode)
 
 		c.hub.wsRequest <- &ClientRequest{
 			client:    c,
@@ -161,8 +394,18 @@ func (c *Client) recvLoop() {
 	}
 }
 
-// Infinite loop that send message from ws connection. Also,
-// periodically send ping to connection and expect it to return pong.
+// Count a dropped message. Client that only occasionally bursts over
+// the limit starts over after the violation window.
+func (c *Client) countRateViolation(now time.Time) {
+	if !now.Before(c.rateViolationsResetTime) {
+		c.rateViolations = 0
+		c.rateViolationsResetTime = now.Add(time.Duration(*c.config.MessageRateViolationWindowSeconds) * time.Second)
+	}
+	c.rateViolations++
+}
+
+// Infinite loop that send message to transport. Also, periodically
+// send ping to keep connection alive.
 func (c *Client) sendLoop() {
 	pingTicker := time.NewTicker(pingInterval)
 	defer pingTicker.Stop()
@@ -170,28 +413,28 @@ func (c *Client) sendLoop() {
 	for {
 		select {
 		case wsMessage := <-c.sendWsMessage:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteJSON(wsMessage); err != nil {
-				c.logger.Errorf("cannot write json to ws conn %v", err)
+			if err := c.write(wsMessage); err != nil {
+				c.logger.Errorf("cannot write message to transport %v", err)
 				continue
 			}
-		case closeMessage := <-c.close:
-			if closeMessage == nil {
-				return
-			}
-
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
-				c.logger.Debugf("cannot write close message to ws conn %v", err)
-			}
+		case req := <-c.close:
+			c.shutdown(req)
 			return
 		case <-pingTicker.C:
-			c.logger.Debugf("send ping id[%v]", c.id)
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				c.logger.Debugf("cannot send ping to ws conn", err)
+			c.logger.Debugw("send ping")
+			if err := c.transport.Ping(); err != nil {
+				c.logger.Debugw("cannot send ping to transport", "err", err)
 				continue
 			}
 		}
 	}
 }
+
+// Write message adapted to client's protocol. Messages client can't
+// handle are skipped.
+func (c *Client) write(wsMessage *msg.WsMessage) error {
+	if wsMessage = c.protocol.Adapt(wsMessage); wsMessage == nil {
+		return nil
+	}
+	return c.transport.WriteMessage(wsMessage)
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"flag"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Hub without queue or main server, not running. Tests call its
+// methods directly.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+
+	tracerFactory, err := infra.ProvideTracerFactory(testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginProviders, err := login.ProvideRegistry(config.CFG, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ProvideHub(nil, nil, nil, loginProviders, config.CFG, nil, testMetrics, tracerFactory, testLoggerFactory)
+}
+
+// Client registered nowhere, with a buffered send channel to inspect.
+func newTestClient(id string, ip string) *Client {
+	return &Client{
+		id:            id,
+		ip:            ip,
+		metadata:      &ConnMetadata{Ip: ip},
+		sendWsMessage: make(chan *msg.WsMessage, 64),
+		close:         make(chan *closeRequest, 1),
+		config:        config.CFG,
+	}
+}
+
+// Messages sent to client so far.
+func sentMessages(client *Client) []*msg.WsMessage {
+	var wsMessages []*msg.WsMessage
+	for {
+		select {
+		case wsMessage := <-client.sendWsMessage:
+			wsMessages = append(wsMessages, wsMessage)
+		default:
+			return wsMessages
+		}
+	}
+}
+
+// Server side of a websocket connection whose client side never reads.
+func dialIdleConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("cannot upgrade %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("cannot connect %v", err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+func TestCountRateViolation(t *testing.T) {
+	setFlag(t, "message-rate-violation-window-seconds", "10")
+
+	client := &Client{config: config.CFG}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{elapsed: 0, want: 1},
+		{elapsed: 5 * time.Second, want: 2},
+		{elapsed: 9 * time.Second, want: 3},
+		// Window starts from the first violation, not the last one.
+		{elapsed: 10 * time.Second, want: 1},
+		{elapsed: 19 * time.Second, want: 2},
+		{elapsed: time.Minute, want: 1},
+	} {
+		client.countRateViolation(start.Add(tc.elapsed))
+		if client.rateViolations != tc.want {
+			t.Fatalf("rateViolations[%v] after [%v], want [%v]", client.rateViolations, tc.elapsed, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"strings"
+	"time"
+)
+
+var (
+	ErrEmptyCredential     = errors.New("empty credential")
+	ErrMalformedCredential = errors.New("malformed credential")
+	ErrExpiredCredential   = errors.New("expired credential")
+	ErrRejectedCredential  = errors.New("credential rejected by main server")
+	ErrInvalidLoginType    = errors.New("invalid login type")
+)
+
+// Tokens of all login providers are way shorter than this.
+const maxCredentialLength = 8192
+
+// Cheap format check on login credential without any network call.
+// Catches credentials that will surely fail login, so client doesn't
+// wait in queue for nothing.
+func checkCredentialFormat(provider login.Provider, loginData *msg.LoginClientEvent) error {
+	if loginData.Token == "" {
+		return ErrEmptyCredential
+	}
+
+	if len(loginData.Token) > maxCredentialLength || strings.ContainsAny(loginData.Token, " \t\r\n") {
+		return ErrMalformedCredential
+	}
+
+	if _, err := provider.MarshalRequest(loginData); err != nil {
+		return fmt.Errorf("%w %v", ErrMalformedCredential, err)
+	}
+
+	if expireTime, ok := credentialExpireTime(loginData.Token); ok && expireTime.Before(time.Now()) {
+		return ErrExpiredCredential
+	}
+
+	return nil
+}
+
+// Return expire time of token if it's a jwt with exp claim, such as
+// Apple and Google id tokens. Signature is not verified, main server
+// will do it on login.
+func credentialExpireTime(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	claims := &struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(rawClaims, claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Exp, 0), true
+}
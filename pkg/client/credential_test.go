@@ -0,0 +1,121 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unsigned jwt with the exp claim.
+func testJwt(expireTime time.Time) string {
+	claims := fmt.Sprintf(`{"sub":"user","exp":%v}`, expireTime.Unix())
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestCredentialExpireTime(t *testing.T) {
+	expireTime := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		hasExp bool
+	}{
+		{name: "jwt", token: testJwt(expireTime), hasExp: true},
+		{name: "opaque token", token: "EAAB1234", hasExp: false},
+		{name: "jwt without exp", token: "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user"}`)) + ".signature", hasExp: false},
+		{name: "invalid base64", token: "a.!!!.c", hasExp: false},
+		{name: "invalid claims", token: "a." + base64.RawURLEncoding.EncodeToString([]byte("not json")) + ".c", hasExp: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := credentialExpireTime(tc.token)
+			if ok != tc.hasExp {
+				t.Fatalf("has exp [%v], want [%v]", ok, tc.hasExp)
+			}
+			if ok && !got.Equal(expireTime) {
+				t.Fatalf("expire time[%v], want [%v]", got, expireTime)
+			}
+		})
+	}
+}
+
+func TestCheckCredentialFormat(t *testing.T) {
+	loginProviders := newTestHub(t).loginProviders
+
+	// Login type that needs an account, as declared in providers file.
+	emailLogin := msg.LoginTypeCode(7)
+	emailProvider, err := login.NewFieldProvider(login.FieldProviderConfig{Type: emailLogin, Name: "email", Path: "/email", Fields: map[string]string{"email": login.AccountField, "otp": login.TokenField}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginProviders.Register(emailLogin, emailProvider)
+
+	for _, tc := range []struct {
+		name      string
+		loginData *msg.LoginClientEvent
+		err       error
+	}{
+		{name: "device", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "device-token"}},
+		{name: "fresh jwt", loginData: &msg.LoginClientEvent{Type: msg.AppleLogin, Token: testJwt(time.Now().Add(time.Hour))}},
+		{name: "expired jwt", loginData: &msg.LoginClientEvent{Type: msg.AppleLogin, Token: testJwt(time.Now().Add(-time.Minute))}, err: ErrExpiredCredential},
+		{name: "empty", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin}, err: ErrEmptyCredential},
+		{name: "whitespace", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "device token"}, err: ErrMalformedCredential},
+		{name: "too long", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: strings.Repeat("a", maxCredentialLength+1)}, err: ErrMalformedCredential},
+		{name: "missing account", loginData: &msg.LoginClientEvent{Type: emailLogin, Token: "otp"}, err: ErrMalformedCredential},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, ok := loginProviders.Get(tc.loginData.Type)
+			if !ok {
+				t.Fatalf("no provider of login type[%v]", tc.loginData.Type)
+			}
+
+			if err := checkCredentialFormat(provider, tc.loginData); !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestRequestCredentialRefresh(t *testing.T) {
+	setFlag(t, "credential-refresh-position", "10")
+	setFlag(t, "credential-refresh-margin-seconds", "120")
+
+	for _, tc := range []struct {
+		name           string
+		ticketPosition int32
+		expireIn       time.Duration
+		isRequested    bool
+	}{
+		{name: "about to expire", ticketPosition: 5, expireIn: time.Minute, isRequested: true},
+		{name: "already expired", ticketPosition: 5, expireIn: -time.Minute, isRequested: true},
+		{name: "far from head", ticketPosition: 50, expireIn: time.Minute, isRequested: false},
+		{name: "not yet entered queue", ticketPosition: 0, expireIn: time.Minute, isRequested: false},
+		{name: "expire after margin", ticketPosition: 5, expireIn: time.Hour, isRequested: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hub := newTestHub(t)
+			client := newTestClient("refresh-"+tc.name, "192.0.2.1")
+			client.ticketPosition = tc.ticketPosition
+			hub.loginDataCache.Put(client.id, &msg.LoginClientEvent{Type: msg.AppleLogin, Token: testJwt(time.Now().Add(tc.expireIn))})
+
+			stats := &queue.Stats{HeadPosition: 1, TailPosition: 100}
+			hub.requestCredentialRefresh(client, stats)
+
+			wsMessages := sentMessages(client)
+			if isRequested := len(wsMessages) == 1 && wsMessages[0].EventCode == msg.CredentialExpiredCode; isRequested != tc.isRequested {
+				t.Fatalf("sent %v, want refresh requested [%v]", wsMessages, tc.isRequested)
+			}
+
+			// Only asked once for the same login request.
+			hub.requestCredentialRefresh(client, stats)
+			if wsMessages := sentMessages(client); len(wsMessages) != 0 {
+				t.Fatalf("sent %v again", wsMessages)
+			}
+		})
+	}
+}
@@ -2,15 +2,21 @@ package client
 
 import (
 	"encoding/json"
-	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/challenge"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
-	"os"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/emirpasic/gods/maps/hashmap"
 	"github.com/imroc/req/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +25,17 @@ type ClientRequest struct {
 	wsMessage *msg.WsMessage
 }
 
+type challengeResult struct {
+	client   *Client
+	isPassed bool
+}
+
+type credentialResult struct {
+	client    *Client
+	loginData *msg.LoginClientEvent
+	err       error
+}
+
 type Hub struct {
 	// Registered clients. Key value: client.id -> client.
 	clients *hashmap.Map
@@ -26,9 +43,21 @@ type Hub struct {
 	// Stores login request from clients. Key value: client.id -> login event.
 	loginDataCache *hashmap.Map
 
-	// Lock for protecting clients and loginDataCache maps.
+	// Number of tickets held by each device. Key value: deviceId ->
+	// number of clients that sent login request with this device.
+	deviceTickets map[string]int
+
+	// Lock for protecting clients, loginDataCache and deviceTickets maps.
 	mux sync.RWMutex
 
+	// Number of open connections of each ip. Key value: client.ip ->
+	// number of connections.
+	ipConnections map[string]int
+
+	// Lock for protecting ipConnections map. Separated from mux since
+	// connections are counted outside of hub goroutines.
+	ipMux sync.Mutex
+
 	// Inbound messages from the clients.
 	broadcast chan []byte
 
@@ -41,26 +70,54 @@ type Hub struct {
 	// Ws message from clients.
 	wsRequest chan *ClientRequest
 
+	// Verification results of challenge solutions from clients.
+	challengeResult chan *challengeResult
+
+	// Validation results of login credentials from clients.
+	credentialResult chan *credentialResult
+
 	queue *queue.Queue
 
+	queueConfig *config.QueueConfig
+
+	challengeIssuer *challenge.Issuer
+
+	loginProviders *login.Registry
+
+	config *config.Config
+
 	httpClient *req.Client
 
+	metrics *infra.Metrics
+
+	tracer trace.Tracer
+
 	logger *zap.SugaredLogger
 }
 
-func ProvideHub(queue *queue.Queue, httpClient *req.Client, loggerFactory *infra.LoggerFactory) *Hub {
+func ProvideHub(queue *queue.Queue, queueConfig *config.QueueConfig, challengeIssuer *challenge.Issuer, loginProviders *login.Registry, config *config.Config, httpClient *req.Client, metrics *infra.Metrics, tracerFactory *infra.TracerFactory, loggerFactory *infra.LoggerFactory) *Hub {
 	return &Hub{
 		clients:        hashmap.New(),
 		loginDataCache: hashmap.New(),
-
-		broadcast:  make(chan []byte, 1024),
-		register:   make(chan *Client, 1024),
-		unregister: make(chan *Client, 1024),
-		wsRequest:  make(chan *ClientRequest, 1024),
-
-		queue:      queue,
-		httpClient: httpClient,
-		logger:     loggerFactory.Create("Hub").Sugar(),
+		deviceTickets:  make(map[string]int),
+		ipConnections:  make(map[string]int),
+
+		broadcast:        make(chan []byte, 1024),
+		register:         make(chan *Client, 1024),
+		unregister:       make(chan *Client, 1024),
+		wsRequest:        make(chan *ClientRequest, 1024),
+		challengeResult:  make(chan *challengeResult, 1024),
+		credentialResult: make(chan *credentialResult, 1024),
+
+		queue:           queue,
+		queueConfig:     queueConfig,
+		challengeIssuer: challengeIssuer,
+		loginProviders:  loginProviders,
+		config:          config,
+		httpClient:      httpClient,
+		metrics:         metrics,
+		tracer:          tracerFactory.Create("Hub"),
+		logger:          loggerFactory.Create("Hub").Sugar(),
 	}
 }
 
@@ -73,7 +130,8 @@ func (h *Hub) handleClient() {
 	for {
 		select {
 		case client := <-h.register:
-			h.logger.Debugf("register client id[%v] ip[%v]", client.id, client.ip)
+			h.clientLogger(client).Debugw("register client")
+			client.span.AddEvent("register")
 
 			h.mux.Lock()
 			h.clients.Put(client.id, client)
@@ -93,8 +151,13 @@ func (h *Hub) handleClient() {
 			}
 			client.sendWsMessage <- wsMessage
 
+			if client.updateNotice != nil {
+				h.suggestUpdate(client)
+			}
+
 		case client := <-h.unregister:
-			h.logger.Debugf("unregister client id[%v]", client.id)
+			h.clientLogger(client).Debugw("unregister client")
+			client.span.AddEvent("unregister")
 
 			h.mux.RLock()
 			_, ok := h.clients.Get(client.id)
@@ -107,26 +170,114 @@ func (h *Hub) handleClient() {
 			h.queue.Leave <- queue.TicketId(client.id)
 			h.removeClient(client)
 
+		case result := <-h.challengeResult:
+			if !result.isPassed {
+				h.clientLogger(result.client).Infow("challenge failed")
+				h.sendError(result.client, msg.ChallengeFailedReason, "Challenge failed")
+				h.sendChallenge(result.client)
+				continue
+			}
+
+			h.clientLogger(result.client).Debugw("challenge passed")
+			result.client.isChallengePassed = true
+
+			h.mux.RLock()
+			_, hasLoginData := h.loginDataCache.Get(result.client.id)
+			h.mux.RUnlock()
+
+			if !hasLoginData {
+				h.clientLogger(result.client).Warnw("challenge passed but cannot find login request info")
+				continue
+			}
+
+			h.enterQueue(result.client)
+
+		case result := <-h.credentialResult:
+			h.mux.Lock()
+			value, ok := h.loginDataCache.Get(result.client.id)
+			if !ok || value.(*msg.LoginClientEvent) != result.loginData {
+				// Client has left or sent a newer login request.
+				h.mux.Unlock()
+				continue
+			}
+
+			if result.err != nil {
+				h.releaseDeviceTicket(result.loginData.DeviceId)
+				h.loginDataCache.Remove(result.client.id)
+				h.mux.Unlock()
+
+				h.clientLogger(result.client).Infow("reject login", "loginType", result.loginData.Type, "err", result.err)
+				h.rejectLogin(result.client, msg.InvalidCredentialReason, result.err.Error())
+				continue
+			}
+			h.mux.Unlock()
+
+			// Ticket enters queue only after client solves the
+			// challenge. Login request is kept in cache meanwhile.
+			if !result.client.isChallengePassed && h.sendChallenge(result.client) {
+				continue
+			}
+
+			h.enterQueue(result.client)
+
 		case req := <-h.wsRequest:
 			switch req.wsMessage.EventCode {
 			case msg.LoginCode:
 				event := &msg.LoginClientEvent{}
 				err := json.Unmarshal(req.wsMessage.EventData, event)
 				if err != nil {
-					h.logger.Errorf("id[%v] %v", req.client.id, err)
+					h.clientLogger(req.client).Errorw("cannot unmarshal LoginClientEvent", "err", err)
+					continue
+				}
+
+				provider, ok := h.loginProviders.Get(event.Type)
+				if !ok {
+					h.clientLogger(req.client).Infow("reject login with invalid login type", "loginType", event.Type)
+					h.rejectLogin(req.client, msg.InvalidCredentialReason, ErrInvalidLoginType.Error())
 					continue
 				}
 
-				h.logger.Debugf("storing event[%+v] into loginReqCache", event)
+				if err := checkCredentialFormat(provider, event); err != nil {
+					h.clientLogger(req.client).Infow("reject login", "loginType", event.Type, "err", err)
+					h.rejectLogin(req.client, msg.InvalidCredentialReason, err.Error())
+					continue
+				}
+
+				h.clientLogger(req.client).Debugw("storing event into loginReqCache", "loginType", event.Type, "deviceId", event.DeviceId)
 
 				h.mux.Lock()
+				if !h.acquireDeviceTicket(req.client.id, event) {
+					h.mux.Unlock()
+					h.clientLogger(req.client).Infow("reject login since device has too many tickets", "deviceId", event.DeviceId)
+					h.rejectLogin(req.client, msg.TooManyTicketsReason, "Too many tickets for this device")
+					continue
+				}
 				h.loginDataCache.Put(req.client.id, event)
 				h.mux.Unlock()
 
-				h.queue.Enter <- queue.TicketId(req.client.id)
+				go h.validateCredential(req.client, event)
+
+			case msg.ChallengeCode:
+				event := &msg.ChallengeClientEvent{}
+				err := json.Unmarshal(req.wsMessage.EventData, event)
+				if err != nil {
+					h.clientLogger(req.client).Errorw("cannot unmarshal ChallengeClientEvent", "err", err)
+					continue
+				}
+
+				pendingChallenge := req.client.challenge
+				if pendingChallenge == nil {
+					h.clientLogger(req.client).Warnw("sent solution but has no pending challenge")
+					continue
+				}
+
+				// Each challenge can only be answered once. A new one
+				// will be issued if the solution is wrong.
+				req.client.challenge = nil
+				go h.verifyChallenge(req.client, pendingChallenge, event.Solution)
 
 			default:
-				h.logger.Errorf("id[%v] invalid eventCode[%v]", req.client.id, req.wsMessage.EventCode)
+				h.clientLogger(req.client).Errorw("invalid eventCode", "eventCode", req.wsMessage.EventCode)
 			}
 		}
 	}
@@ -136,14 +287,14 @@ func (h *Hub) handleQueue() {
 	for {
 		select {
 		case ticket := <-h.queue.NotifyTicket:
-			h.logger.Debugf("notifyDirtyTicket ticketId[%v]", ticket.TicketId)
+			h.logger.Debugw("notifyDirtyTicket", "ticketId", ticket.TicketId)
 
 			h.mux.RLock()
 			value, ok := h.clients.Get(string(ticket.TicketId))
 			h.mux.RUnlock()
 
 			if !ok {
-				h.logger.Warnf("notifyDirtyTicket but cannot find client for ticketId[%v]", ticket.TicketId)
+				h.logger.Warnw("notifyDirtyTicket but cannot find client", "ticketId", ticket.TicketId)
 				continue
 			}
 
@@ -162,6 +313,7 @@ func (h *Hub) handleQueue() {
 			}
 
 			client := value.(*Client)
+			client.ticketPosition = ticket.Position
 			client.sendWsMessage <- wsMessage
 
 		case stats := <-h.queue.NotifyStats:
@@ -176,129 +328,573 @@ func (h *Hub) handleQueue() {
 				return
 			}
 
-			wsMessage := &msg.WsMessage{
-				EventCode: msg.QueueStatsCode,
-				EventData: rawEvent,
-			}
+			// Encoded once per codec for all clients.
+			wsMessage := msg.NewSharedMessage(msg.QueueStatsCode, rawEvent)
 
 			h.mux.RLock()
 			for _, value := range h.clients.Values() {
 				client := value.(*Client)
 				client.sendWsMessage <- wsMessage
+				h.requestCredentialRefresh(client, stats)
 			}
 			h.mux.RUnlock()
 
-		case ticketId := <-h.queue.NotifyFinish:
-			h.logger.Debugf("notifyFinish ticketId[%v]", ticketId)
+		case isQueueing := <-h.queueConfig.NotifySwitch:
+			h.queue.Switch <- isQueueing
+			if isQueueing {
+				continue
+			}
+
+			// Tickets in queue are flushed and logged in by queue
+			// server. Tell other clients that queue no longer exists,
+			// so they can login by themselves without waiting.
+			rawEvent, err := json.Marshal(&msg.ShouldQueueEvent{
+				ShouldQueue: false,
+			})
+			if err != nil {
+				h.logger.Errorf("cannot marshal ShouldQueueEvent %v", err)
+				return
+			}
+
+			wsMessage := msg.NewSharedMessage(msg.ShouldQueueCode, rawEvent)
 
 			h.mux.RLock()
-			value, ok := h.clients.Get(string(ticketId))
+			h.logger.Infow("queue switched off, notify clients without login request", "clientCnt", h.clients.Size(), "loginRequestCnt", h.loginDataCache.Size())
+			for _, value := range h.clients.Values() {
+				client := value.(*Client)
+				client.span.AddEvent("queue switched off")
+				if _, hasLoginData := h.loginDataCache.Get(client.id); !hasLoginData {
+					client.sendWsMessage <- wsMessage
+				}
+			}
+			h.mux.RUnlock()
+
+		case ticket := <-h.queue.NotifyFinish:
+			h.logger.Debugw("notifyFinish", "ticketId", ticket.TicketId)
+
+			h.mux.RLock()
+			value, ok := h.clients.Get(string(ticket.TicketId))
 			h.mux.RUnlock()
 
 			if !ok {
-				h.logger.Warnf("notifyFinish but cannot find client for ticketId[%v]", ticketId)
+				h.logger.Warnw("notifyFinish but cannot find client", "ticketId", ticket.TicketId)
+				h.abandonLater(ticket)
 				continue
 			}
 			client := value.(*Client)
 
 			h.mux.RLock()
-			value, ok = h.loginDataCache.Get(string(ticketId))
+			value, ok = h.loginDataCache.Get(string(ticket.TicketId))
 			h.mux.RUnlock()
 
 			if !ok {
-				h.logger.Warnf("notifyFinish but cannot find login request info for ticketId[%v]", ticketId)
+				h.logger.Warnw("notifyFinish but cannot find login request info", "ticketId", ticket.TicketId)
+				h.abandonLater(ticket)
 				continue
 			}
 			loginData := value.(*msg.LoginClientEvent)
+			client.span.AddEvent("dequeue")
 
-			authResult := make(chan *msg.LoginServerEvent)
+			authResult := make(chan *loginResult)
 			go h.loginForClient(loginData, client, authResult)
-			go h.finishClient(client, authResult)
+			go h.finishClient(client, ticket, authResult)
 		}
 	}
 }
 
+// Abandon ticket from another goroutine. Queue worker may be blocked
+// sending to NotifyFinish, which handleQueue must keep reading, while
+// Abandon is full.
+func (h *Hub) abandonLater(ticket *queue.Ticket) {
+	go func() {
+		h.queue.Abandon <- ticket
+	}()
+}
+
+// Logger of hub with fields identifying the client.
+func (h *Hub) clientLogger(client *Client) *zap.SugaredLogger {
+	return h.logger.With(logFields(client.id, client.metadata)...)
+}
+
+func (h *Hub) enterQueue(client *Client) {
+	client.span.AddEvent("enter queue")
+	h.queue.Enter <- queue.TicketId(client.id)
+}
+
 func (h *Hub) removeClient(client *Client) {
 	h.mux.Lock()
 	h.clients.Remove(client.id)
+	if value, ok := h.loginDataCache.Get(client.id); ok {
+		h.releaseDeviceTicket(value.(*msg.LoginClientEvent).DeviceId)
+	}
 	h.loginDataCache.Remove(client.id)
 	h.mux.Unlock()
 
 	client.TryClose(false) // Notify client it should close now.
 }
 
-func (h *Hub) loginForClient(loginData *msg.LoginClientEvent, client *Client, result chan<- *msg.LoginServerEvent) {
-	defer close(result)
+// Reserve a connection for ip. Return false if ip has reached the
+// max number of connections.
+func (h *Hub) acquireIpConnection(ip string) bool {
+	h.ipMux.Lock()
+	defer h.ipMux.Unlock()
 
-	var (
-		url     string = os.Getenv("MAIN_SERVER_HOST") + "/api/user/authorization"
-		payload string
-	)
-	switch loginData.Type {
-	case msg.AppleLogin:
-		url += "/apple"
-		payload = fmt.Sprintf(`{"accessToken":"%v"}`, loginData.Token)
-	case msg.DeviceLogin:
-		url += "/device"
-		payload = fmt.Sprintf(`{"uniqueId":"%v"}`, loginData.Token)
-	case msg.FacebookLogin:
-		url += "/facebook"
-		payload = fmt.Sprintf(`{"token":"%v"}`, loginData.Token)
-	case msg.GoogleLogin:
-		url += "/google"
-		payload = fmt.Sprintf(`{"token":"%v"}`, loginData.Token)
-	case msg.LineLogin:
-		url += "/line"
-		payload = fmt.Sprintf(`{"accessToken":"%v"}`, loginData.Token)
-	default:
-		h.logger.Errorf("invalid login type[%v]", loginData.Type)
+	if limit := *h.config.MaxConnectionsPerIp; limit > 0 && h.ipConnections[ip] >= limit {
+		h.metrics.Add("rejectedByIpLimit", 1)
+		return false
+	}
+
+	h.ipConnections[ip]++
+	h.metrics.Add("connections", 1)
+	h.metrics.Set("trackedIps", int64(len(h.ipConnections)))
+	return true
+}
+
+// Whether ip can open another connection, without reserving it.
+func (h *Hub) hasIpCapacity(ip string) bool {
+	h.ipMux.Lock()
+	defer h.ipMux.Unlock()
+
+	limit := *h.config.MaxConnectionsPerIp
+	return limit <= 0 || h.ipConnections[ip] < limit
+}
+
+func (h *Hub) releaseIpConnection(ip string) {
+	h.ipMux.Lock()
+	defer h.ipMux.Unlock()
+
+	if h.ipConnections[ip] <= 0 {
+		h.logger.Warnw("release connection but ip has no connection", "ip", ip)
+		return
+	}
+
+	h.ipConnections[ip]--
+	if h.ipConnections[ip] == 0 {
+		delete(h.ipConnections, ip)
+	}
+	h.metrics.Add("connections", -1)
+	h.metrics.Set("trackedIps", int64(len(h.ipConnections)))
+}
+
+// Reserve a ticket of the login event's device for client. A client
+// that sends login request again with same device keeps its ticket.
+// Return false if device has reached the max number of tickets, in
+// which case previous login request of the client is left untouched.
+// Must hold mux.
+func (h *Hub) acquireDeviceTicket(clientId string, event *msg.LoginClientEvent) bool {
+	var prevDeviceId string
+	value, hasPrev := h.loginDataCache.Get(clientId)
+	if hasPrev {
+		prevDeviceId = value.(*msg.LoginClientEvent).DeviceId
+		if prevDeviceId == event.DeviceId {
+			return true
+		}
+	}
+
+	if limit := *h.config.MaxTicketsPerDevice; limit > 0 && h.deviceTickets[event.DeviceId] >= limit {
+		h.metrics.Add("rejectedByDeviceLimit", 1)
+		return false
+	}
+
+	if hasPrev {
+		h.releaseDeviceTicket(prevDeviceId)
+	}
+	h.deviceTickets[event.DeviceId]++
+	h.metrics.Set("trackedDevices", int64(len(h.deviceTickets)))
+	return true
+}
+
+// Must hold mux.
+func (h *Hub) releaseDeviceTicket(deviceId string) {
+	if h.deviceTickets[deviceId] <= 0 {
+		return
+	}
+
+	h.deviceTickets[deviceId]--
+	if h.deviceTickets[deviceId] == 0 {
+		delete(h.deviceTickets, deviceId)
+	}
+	h.metrics.Set("trackedDevices", int64(len(h.deviceTickets)))
+}
+
+// Issue a new challenge and send it to client. Return false if client
+// does not need to solve any challenge.
+func (h *Hub) sendChallenge(client *Client) bool {
+	newChallenge, err := h.challengeIssuer.Issue()
+	if err != nil {
+		h.logger.Errorf("cannot issue challenge %v", err)
+		return false
+	}
+
+	if newChallenge == nil {
+		return false
+	}
+
+	// Client can't receive the challenge, so it would wait forever.
+	if !client.protocol.Supports(msg.ChallengeCode) {
+		h.clientLogger(client).Infow("close client that cannot solve challenge", "protocolVersion", client.protocol.Version)
+		h.metrics.Add("rejectedByChallengeVersion", 1)
+		client.closeByServer(CloseUpdateRequired, "Update required to solve challenge")
+		return true
+	}
+	client.challenge = newChallenge
+
+	rawEvent, err := json.Marshal(&msg.ChallengeServerEvent{
+		Type:       string(newChallenge.Type),
+		Seed:       newChallenge.Seed,
+		Difficulty: newChallenge.Difficulty,
+	})
+	if err != nil {
+		h.logger.Errorf("cannot marshal ChallengeServerEvent %v", err)
+		return false
+	}
+
+	client.sendWsMessage <- &msg.WsMessage{
+		EventCode: msg.ChallengeCode,
+		EventData: rawEvent,
+	}
+	return true
+}
+
+func (h *Hub) verifyChallenge(client *Client, pendingChallenge *challenge.Challenge, solution string) {
+	_, span := h.tracer.Start(client.ctx, "verify challenge", trace.WithAttributes(attribute.String("challengeType", string(pendingChallenge.Type))))
+	defer span.End()
+
+	isPassed := h.challengeIssuer.Verify(pendingChallenge, solution, client.ip)
+	span.SetAttributes(attribute.Bool("isPassed", isPassed))
+
+	h.challengeResult <- &challengeResult{
+		client:   client,
+		isPassed: isPassed,
+	}
+}
+
+// Validate login credential through main server if enabled. Only
+// rejection from main server fails the validation, other errors are
+// left for the actual login to handle.
+func (h *Hub) validateCredential(client *Client, loginData *msg.LoginClientEvent) {
+	result := &credentialResult{
+		client:    client,
+		loginData: loginData,
+	}
+	defer func() { h.credentialResult <- result }()
+
+	if *h.config.CredentialValidatePath == "" {
 		return
 	}
 
-	authData := &struct {
-		Data struct {
-			Jwt string `json:"jwt"`
-		} `json:"data"`
-	}{}
+	ctx, span := h.tracer.Start(client.ctx, "validate credential", trace.WithAttributes(attribute.Int("loginType", int(loginData.Type))))
+	defer func() {
+		recordSpanError(span, result.err)
+		span.End()
+	}()
+
+	provider, payload, err := h.authorizationRequest(loginData)
+	if err != nil {
+		result.err = err
+		return
+	}
 
-	// TODO how to send client IP
 	resp, err := h.httpClient.R().
+		SetContext(ctx).
+		SetHeaders(client.metadata.Headers()).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("platform", client.platform).
 		SetHeader("deviceid", loginData.DeviceId).
-		SetHeader("sessionid", loginData.SessionId).
 		SetBody(payload).
-		SetSuccessResult(authData).
-		Post(url)
+		Post(*h.config.MainServerHost + "/api/user/authorization" + provider.Path() + *h.config.CredentialValidatePath)
+
+	if err != nil {
+		h.clientLogger(client).Warnw("validate credential request failed, skip validation", "loginType", loginData.Type, "err", err)
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		result.err = ErrRejectedCredential
+	}
+}
+
+// Ask client near the front of queue to resend login request if its
+// credential will expire before it gets dequeued. Only ask once for
+// each login request. Must hold mux.
+func (h *Hub) requestCredentialRefresh(client *Client, stats *queue.Stats) {
+	if client.ticketPosition == 0 || client.ticketPosition-stats.HeadPosition > int32(*h.config.CredentialRefreshPosition) {
+		return
+	}
+
+	value, ok := h.loginDataCache.Get(client.id)
+	if !ok {
+		return
+	}
+
+	loginData := value.(*msg.LoginClientEvent)
+	if client.refreshRequestedFor == loginData {
+		return
+	}
+
+	expireTime, ok := credentialExpireTime(loginData.Token)
+	if !ok || time.Until(expireTime) > time.Duration(*h.config.CredentialRefreshMarginSeconds)*time.Second {
+		return
+	}
+
+	h.clientLogger(client).Infow("request credential refresh", "loginType", loginData.Type, "expireTime", expireTime)
+	client.refreshRequestedFor = loginData
+
+	rawEvent, err := json.Marshal(&msg.CredentialExpiredServerEvent{
+		Type: loginData.Type,
+	})
+	if err != nil {
+		h.logger.Errorf("cannot marshal CredentialExpiredServerEvent %v", err)
+		return
+	}
+
+	client.sendWsMessage <- &msg.WsMessage{
+		EventCode: msg.CredentialExpiredCode,
+		EventData: rawEvent,
+	}
+}
+
+func (h *Hub) sendError(client *Client, reason msg.ErrorReasonCode, message string) {
+	rawEvent, err := json.Marshal(&msg.ErrorServerEvent{
+		Reason:  reason,
+		Message: message,
+	})
+	if err != nil {
+		h.logger.Errorf("cannot marshal ErrorServerEvent %v", err)
+		return
+	}
+
+	client.sendWsMessage <- &msg.WsMessage{
+		EventCode: msg.ErrorCode,
+		EventData: rawEvent,
+	}
+}
+
+// Reject login request before it enters queue. Clients that can't
+// receive Error event are closed instead, otherwise they would wait
+// for a ticket that never comes.
+func (h *Hub) rejectLogin(client *Client, reason msg.ErrorReasonCode, message string) {
+	if !client.protocol.Supports(msg.ErrorCode) {
+		h.clientLogger(client).Infow("close client that cannot receive login rejection", "protocolVersion", client.protocol.Version, "reason", reason)
+		client.closeByServer(CloseLoginRejected, "Login rejected")
+		return
+	}
+	h.sendError(client, reason, message)
+}
+
+// Ask client of an outdated protocol to update. Client can still queue.
+func (h *Hub) suggestUpdate(client *Client) {
+	wsMessage, err := UpdateRequiredMessage(client.updateNotice)
+	if err != nil {
+		h.logger.Errorf("cannot marshal UpdateRequiredServerEvent %v", err)
+		return
+	}
+
+	h.metrics.Add("updateSuggested", 1)
+	client.span.AddEvent("suggest update")
+	client.sendWsMessage <- wsMessage
+}
+
+type loginFailure int
+
+const (
+	noFailure loginFailure = iota
+
+	// Network error or main server error that is worth retrying.
+	transientFailure
+
+	// Main server rejects the credential. Retrying won't help.
+	rejectedFailure
+
+	// Main server is under maintenance. Retrying immediately won't
+	// help, but it might be back later.
+	maintenanceFailure
+)
+
+func (f loginFailure) String() string {
+	switch f {
+	case noFailure:
+		return "none"
+	case transientFailure:
+		return "transient"
+	case rejectedFailure:
+		return "rejected"
+	case maintenanceFailure:
+		return "maintenance"
+	default:
+		return "unknown"
+	}
+}
+
+type loginResult struct {
+	event *msg.LoginServerEvent
+
+	failure loginFailure
+}
 
+func classifyLoginFailure(resp *req.Response, err error) loginFailure {
 	if err != nil {
-		h.logger.Errorf("request failed %v", err)
+		return transientFailure
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return maintenanceFailure
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return transientFailure
+	case resp.IsErrorState():
+		return rejectedFailure
+	default:
+		return noFailure
+	}
+}
+
+func (h *Hub) loginForClient(loginData *msg.LoginClientEvent, client *Client, result chan<- *loginResult) {
+	defer close(result)
+
+	ctx, span := h.tracer.Start(client.ctx, "login", trace.WithAttributes(attribute.Int("loginType", int(loginData.Type))))
+	defer span.End()
+
+	provider, payload, err := h.authorizationRequest(loginData)
+	if err != nil {
+		h.clientLogger(client).Errorw("cannot build login request", "loginType", loginData.Type, "err", err)
+		recordSpanError(span, err)
+
+		// Retrying wouldn't build it either, so client is rejected
+		// instead of left waiting.
+		result <- &loginResult{
+			event:   &msg.LoginServerEvent{StatusCode: http.StatusBadRequest},
+			failure: rejectedFailure,
+		}
 		return
 	}
+	url := *h.config.MainServerHost + "/api/user/authorization" + provider.Path()
 
-	if resp.IsErrorState() {
-		h.logger.Errorf("login failed with http status[%v]", resp.Status)
-		result <- &msg.LoginServerEvent{
-			StatusCode: resp.StatusCode,
-			Jwt:        "",
+	resp, err := h.httpClient.R().
+		SetContext(ctx).
+		SetHeaders(client.metadata.Headers()).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("platform", client.platform).
+		SetHeader("deviceid", loginData.DeviceId).
+		SetHeader("sessionid", loginData.SessionId).
+		SetBody(payload).
+		// Only retry transient failures, with capped exponential
+		// backoff so a struggling main server is not hammered.
+		SetRetryCount(*h.config.LoginRetryCount).
+		SetRetryBackoffInterval(time.Second, time.Duration(*h.config.LoginRetryMaxIntervalSeconds)*time.Second).
+		SetRetryCondition(func(resp *req.Response, err error) bool {
+			return classifyLoginFailure(resp, err) == transientFailure
+		}).
+		SetRetryHook(func(resp *req.Response, err error) {
+			if err != nil {
+				h.clientLogger(client).Warnw("retry login", "loginType", loginData.Type, "err", err)
+				return
+			}
+			h.clientLogger(client).Warnw("retry login", "loginType", loginData.Type, "status", resp.Status)
+		}).
+		Post(url)
+
+	failure := classifyLoginFailure(resp, err)
+	span.SetAttributes(attribute.String("provider", provider.Name()), attribute.String("failure", failure.String()))
+	if failure != noFailure {
+		span.SetStatus(codes.Error, failure.String())
+	}
+
+	switch failure {
+	case noFailure:
+		jwt, err := provider.ParseResponse(resp.Bytes())
+		if err != nil {
+			h.clientLogger(client).Errorw("cannot parse login response", "loginType", loginData.Type, "provider", provider.Name(), "err", err)
+			recordSpanError(span, err)
+			result <- &loginResult{
+				event:   &msg.LoginServerEvent{StatusCode: http.StatusBadGateway},
+				failure: rejectedFailure,
+			}
+			return
+		}
+
+		h.clientLogger(client).Infow("login success", "loginType", loginData.Type, "provider", provider.Name())
+		result <- &loginResult{
+			event: &msg.LoginServerEvent{
+				StatusCode: resp.StatusCode,
+				Jwt:        jwt,
+			},
+			failure: failure,
+		}
+	case transientFailure:
+		if err != nil {
+			h.clientLogger(client).Errorw("login request failed", "loginType", loginData.Type, "err", err)
+		} else {
+			h.clientLogger(client).Errorw("login failed", "loginType", loginData.Type, "status", resp.Status)
 		}
-	} else {
-		h.logger.Infof("login success for id[%v]", client.id)
-		result <- &msg.LoginServerEvent{
-			StatusCode: resp.StatusCode,
-			Jwt:        authData.Data.Jwt,
+		result <- &loginResult{failure: failure}
+	default:
+		h.clientLogger(client).Errorw("login failed", "loginType", loginData.Type, "status", resp.Status)
+		result <- &loginResult{
+			event: &msg.LoginServerEvent{
+				StatusCode: resp.StatusCode,
+				Jwt:        "",
+			},
+			failure: failure,
 		}
 	}
 }
 
-func (h *Hub) finishClient(client *Client, result <-chan *msg.LoginServerEvent) {
-	event, ok := <-result
+// Return provider of the login type and request body of its main
+// server authorization api.
+func (h *Hub) authorizationRequest(loginData *msg.LoginClientEvent) (login.Provider, []byte, error) {
+	provider, ok := h.loginProviders.Get(loginData.Type)
+	if !ok {
+		return nil, nil, ErrInvalidLoginType
+	}
+
+	payload, err := provider.MarshalRequest(loginData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return provider, payload, nil
+}
+
+func (h *Hub) finishClient(client *Client, ticket *queue.Ticket, result <-chan *loginResult) {
+	loginResult, ok := <-result
 	if !ok {
-		h.logger.Warnf("cannot get login data from closed channel")
+		h.clientLogger(client).Warnw("cannot get login data from closed channel")
+		h.queue.Abandon <- ticket
+		h.sendError(client, msg.LoginRejectedReason, "Login failed")
+		h.removeClient(client)
+		return
+	}
+
+	client.span.AddEvent("login finished", trace.WithAttributes(attribute.String("failure", loginResult.failure.String())))
+
+	switch loginResult.failure {
+	case transientFailure, maintenanceFailure:
+		if attempts := ticket.Attempts(); attempts >= *h.config.RequeueMaxAttempts {
+			// Give up instead of putting client back forever.
+			h.clientLogger(client).Warnw("login keeps failing after requeue", "attempts", attempts, "failure", loginResult.failure)
+			h.metrics.Add("requeueExhausted", 1)
+			h.queue.Abandon <- ticket
+			h.sendError(client, msg.LoginRejectedReason, "Login failed too many times")
+			loginResult.event = &msg.LoginServerEvent{StatusCode: http.StatusServiceUnavailable}
+			break
+		}
+
+		// Client keeps its login request and will be dequeued again.
+		h.queue.Requeue <- ticket
+		if loginResult.failure == maintenanceFailure {
+			h.sendError(client, msg.MaintenanceReason, "Main server under maintenance, will retry later")
+		} else {
+			h.sendError(client, msg.LoginFailedReason, "Login failed, will retry soon")
+		}
 		return
+	case rejectedFailure:
+		h.queue.Abandon <- ticket
+		h.sendError(client, msg.LoginRejectedReason, "Login rejected by main server")
 	}
 
-	rawEvent, err := json.Marshal(event)
+	rawEvent, err := json.Marshal(loginResult.event)
 	if err != nil {
 		h.logger.Errorf("cannot marshal LoginServerEvent %v", err)
 		return
@@ -309,7 +905,15 @@ func (h *Hub) finishClient(client *Client, result <-chan *msg.LoginServerEvent)
 		EventData: rawEvent,
 	}
 
-	if event.StatusCode == 200 {
-		h.removeClient(client)
+	// Done with client either way. Its login request and device
+	// ticket are released, it has to connect again after rejected.
+	h.removeClient(client)
+}
+
+// Mark span failed if err is not nil.
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 }
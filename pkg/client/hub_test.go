@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/imroc/req/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestIpConnectionLimit(t *testing.T) {
+	setFlag(t, "max-connections-per-ip", "2")
+	hub := newTestHub(t)
+
+	for _, tc := range []struct {
+		ip         string
+		isAcquired bool
+	}{
+		{ip: "192.0.2.1", isAcquired: true},
+		{ip: "192.0.2.1", isAcquired: true},
+		{ip: "192.0.2.1", isAcquired: false},
+		{ip: "192.0.2.2", isAcquired: true},
+	} {
+		if isAcquired := hub.acquireIpConnection(tc.ip); isAcquired != tc.isAcquired {
+			t.Fatalf("acquired [%v] for ip[%v] with connections %v, want [%v]", isAcquired, tc.ip, hub.ipConnections, tc.isAcquired)
+		}
+	}
+	if hub.hasIpCapacity("192.0.2.1") {
+		t.Fatalf("has capacity at limit")
+	}
+
+	// Released connection can be taken again.
+	hub.releaseIpConnection("192.0.2.1")
+	if !hub.hasIpCapacity("192.0.2.1") || !hub.acquireIpConnection("192.0.2.1") {
+		t.Fatalf("cannot acquire released connection")
+	}
+
+	// Releasing more than acquired doesn't make room for more.
+	hub.releaseIpConnection("192.0.2.2")
+	hub.releaseIpConnection("192.0.2.2")
+	if _, ok := hub.ipConnections["192.0.2.2"]; ok {
+		t.Fatalf("ip without connection is still tracked")
+	}
+	if hub.ipConnections["192.0.2.1"] != 2 {
+		t.Fatalf("connections[%v], want 2", hub.ipConnections["192.0.2.1"])
+	}
+}
+
+func TestIpConnectionUnlimited(t *testing.T) {
+	setFlag(t, "max-connections-per-ip", "0")
+	hub := newTestHub(t)
+
+	for i := 0; i < 100; i++ {
+		if !hub.acquireIpConnection("192.0.2.1") {
+			t.Fatalf("connection[%v] rejected without limit", i)
+		}
+	}
+}
+
+func TestDeviceTicketLimit(t *testing.T) {
+	setFlag(t, "max-tickets-per-device", "2")
+	hub := newTestHub(t)
+
+	// Login request is cached after device ticket is acquired, as hub
+	// does.
+	login := func(client *Client, deviceId string) bool {
+		event := &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "token", DeviceId: deviceId}
+
+		hub.mux.Lock()
+		defer hub.mux.Unlock()
+		if !hub.acquireDeviceTicket(client.id, event) {
+			return false
+		}
+		hub.loginDataCache.Put(client.id, event)
+		return true
+	}
+
+	a, b, c := newTestClient("a", "192.0.2.1"), newTestClient("b", "192.0.2.1"), newTestClient("c", "192.0.2.1")
+	if !login(a, "device-1") || !login(b, "device-1") {
+		t.Fatalf("tickets within limit rejected")
+	}
+	if login(c, "device-1") {
+		t.Fatalf("ticket over limit accepted")
+	}
+
+	// Login again with the same device keeps the ticket.
+	if !login(a, "device-1") || hub.deviceTickets["device-1"] != 2 {
+		t.Fatalf("login again rejected or counted, tickets[%v]", hub.deviceTickets["device-1"])
+	}
+
+	// Switching device moves the ticket.
+	if !login(a, "device-2") || hub.deviceTickets["device-1"] != 1 || hub.deviceTickets["device-2"] != 1 {
+		t.Fatalf("tickets %v after switching device, want 1 of each", hub.deviceTickets)
+	}
+	if !login(c, "device-1") {
+		t.Fatalf("ticket rejected after another one moved away")
+	}
+
+	// Removed clients release their tickets.
+	for _, client := range []*Client{a, b, c} {
+		hub.removeClient(client)
+	}
+	if len(hub.deviceTickets) != 0 {
+		t.Fatalf("tickets %v left after clients removed", hub.deviceTickets)
+	}
+}
+
+// Hub with a queue and queue config driven by tests, logging in to
+// mainServer.
+func newLoginTestHub(t *testing.T, mainServer *httptest.Server) (*Hub, *queue.Queue) {
+	t.Helper()
+	setFlag(t, "main-server-host", mainServer.URL)
+	setFlag(t, "login-retry-count", "0")
+
+	clock := infra.NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	health := infra.ProvideHealth()
+	queueConfig := config.ProvideQueueConfig(config.CFG, nil, nil, health, testMetrics, clock, testLoggerFactory)
+	q := queue.ProvideQueue(queue.ProvideStats(config.CFG, testLoggerFactory), config.CFG, queueConfig, health, clock, testLoggerFactory)
+
+	hub := newTestHub(t)
+	hub.queue = q
+	hub.queueConfig = queueConfig
+	hub.httpClient = req.C()
+	return hub, q
+}
+
+func TestLoginWithoutResult(t *testing.T) {
+	mainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": "not an object`))
+	}))
+	t.Cleanup(mainServer.Close)
+
+	for _, tc := range []struct {
+		name       string
+		loginData  *msg.LoginClientEvent
+		statusCode int
+	}{
+		{name: "unparsable response", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "token", DeviceId: "device"}, statusCode: http.StatusBadGateway},
+		{name: "request not built", loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, DeviceId: "device"}, statusCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hub, q := newLoginTestHub(t, mainServer)
+
+			client := newTestClient("a", "192.0.2.1")
+			client.ctx = context.Background()
+			client.span = trace.SpanFromContext(client.ctx)
+			ticket := &queue.Ticket{TicketId: "a"}
+
+			result := make(chan *loginResult)
+			go hub.loginForClient(tc.loginData, client, result)
+			hub.finishClient(client, ticket, result)
+
+			// Client is told and closed instead of left waiting.
+			wsMessages := sentMessages(client)
+			if len(wsMessages) != 2 || wsMessages[0].EventCode != msg.ErrorCode || wsMessages[1].EventCode != msg.LoginCode {
+				t.Fatalf("sent %v, want Error and Login", wsMessages)
+			}
+			event := &msg.LoginServerEvent{}
+			if err := json.Unmarshal(wsMessages[1].EventData, event); err != nil || event.StatusCode != tc.statusCode {
+				t.Fatalf("login event %s, want status code [%v]", wsMessages[1].EventData, tc.statusCode)
+			}
+			if !client.isClosing.Load() {
+				t.Fatalf("client not closed")
+			}
+			if len(q.Abandon) != 1 {
+				t.Fatalf("ticket not abandoned")
+			}
+		})
+	}
+}
+
+func TestAbandonWhileQueueNotifies(t *testing.T) {
+	mainServer := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(mainServer.Close)
+
+	hub, q := newLoginTestHub(t, mainServer)
+	go hub.handleQueue()
+
+	// Like queue worker dequeueing tickets whose clients are gone. It
+	// doesn't read Abandon until every ticket is notified. Tickets are
+	// more than both buffers and the one hub is handling.
+	ticketCnt := cap(q.NotifyFinish) + cap(q.Abandon) + 2
+	notified := make(chan struct{})
+	go func() {
+		for i := 0; i < ticketCnt; i++ {
+			q.NotifyFinish <- &queue.Ticket{TicketId: queue.TicketId(fmt.Sprint("gone-", i))}
+		}
+		close(notified)
+	}()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queue blocked on NotifyFinish, hub blocked on Abandon")
+	}
+
+	for i := 0; i < ticketCnt; i++ {
+		select {
+		case <-q.Abandon:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("abandoned [%v] tickets, want [%v]", i, ticketCnt)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// Connection metadata of a client. Forwarded to main server on every
+// request made on behalf of the client, otherwise main server sees
+// every request coming from queue server.
+type ConnMetadata struct {
+	// Client ip. Derived from proxy headers only if the request
+	// comes from a trusted proxy.
+	Ip string
+
+	UserAgent string
+
+	// Protocol client used to connect to queue server.
+	Proto string
+
+	// Id of the upgrade request, generated by RequestID middleware.
+	// Used to correlate logs of queue server and main server.
+	RequestId string
+}
+
+func NewConnMetadata(c echo.Context) *ConnMetadata {
+	return &ConnMetadata{
+		Ip:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		Proto:     c.Scheme(),
+		RequestId: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+}
+
+func (m *ConnMetadata) Headers() map[string]string {
+	return map[string]string{
+		echo.HeaderXForwardedFor:   m.Ip,
+		echo.HeaderXRealIP:         m.Ip,
+		echo.HeaderXForwardedProto: m.Proto,
+		echo.HeaderXRequestID:      m.RequestId,
+		"User-Agent":               m.UserAgent,
+	}
+}
+
+// Structured log fields identifying a client.
+func logFields(clientId string, metadata *ConnMetadata) []interface{} {
+	return []interface{}{"clientId", clientId, "requestId", metadata.RequestId, "ip", metadata.Ip}
+}
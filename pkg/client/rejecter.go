@@ -0,0 +1,113 @@
+package client
+
+import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Rejections waiting for a worker. Rejections beyond it are closed
+// right away.
+const rejectQueueSize = 4096
+
+// Time allowed to write a rejection that no worker can take, so that
+// caller is held only briefly.
+const overflowWriteWait = 100 * time.Millisecond
+
+type rejection struct {
+	conn *websocket.Conn
+
+	// Sent before close message. Nil means none.
+	wsMessage *msg.WsMessage
+
+	closeMessage []byte
+}
+
+// Close upgraded connections that are not accepted as clients, with a
+// close handshake done by a fixed number of workers. Handler goroutine
+// of the upgrade request returns right away.
+type Rejecter struct {
+	rejections chan *rejection
+
+	config  *config.Config
+	metrics *infra.Metrics
+	logger  *zap.SugaredLogger
+}
+
+func ProvideRejecter(config *config.Config, metrics *infra.Metrics, loggerFactory *infra.LoggerFactory) *Rejecter {
+	return &Rejecter{
+		rejections: make(chan *rejection, rejectQueueSize),
+		config:     config,
+		metrics:    metrics,
+		logger:     loggerFactory.Create("Rejecter").Sugar(),
+	}
+}
+
+func (r *Rejecter) Run() {
+	for i := 0; i < *r.config.RejectWorkers; i++ {
+		go r.worker()
+	}
+}
+
+// Send wsMessage if not nil, then close connection with close code and
+// reason. Returns right away if a worker can take it. Otherwise writes
+// in the calling goroutine for at most overflowWriteWait.
+func (r *Rejecter) Reject(conn *websocket.Conn, wsMessage *msg.WsMessage, closeCode int, closeReason string) {
+	rejection := &rejection{
+		conn:         conn,
+		wsMessage:    wsMessage,
+		closeMessage: websocket.FormatCloseMessage(closeCode, closeReason),
+	}
+
+	select {
+	case r.rejections <- rejection:
+	default:
+		// Workers can't keep up, skip waiting for client to reply.
+		r.metrics.Add("rejectedWithoutHandshake", 1)
+		r.write(rejection, time.Now().Add(overflowWriteWait))
+		conn.Close()
+	}
+}
+
+func (r *Rejecter) worker() {
+	for rejection := range r.rejections {
+		if r.write(rejection, time.Now().Add(writeWait)) {
+			r.waitClose(rejection.conn)
+		}
+		rejection.conn.Close()
+	}
+}
+
+// Write message and close message before deadline. Return false if
+// connection is broken.
+func (r *Rejecter) write(rejection *rejection, deadline time.Time) bool {
+	if rejection.wsMessage != nil {
+		codec := msg.CodecOf(rejection.conn.Subprotocol())
+		if err := writeWsMessage(rejection.conn, codec, rejection.wsMessage, *r.config.WsCompressionMinBytes, deadline); err != nil {
+			r.logger.Debugf("cannot write message to ws conn %v", err)
+			return false
+		}
+	}
+
+	rejection.conn.SetWriteDeadline(deadline)
+	if err := rejection.conn.WriteMessage(websocket.CloseMessage, rejection.closeMessage); err != nil {
+		r.logger.Debugf("cannot write close message to ws conn %v", err)
+		return false
+	}
+	return true
+}
+
+// Read until client replies close message, so that close message is
+// not lost by closing connection too early.
+func (r *Rejecter) waitClose(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(CloseGracePeriod))
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
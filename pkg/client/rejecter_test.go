@@ -0,0 +1,33 @@
+package client
+
+import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRejectOverflow(t *testing.T) {
+	// No worker and no room for rejections, so every rejection
+	// overflows.
+	rejecter := ProvideRejecter(config.CFG, testMetrics, testLoggerFactory)
+	rejecter.rejections = make(chan *rejection)
+
+	// Larger than socket buffers, so writing it blocks since client
+	// never reads.
+	wsMessage := &msg.WsMessage{
+		EventCode: msg.ShouldQueueCode,
+		EventData: []byte(`"` + strings.Repeat("a", 16<<20) + `"`),
+	}
+
+	// Encoding the message takes a while itself, especially with race
+	// detector, but far less than writeWait.
+	start := time.Now()
+	rejecter.Reject(dialIdleConn(t), wsMessage, websocket.CloseNormalClosure, "")
+	if elapsed := time.Since(start); elapsed > overflowWriteWait+3*time.Second {
+		t.Fatalf("reject blocked for [%v], want at most [%v]", elapsed, overflowWriteWait)
+	}
+}
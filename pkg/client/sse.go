@@ -0,0 +1,407 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("sse session not found")
+	ErrSessionExpired  = errors.New("sse session not resumed in time")
+	ErrTransportClosed = errors.New("transport closed")
+	ErrTooManyMessages = errors.New("too many pending messages")
+)
+
+const (
+	// Sent events kept for replay when a stream is resumed.
+	sseBacklogSize = 64
+
+	// Posted client events waiting for recvLoop. Posts beyond it are
+	// refused.
+	sseInboundSize = 16
+)
+
+// First event of every stream, carrying what client needs to post
+// events and resume.
+type sseSessionEvent struct {
+	TicketId string `json:"ticketId"`
+	Token    string `json:"token"`
+}
+
+// Last event of a stream closed by server, like a websocket close
+// message.
+type sseCloseEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Sse sessions by ticket id, so that posted client events and resumed
+// streams reach the client of the session.
+type SseSessions struct {
+	// Key value: ticket id (client.id) -> transport.
+	sessions map[string]*SseTransport
+
+	mux sync.Mutex
+
+	config *config.Config
+
+	metrics *infra.Metrics
+}
+
+func ProvideSseSessions(config *config.Config, metrics *infra.Metrics) *SseSessions {
+	return &SseSessions{
+		sessions: make(map[string]*SseTransport),
+		config:   config,
+		metrics:  metrics,
+	}
+}
+
+// Find session by ticket id. Token must be the one sent to client in
+// session event.
+func (s *SseSessions) Get(ticketId string, token string) (*SseTransport, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	transport, ok := s.sessions[ticketId]
+	if !ok || subtle.ConstantTimeCompare([]byte(transport.token), []byte(token)) != 1 {
+		return nil, fmt.Errorf("%w [%v]", ErrSessionNotFound, ticketId)
+	}
+	return transport, nil
+}
+
+// Session of the same ticket id replaces the previous one, which only
+// stops being reachable and closes with its client.
+func (s *SseSessions) create(ticketId string) (*SseTransport, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	transport := &SseTransport{
+		ticketId:     ticketId,
+		token:        hex.EncodeToString(token),
+		inbound:      make(chan []byte, sseInboundSize),
+		done:         make(chan struct{}),
+		expired:      make(chan struct{}),
+		resumeWindow: time.Duration(*s.config.SseResumeSeconds) * time.Second,
+		sessions:     s,
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.sessions[ticketId] = transport
+	s.metrics.Set("sseSessions", int64(len(s.sessions)))
+	return transport, nil
+}
+
+func (s *SseSessions) remove(transport *SseTransport) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sessions[transport.ticketId] == transport {
+		delete(s.sessions, transport.ticketId)
+	}
+	s.metrics.Set("sseSessions", int64(len(s.sessions)))
+}
+
+// Transport streaming server events as server-sent events, while
+// client events are posted by separate requests. Stream may break, eg.
+// on mobile network switch, and be resumed within a window, with
+// events sent in between replayed.
+type SseTransport struct {
+	ticketId string
+
+	// Secret of the session, required to post events and resume.
+	token string
+
+	// Client events posted, read by recvLoop.
+	inbound chan []byte
+
+	// Closed once server closes the session.
+	done chan struct{}
+
+	doneOnce sync.Once
+
+	// Closed once stream has been detached longer than resumeWindow.
+	expired chan struct{}
+
+	resumeWindow time.Duration
+
+	sessions *SseSessions
+
+	// Lock for protecting fields below. Held while writing to stream.
+	mux sync.Mutex
+
+	// Attached stream. Nil when detached.
+	stream *sseStream
+
+	// Recently sent events, oldest first.
+	backlog []*sseEvent
+
+	// Id of the last sent event.
+	lastId uint64
+
+	// Bumped on every detach, so that expiry of an earlier detach is
+	// ignored.
+	detaches uint64
+}
+
+type sseEvent struct {
+	// Zero means no id, event is not replayed.
+	id uint64
+
+	// Empty means default event type, ie. a msg.WsMessage.
+	name string
+
+	data []byte
+}
+
+func (e *sseEvent) format() []byte {
+	var buf bytes.Buffer
+	if e.id != 0 {
+		fmt.Fprintf(&buf, "id: %v\n", e.id)
+	}
+	if e.name != "" {
+		fmt.Fprintf(&buf, "event: %v\n", e.name)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", e.data)
+	return buf.Bytes()
+}
+
+type sseStream struct {
+	w http.ResponseWriter
+
+	// Closed to end the stream request.
+	end chan struct{}
+}
+
+// Stream events to w until end is closed, which happens once session
+// is closed or resumed by another stream. Caller must call detach if
+// it stops streaming earlier, eg. request is canceled. Events after
+// lastEventId are replayed, resuming is refused if some of them are no
+// longer kept.
+func (t *SseTransport) Attach(w http.ResponseWriter, lastEventId uint64) (end <-chan struct{}, detach func(), err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	select {
+	case <-t.done:
+		return nil, nil, ErrTransportClosed
+	case <-t.expired:
+		return nil, nil, ErrSessionExpired
+	default:
+	}
+
+	if len(t.backlog) > 0 && lastEventId+1 < t.backlog[0].id {
+		return nil, nil, fmt.Errorf("%w, events after [%v] are no longer kept", ErrSessionExpired, lastEventId)
+	}
+
+	if t.stream != nil {
+		t.endStream()
+	}
+
+	writeSseHeader(w)
+	stream := &sseStream{w: w, end: make(chan struct{})}
+	t.stream = stream
+
+	data, err := json.Marshal(&sseSessionEvent{TicketId: t.ticketId, Token: t.token})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.write((&sseEvent{name: "session", data: data}).format()); err != nil {
+		// Stream is broken, request is canceled soon and detaches.
+		return stream.end, func() { t.detach(stream) }, nil
+	}
+
+	for _, event := range t.backlog {
+		if event.id <= lastEventId {
+			continue
+		}
+		if err := t.write(event.format()); err != nil {
+			break
+		}
+	}
+	return stream.end, func() { t.detach(stream) }, nil
+}
+
+func (t *SseTransport) detach(stream *sseStream) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.stream != stream {
+		return
+	}
+	t.endStream()
+
+	t.detaches++
+	detaches := t.detaches
+	time.AfterFunc(t.resumeWindow, func() { t.expire(detaches) })
+}
+
+func (t *SseTransport) expire(detaches uint64) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.stream != nil || t.detaches != detaches {
+		return
+	}
+	select {
+	case <-t.expired:
+	default:
+		close(t.expired)
+	}
+}
+
+// Must hold mux.
+func (t *SseTransport) endStream() {
+	// Write deadline stays on the underlying connection otherwise.
+	http.NewResponseController(t.stream.w).SetWriteDeadline(time.Time{})
+	close(t.stream.end)
+	t.stream = nil
+}
+
+// Write to attached stream. Nothing is written if detached. Must hold
+// mux.
+func (t *SseTransport) write(b []byte) error {
+	if t.stream == nil {
+		return nil
+	}
+
+	controller := http.NewResponseController(t.stream.w)
+	controller.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := t.stream.w.Write(b); err != nil {
+		return err
+	}
+	return controller.Flush()
+}
+
+// Queue a client event for recvLoop.
+func (t *SseTransport) Post(message []byte) error {
+	select {
+	case <-t.done:
+		return ErrTransportClosed
+	case <-t.expired:
+		return ErrSessionExpired
+	default:
+	}
+
+	select {
+	case t.inbound <- message:
+		return nil
+	default:
+		return ErrTooManyMessages
+	}
+}
+
+func (t *SseTransport) ReadMessage() ([]byte, error) {
+	select {
+	case message := <-t.inbound:
+		return message, nil
+	case <-t.done:
+		return nil, ErrTransportClosed
+	case <-t.expired:
+		return nil, ErrSessionExpired
+	}
+}
+
+func (t *SseTransport) WriteMessage(wsMessage *msg.WsMessage) error {
+	data, err := msg.Encode(msg.JsonCodec, wsMessage)
+	if err != nil {
+		return err
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.lastId++
+	event := &sseEvent{id: t.lastId, data: data}
+	t.backlog = append(t.backlog, event)
+	if len(t.backlog) > sseBacklogSize {
+		t.backlog = t.backlog[1:]
+	}
+	return t.write(event.format())
+}
+
+// Events are text, so always json.
+func (t *SseTransport) Codec() msg.Codec {
+	return msg.JsonCodec
+}
+
+func (t *SseTransport) Ping() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.write([]byte(": ping\n\n"))
+}
+
+// Client has nothing to reply, so reads end right away.
+func (t *SseTransport) WriteClose(closeCode int, closeReason string) error {
+	defer t.doneOnce.Do(func() { close(t.done) })
+
+	data, err := json.Marshal(&sseCloseEvent{Code: closeCode, Reason: closeReason})
+	if err != nil {
+		return err
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.write((&sseEvent{name: "close", data: data}).format())
+}
+
+func (t *SseTransport) Close() error {
+	t.doneOnce.Do(func() { close(t.done) })
+
+	t.mux.Lock()
+	if t.stream != nil {
+		t.endStream()
+	}
+	t.mux.Unlock()
+
+	t.sessions.remove(t)
+	return nil
+}
+
+// Reply a stream of wsMessage if not nil and close event, for sse
+// requests that are not accepted as clients.
+func RejectSse(w http.ResponseWriter, wsMessage *msg.WsMessage, closeCode int, closeReason string) error {
+	writeSseHeader(w)
+
+	var buf bytes.Buffer
+	if wsMessage != nil {
+		data, err := json.Marshal(wsMessage)
+		if err != nil {
+			return err
+		}
+		buf.Write((&sseEvent{data: data}).format())
+	}
+
+	data, err := json.Marshal(&sseCloseEvent{Code: closeCode, Reason: closeReason})
+	if err != nil {
+		return err
+	}
+	buf.Write((&sseEvent{name: "close", data: data}).format())
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeSseHeader(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
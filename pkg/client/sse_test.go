@@ -0,0 +1,46 @@
+package client
+
+import (
+	"errors"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSseResumeBacklog(t *testing.T) {
+	transport, err := ProvideSseSessions(config.CFG, testMetrics).create("sse-backlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sent while detached, only the last sseBacklogSize are kept.
+	const sentCnt = sseBacklogSize + 10
+	for i := 0; i < sentCnt; i++ {
+		if err := transport.WriteMessage(&msg.WsMessage{EventCode: msg.QueueStatsCode, EventData: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldestKept := uint64(sentCnt - sseBacklogSize + 1)
+
+	for _, tc := range []struct {
+		name        string
+		lastEventId uint64
+		isExpired   bool
+	}{
+		{name: "missed events dropped", lastEventId: oldestKept - 2, isExpired: true},
+		{name: "never received any", lastEventId: 0, isExpired: true},
+		{name: "missed oldest kept", lastEventId: oldestKept - 1, isExpired: false},
+		{name: "up to date", lastEventId: sentCnt, isExpired: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, detach, err := transport.Attach(httptest.NewRecorder(), tc.lastEventId)
+			if isExpired := errors.Is(err, ErrSessionExpired); isExpired != tc.isExpired {
+				t.Fatalf("attach err[%v], want expired [%v]", err, tc.isExpired)
+			}
+			if detach != nil {
+				detach()
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Connection between a client and server, carrying msg events. Client
+// reads from one goroutine and writes from another.
+type Transport interface {
+	// Block until the next message from client. Return error once
+	// client has closed, replied close message or is gone.
+	ReadMessage() ([]byte, error)
+
+	WriteMessage(wsMessage *msg.WsMessage) error
+
+	// Codec of messages read.
+	Codec() msg.Codec
+
+	// Keep connection alive through proxies and detect dead peer.
+	Ping() error
+
+	// Tell client that server is closing the connection.
+	WriteClose(closeCode int, closeReason string) error
+
+	// Release connection. Pending reads return error.
+	Close() error
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+
+	// Codec of the negotiated subprotocol.
+	codec msg.Codec
+
+	// Messages smaller than this are not compressed.
+	compressionMinBytes int
+}
+
+func newWsTransport(conn *websocket.Conn, config *config.Config, logger *zap.SugaredLogger) *wsTransport {
+	// Connection is closed with CloseMessageTooBig if client sends a
+	// message larger than this.
+	conn.SetReadLimit(int64(*config.MaxMessageBytes))
+
+	// Heartbeat. Set read timeout if client does not respond to ping
+	// for too long. This will in turn make conn.ReadMessage get an io
+	// timeout error and thus closing the connection.
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		logger.Debugw("receive pong")
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	return &wsTransport{
+		conn:                conn,
+		codec:               msg.CodecOf(conn.Subprotocol()),
+		compressionMinBytes: *config.WsCompressionMinBytes,
+	}
+}
+
+func (t *wsTransport) ReadMessage() ([]byte, error) {
+	_, message, err := t.conn.ReadMessage()
+	return message, err
+}
+
+func (t *wsTransport) WriteMessage(wsMessage *msg.WsMessage) error {
+	return writeWsMessage(t.conn, t.codec, wsMessage, t.compressionMinBytes, time.Now().Add(writeWait))
+}
+
+func (t *wsTransport) Codec() msg.Codec {
+	return t.codec
+}
+
+func (t *wsTransport) Ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t *wsTransport) WriteClose(closeCode int, closeReason string) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Shared messages are written as prepared frames, so that broadcasts
+// are encoded and compressed once instead of per connection.
+func writeWsMessage(conn *websocket.Conn, codec msg.Codec, wsMessage *msg.WsMessage, compressionMinBytes int, deadline time.Time) error {
+	data, err := msg.Encode(codec, wsMessage)
+	if err != nil {
+		return err
+	}
+	prepared, err := msg.Prepare(codec, wsMessage)
+	if err != nil {
+		return err
+	}
+
+	// No effect unless permessage-deflate is negotiated.
+	conn.EnableWriteCompression(len(data) >= compressionMinBytes)
+
+	conn.SetWriteDeadline(deadline)
+	if prepared != nil {
+		return conn.WritePreparedMessage(prepared)
+	}
+	return conn.WriteMessage(msg.MessageType(codec), data)
+}
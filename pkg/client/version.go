@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUpdateRequired   = errors.New("update required")
+	ErrInvalidStoreUrls = errors.New("invalid store urls")
+)
+
+// Close code of clients rejected for an outdated protocol version, in
+// the private range and after http 426 Upgrade Required.
+const CloseUpdateRequired = 4426
+
+// Close code of clients that can't receive Error event when their
+// login request is rejected before entering queue, after http 400 Bad
+// Request.
+const CloseLoginRejected = 4400
+
+// Decide protocol of clients from their headers, and whether they are
+// too outdated to queue or only asked to update.
+type VersionPolicy struct {
+	// Key value: platform -> app store url.
+	storeUrls map[string]string
+
+	config *config.Config
+
+	logger *zap.SugaredLogger
+}
+
+func ProvideVersionPolicy(config *config.Config, loggerFactory *infra.LoggerFactory) (*VersionPolicy, error) {
+	policy := &VersionPolicy{
+		storeUrls: make(map[string]string),
+		config:    config,
+		logger:    loggerFactory.Create("VersionPolicy").Sugar(),
+	}
+
+	if *config.StoreUrls == "" {
+		return policy, nil
+	}
+	for _, entry := range strings.Split(*config.StoreUrls, ",") {
+		platform, url, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || platform == "" || url == "" {
+			err := fmt.Errorf("%w [%v] is not platform=url", ErrInvalidStoreUrls, entry)
+			policy.logger.Error(err)
+			return nil, err
+		}
+		policy.storeUrls[platform] = url
+	}
+	return policy, nil
+}
+
+// Protocol of the request by protocolVersion and capabilities headers.
+// Event is not nil if client is outdated. It's forced along with
+// ErrUpdateRequired if client is below min protocol version, otherwise
+// only a suggestion.
+func (p *VersionPolicy) Check(header http.Header) (*msg.Protocol, *msg.UpdateRequiredServerEvent, error) {
+	protocol, err := msg.ParseProtocol(header.Get("protocolVersion"), header.Get("capabilities"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minVersion := msg.ProtocolVersion(p.config.MinProtocolVersion.Get())
+	event := &msg.UpdateRequiredServerEvent{
+		MinVersion:    minVersion,
+		LatestVersion: msg.LatestProtocolVersion,
+		StoreUrl:      p.storeUrls[header.Get("platform")],
+	}
+
+	if protocol.Version < minVersion {
+		event.IsForced = true
+		return protocol, event, fmt.Errorf("%w version[%v] min[%v]", ErrUpdateRequired, protocol.Version, minVersion)
+	}
+	if protocol.Version < msg.ProtocolVersion(p.config.WarnProtocolVersion.Get()) {
+		return protocol, event, nil
+	}
+	return protocol, nil, nil
+}
+
+// UpdateRequired event is sent to clients of every version, since
+// it's meant for outdated ones.
+func UpdateRequiredMessage(event *msg.UpdateRequiredServerEvent) (*msg.WsMessage, error) {
+	rawEvent, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.NewVersionlessMessage(msg.UpdateRequiredCode, rawEvent), nil
+}
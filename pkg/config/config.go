@@ -1,28 +1,172 @@
 package config
 
-import "flag"
+import (
+	"flag"
 
+	"go.uber.org/zap"
+)
+
+// Every flag can also be set by env named after it, eg. REDIS_DB for
+// --redis-db, or by key of config file. Precedence is flag, env, config
+// file, then default. Fields of *ReloadableInt are reloaded from config
+// file without restart.
+//
+// Exceptions are LOG_* and OTEL_* env, which are read by infra when the
+// logger and tracer are created, before config is loaded.
 type Config struct {
-	SessionStaleSeconds *int
-	TicketStaleSeconds  *int
+	ConfigFile *string
+
+	ServerPort *string
+
+	RedisHost *string
+	RedisDb   *int
+
+	MainServerHost   *string
+	MainServerApiKey *string
+
+	CaptchaVerifyUrl *string
+	CaptchaSecret    *string
+
+	SessionStaleSeconds *ReloadableInt
+	TicketStaleSeconds  *ReloadableInt
 
 	NotifyStatsIntervalSeconds *int
-	DequeueIntervalSeconds     *int
-	MaxDequeuePerInterval      *int
+	DequeueIntervalSeconds     *ReloadableInt
+	MaxDequeuePerInterval      *ReloadableInt
 
 	InitAvgWaitSeconds    *int
 	AverageWaitWindowSize *int
 
 	PingIntervalSeconds *int
+
+	MaxConnectionsPerIp *int
+	MaxTicketsPerDevice *int
+
+	RejectWorkers *int
+
+	SseResumeSeconds *int
+
+	MinProtocolVersion  *ReloadableInt
+	WarnProtocolVersion *ReloadableInt
+	StoreUrls           *string
+
+	WsCompression         *bool
+	WsCompressionLevel    *int
+	WsCompressionMinBytes *int
+
+	MaxMessageBytes                   *int
+	MessageRatePerSecond              *float64
+	MessageBurst                      *int
+	MessageRateWarnViolations         *int
+	MessageRateDisconnectViolations   *int
+	MessageRateViolationWindowSeconds *int
+
+	CredentialValidatePath         *string
+	CredentialRefreshPosition      *int
+	CredentialRefreshMarginSeconds *int
+
+	LoginRetryCount              *int
+	LoginRetryMaxIntervalSeconds *int
+	RequeueBackoffSeconds        *int
+	RequeueMaxAttempts           *int
+
+	LoginProvidersFile *string
+
+	TrustedProxyCidrs *string
+	ProxyProtocol     *bool
+
+	ReadyConfigStaleSeconds *ReloadableInt
+
+	MinQueueOnSeconds  *int
+	MinQueueOffSeconds *int
+	FlushPerSecond     *int
+
+	AdminAddr           *string
+	AdminPrincipalsFile *string
+	AdminClientCaFile   *string
+
+	TlsCertDir        *string
+	TlsCertPath       *string
+	TlsPrivateKeyPath *string
+	PlainHttp         *bool
+
+	// Key value: flag name -> where it's set, "flag" or "env". Values
+	// set there are not overridden by config file.
+	overridden map[string]string
+
+	logger *zap.SugaredLogger
 }
 
 var CFG = &Config{
-	SessionStaleSeconds:        flag.Int("session-stale-seconds", 300, "The number of seconds before a session is considered stale. If client goes offline over this period of time, he has to go into login queue again."),
-	TicketStaleSeconds:         flag.Int("ticket-stale-seconds", 300, "After client is inactive for this period, ticket is viewed as stale and can be removed (not immediately removed). If client come back, he will have to wait from the start of the queue."),
+	ConfigFile: flag.String("config-file", "", "Yaml or json file of settings keyed by flag name, eg. dequeue-interval-seconds: 10. Reloadable settings in it are applied on file change or SIGHUP."),
+
+	ServerPort: flag.String("server-port", "", "Port of the queue server."),
+
+	RedisHost: flag.String("redis-host", "", "Address of redis, eg. localhost:6379."),
+	RedisDb:   flag.Int("redis-db", 0, "Redis db number."),
+
+	MainServerHost:   flag.String("main-server-host", "", "Base url of main server, eg. http://localhost:8888."),
+	MainServerApiKey: flag.String("main-server-api-key", "", "Api key of main server."),
+
+	CaptchaVerifyUrl: flag.String("captcha-verify-url", "", "Captcha siteverify api, used when queue config challengeType is captcha. Captcha challenge can't be enabled without it."),
+	CaptchaSecret:    flag.String("captcha-secret", "", "Secret of captcha siteverify api."),
+
+	SessionStaleSeconds:        reloadableInt("session-stale-seconds", 300, "The number of seconds before a session is considered stale. If client goes offline over this period of time, he has to go into login queue again."),
+	TicketStaleSeconds:         reloadableInt("ticket-stale-seconds", 300, "After client is inactive for this period, ticket is viewed as stale and can be removed (not immediately removed). If client come back, he will have to wait from the start of the queue."),
 	NotifyStatsIntervalSeconds: flag.Int("notify-stats-interval-seconds", 5, "Interval to notify stats to client."),
-	DequeueIntervalSeconds:     flag.Int("dequeue-interval-seconds", 10, "Interval to dequeue tickets."),
-	MaxDequeuePerInterval:      flag.Int("max-dequeue-per-interval", 500, "Max number of tickets to dequeue per interval."),
+	DequeueIntervalSeconds:     reloadableInt("dequeue-interval-seconds", 10, "Interval to dequeue tickets."),
+	MaxDequeuePerInterval:      reloadableInt("max-dequeue-per-interval", 500, "Max number of tickets to dequeue per interval."),
 	InitAvgWaitSeconds:         flag.Int("init-avg-wait-seconds", 180, "Initial default value of wait duration."),
 	AverageWaitWindowSize:      flag.Int("average-wait-window-size", 50, "The size of sliding window for calculating average wait time of a ticket."),
 	PingIntervalSeconds:        flag.Int("ping-interval-seconds", 30, "Send pings to websocket peer with this interval."),
+	MaxConnectionsPerIp:        flag.Int("max-connections-per-ip", 0, "Max number of concurrent websocket connections from the same ip. 0 means unlimited."),
+	MaxTicketsPerDevice:        flag.Int("max-tickets-per-device", 0, "Max number of tickets that can be held by the same device id at the same time. 0 means unlimited."),
+
+	RejectWorkers: flag.Int("reject-workers", 128, "Number of goroutines closing rejected websocket connections, each waits for client to reply close message. Rejections more than they can take are closed right away."),
+
+	SseResumeSeconds: flag.Int("sse-resume-seconds", 30, "Keep a sse session whose stream breaks for this number of seconds, so that client can resume it without losing its ticket."),
+
+	MinProtocolVersion:  reloadableInt("min-protocol-version", 1, "Clients of older protocol versions are rejected with a forced UpdateRequired event."),
+	WarnProtocolVersion: reloadableInt("warn-protocol-version", 1, "Clients of older protocol versions are sent an UpdateRequired event as a suggestion, and can still queue."),
+	StoreUrls:           flag.String("store-urls", "", "Comma separated platform=url of app stores, sent to clients asked to update, eg. Android=https://play.google.com/store/apps/details?id=x. Platform is the platform header of client."),
+
+	WsCompression:         flag.Bool("ws-compression", false, "Negotiate permessage-deflate with websocket clients that offer it."),
+	WsCompressionLevel:    flag.Int("ws-compression-level", 6, "Flate level of compressed websocket messages, from -2 (huffman only) to 9 (best compression). 1 is the fastest, but stores messages of a few hundred bytes uncompressed."),
+	WsCompressionMinBytes: flag.Int("ws-compression-min-bytes", 128, "Websocket messages smaller than this are sent uncompressed, since deflate makes them larger."),
+
+	MaxMessageBytes:                   flag.Int("max-message-bytes", 4096, "Max size of a websocket message from client. Connection is closed if exceeded."),
+	MessageRatePerSecond:              flag.Float64("message-rate-per-second", 2, "Number of websocket messages a client can send per second in the long run. Messages over the rate are dropped."),
+	MessageBurst:                      flag.Int("message-burst", 10, "Number of websocket messages a client can send at once before being rate limited."),
+	MessageRateWarnViolations:         flag.Int("message-rate-warn-violations", 3, "Send a warning event to client when this number of its messages are dropped by rate limit."),
+	MessageRateDisconnectViolations:   flag.Int("message-rate-disconnect-violations", 20, "Disconnect client with policy violation close code when this number of its messages are dropped by rate limit."),
+	MessageRateViolationWindowSeconds: flag.Int("message-rate-violation-window-seconds", 60, "Dropped messages of a client are counted within this window, and from zero again after it."),
+
+	CredentialValidatePath:         flag.String("credential-validate-path", "", "If not empty, validate login credential when client enters queue by posting it to main server authorization api with this path suffix (eg. /validate). Empty means only format check."),
+	CredentialRefreshPosition:      flag.Int("credential-refresh-position", 1000, "Ask client to refresh its credential if it's within this number of positions from the head of queue and its credential is about to expire."),
+	CredentialRefreshMarginSeconds: flag.Int("credential-refresh-margin-seconds", 120, "Credential that expires within this number of seconds is viewed as about to expire."),
+
+	LoginRetryCount:              flag.Int("login-retry-count", 3, "Number of retries when login for a dequeued client fails with network or main server error. Ticket is put back to the front of queue if all retries fail."),
+	LoginRetryMaxIntervalSeconds: flag.Int("login-retry-max-interval-seconds", 10, "Max backoff interval between login retries."),
+	RequeueBackoffSeconds:        flag.Int("requeue-backoff-seconds", 5, "Ticket put back to queue after all login retries fail is not dequeued or flushed again until this number of seconds times its attempts has passed."),
+	RequeueMaxAttempts:           flag.Int("requeue-max-attempts", 5, "Login is viewed as rejected if it still fails after the ticket has been put back to queue this number of times."),
+
+	LoginProvidersFile: flag.String("login-providers-file", "", "Json file of extra login providers. Providers in it replace the built-in ones of the same type."),
+
+	TrustedProxyCidrs: flag.String("trusted-proxy-cidrs", "", "Comma separated cidrs of proxies whose X-Forwarded-For header is trusted for client ip. Empty keeps X-Real-IP or X-Forwarded-For header of any peer, falling back to the peer address."),
+	ProxyProtocol:     flag.Bool("proxy-protocol", false, "Require PROXY protocol v1 or v2 header on every connection, for deployments behind L4 load balancers."),
+
+	ReadyConfigStaleSeconds: reloadableInt("ready-config-stale-seconds", 60, "Server is not ready if queue config has not been refreshed from redis and main server within this number of seconds."),
+
+	MinQueueOnSeconds:  flag.Int("min-queue-on-seconds", 60, "Queue keeps functioning for at least this number of seconds after it starts, unless it's disabled."),
+	MinQueueOffSeconds: flag.Int("min-queue-off-seconds", 30, "Queue stays off for at least this number of seconds after it stops."),
+	FlushPerSecond:     flag.Int("flush-per-second", 500, "Number of waiting tickets released to login per second after queue switches off, regardless of free slots."),
+
+	AdminAddr:           flag.String("admin-addr", "127.0.0.1:5488", "Address that admin api listens on. Should be an internal interface. Served over TLS with the certificate of public port unless it's a loopback address. Empty disables admin api."),
+	AdminPrincipalsFile: flag.String("admin-principals-file", "", "Json file of principals allowed to call admin api, with their api key or client certificate common name and role."),
+	AdminClientCaFile:   flag.String("admin-client-ca-file", "", "If not empty, admin api is served over TLS and client certificates signed by this ca are accepted for authentication."),
+
+	TlsCertDir:        flag.String("tls-cert-dir", "", "Directory of domain directories, each holds public.crt and private.key. Certificate is selected by SNI and reloaded on file change or SIGHUP. Empty means using TLS_CERT_PATH and TLS_PRIVATE_KEY_PATH."),
+	TlsCertPath:       flag.String("tls-cert-path", "", "Certificate of the queue server. Only used if tls cert dir is empty."),
+	TlsPrivateKeyPath: flag.String("tls-private-key-path", "", "Private key of the queue server. Only used if tls cert dir is empty."),
+	PlainHttp:         flag.Bool("plain-http", false, "Serve plain http instead of https, for deployments behind a TLS terminating proxy."),
 }
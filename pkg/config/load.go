@@ -0,0 +1,376 @@
+package config
+
+import (
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidConfig    = errors.New("invalid config")
+	ErrUnknownConfigKey = errors.New("unknown config key")
+)
+
+// Wait for config file to settle before reloading, since editors and
+// k8s configmaps replace it in several steps.
+const reloadDelay = time.Second
+
+// Int flag that can be changed by reload while workers are reading it.
+type ReloadableInt struct {
+	value atomic.Int64
+}
+
+func reloadableInt(name string, value int, usage string) *ReloadableInt {
+	v := &ReloadableInt{}
+	v.value.Store(int64(value))
+	flag.Var(v, name, usage)
+	return v
+}
+
+func (v *ReloadableInt) Get() int {
+	return int(v.value.Load())
+}
+
+func (v *ReloadableInt) Set(s string) error {
+	value, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	v.value.Store(int64(value))
+	return nil
+}
+
+func (v *ReloadableInt) String() string {
+	return strconv.Itoa(v.Get())
+}
+
+// Env name of a flag, eg. REDIS_DB for --redis-db.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Fill flags not given on command line from env and config file, then
+// validate. Flags must have been parsed.
+func ProvideConfig(loggerFactory *infra.LoggerFactory) (*Config, error) {
+	CFG.logger = loggerFactory.Create("Config").Sugar()
+	if err := CFG.load(); err != nil {
+		CFG.logger.Errorf("cannot load config %v", err)
+		return nil, err
+	}
+
+	CFG.logger.Infof("config loaded from file[%v]", *CFG.ConfigFile)
+	return CFG, nil
+}
+
+func (c *Config) load() error {
+	c.overridden = make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		c.overridden[f.Name] = "flag"
+	})
+
+	// Empty env is viewed as not set, since docker compose passes
+	// unset variables as empty.
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		value := os.Getenv(envName(f.Name))
+		if c.overridden[f.Name] != "" || value == "" {
+			return
+		}
+
+		c.overridden[f.Name] = "env"
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%w env %v[%v] %v", ErrInvalidConfig, envName(f.Name), value, err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	fileValues, err := c.readFile()
+	if err != nil {
+		return err
+	}
+
+	for name, value := range fileValues {
+		if c.overridden[name] != "" {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%w key %v[%v] of config file %v", ErrInvalidConfig, name, value, err))
+		}
+	}
+
+	return errors.Join(append(errs, c.validate()...)...)
+}
+
+// Read config file as flag name -> value. Empty if there's no config
+// file. Json is read as yaml.
+func (c *Config) readFile() (map[string]string, error) {
+	if *c.ConfigFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(*c.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for name, value := range raw {
+		if flag.Lookup(name) == nil || name == "config-file" {
+			return nil, fmt.Errorf("%w [%v] in config file", ErrUnknownConfigKey, name)
+		}
+
+		switch value := value.(type) {
+		case nil:
+			values[name] = ""
+
+		// Such as a list of cidrs.
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+
+	return values, nil
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"session-stale-seconds", c.SessionStaleSeconds.Get()},
+		{"ticket-stale-seconds", c.TicketStaleSeconds.Get()},
+		{"notify-stats-interval-seconds", *c.NotifyStatsIntervalSeconds},
+		{"dequeue-interval-seconds", c.DequeueIntervalSeconds.Get()},
+		{"max-dequeue-per-interval", c.MaxDequeuePerInterval.Get()},
+		{"average-wait-window-size", *c.AverageWaitWindowSize},
+		{"ping-interval-seconds", *c.PingIntervalSeconds},
+		{"max-message-bytes", *c.MaxMessageBytes},
+		{"message-burst", *c.MessageBurst},
+		{"flush-per-second", *c.FlushPerSecond},
+		{"reject-workers", *c.RejectWorkers},
+		{"sse-resume-seconds", *c.SseResumeSeconds},
+		{"min-protocol-version", c.MinProtocolVersion.Get()},
+		{"warn-protocol-version", c.WarnProtocolVersion.Get()},
+		{"login-retry-max-interval-seconds", *c.LoginRetryMaxIntervalSeconds},
+		{"requeue-backoff-seconds", *c.RequeueBackoffSeconds},
+		{"message-rate-violation-window-seconds", *c.MessageRateViolationWindowSeconds},
+		{"ready-config-stale-seconds", c.ReadyConfigStaleSeconds.Get()},
+	} {
+		if setting.value <= 0 {
+			errs = append(errs, fmt.Errorf("%w %v[%v] must be positive", ErrInvalidConfig, setting.name, setting.value))
+		}
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"redis-db", *c.RedisDb},
+		{"init-avg-wait-seconds", *c.InitAvgWaitSeconds},
+		{"max-connections-per-ip", *c.MaxConnectionsPerIp},
+		{"max-tickets-per-device", *c.MaxTicketsPerDevice},
+		{"message-rate-warn-violations", *c.MessageRateWarnViolations},
+		{"message-rate-disconnect-violations", *c.MessageRateDisconnectViolations},
+		{"credential-refresh-position", *c.CredentialRefreshPosition},
+		{"credential-refresh-margin-seconds", *c.CredentialRefreshMarginSeconds},
+		{"login-retry-count", *c.LoginRetryCount},
+		{"requeue-max-attempts", *c.RequeueMaxAttempts},
+		{"min-queue-on-seconds", *c.MinQueueOnSeconds},
+		{"min-queue-off-seconds", *c.MinQueueOffSeconds},
+		{"ws-compression-min-bytes", *c.WsCompressionMinBytes},
+	} {
+		if setting.value < 0 {
+			errs = append(errs, fmt.Errorf("%w %v[%v] must not be negative", ErrInvalidConfig, setting.name, setting.value))
+		}
+	}
+
+	if level := *c.WsCompressionLevel; level < flate.HuffmanOnly || level > flate.BestCompression {
+		errs = append(errs, fmt.Errorf("%w ws-compression-level[%v] must be between %v and %v", ErrInvalidConfig, level, flate.HuffmanOnly, flate.BestCompression))
+	}
+
+	// Client would be disconnected before it's warned.
+	if *c.MessageRateWarnViolations >= *c.MessageRateDisconnectViolations {
+		errs = append(errs, fmt.Errorf("%w message-rate-warn-violations[%v] must be less than message-rate-disconnect-violations[%v]",
+			ErrInvalidConfig, *c.MessageRateWarnViolations, *c.MessageRateDisconnectViolations))
+	}
+
+	if *c.MessageRatePerSecond <= 0 {
+		errs = append(errs, fmt.Errorf("%w message-rate-per-second[%v] must be positive", ErrInvalidConfig, *c.MessageRatePerSecond))
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"server-port", *c.ServerPort},
+		{"redis-host", *c.RedisHost},
+		{"main-server-host", *c.MainServerHost},
+	} {
+		if setting.value == "" {
+			errs = append(errs, fmt.Errorf("%w %v is required", ErrInvalidConfig, setting.name))
+		}
+	}
+
+	if mainServerUrl, err := url.Parse(*c.MainServerHost); *c.MainServerHost != "" && (err != nil || mainServerUrl.Host == "") {
+		errs = append(errs, fmt.Errorf("%w main-server-host[%v] is not an absolute url", ErrInvalidConfig, *c.MainServerHost))
+	}
+
+	return errs
+}
+
+// Apply reloadable settings of config file. Settings given by flag or
+// env are kept, and reloadable settings removed from file go back to
+// default. Nothing is applied if any of them is invalid.
+func (c *Config) Reload() error {
+	fileValues, err := c.readFile()
+	if err != nil {
+		c.logger.Errorf("cannot read config file[%v] %v", *c.ConfigFile, err)
+		return err
+	}
+
+	changes := make(map[*flag.Flag]string)
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, inFile := fileValues[f.Name]
+		if _, ok := f.Value.(*ReloadableInt); !ok {
+			if inFile && c.overridden[f.Name] == "" && value != f.Value.String() {
+				c.logger.Warnf("%v[%v] in config file needs restart to apply", f.Name, value)
+			}
+			return
+		}
+
+		if source := c.overridden[f.Name]; source != "" {
+			if inFile {
+				c.logger.Warnf("%v in config file is ignored since it's set by %v", f.Name, source)
+			}
+			return
+		}
+
+		if !inFile {
+			value = f.DefValue
+		}
+
+		// Every reloadable setting is an interval or a count.
+		if number, err := strconv.Atoi(value); err != nil || number <= 0 {
+			errs = append(errs, fmt.Errorf("%w %v[%v] must be a positive integer", ErrInvalidConfig, f.Name, value))
+			return
+		}
+
+		if value != f.Value.String() {
+			changes[f] = value
+		}
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		c.logger.Errorf("config file[%v] is not applied %v", *c.ConfigFile, err)
+		return err
+	}
+
+	for f, value := range changes {
+		c.logger.Infof("config %v changed from [%v] to [%v]", f.Name, f.Value.String(), value)
+		f.Value.Set(value)
+	}
+	return nil
+}
+
+// Reload config file on change or SIGHUP. Runs forever.
+func (c *Config) Watch() {
+	if *c.ConfigFile == "" {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// Never fires until the file changes.
+	reloadTimer := time.NewTimer(reloadDelay)
+	reloadTimer.Stop()
+
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	watcher, err := c.newWatcher()
+	if err != nil {
+		c.logger.Errorf("cannot watch config file, only reload on SIGHUP %v", err)
+	} else {
+		defer watcher.Close()
+		fileEvents, fileErrors = watcher.Events, watcher.Errors
+	}
+
+	for {
+		select {
+		case event := <-fileEvents:
+			c.logger.Debugf("config dir changed event[%v]", event)
+			reloadTimer.Reset(reloadDelay)
+
+		case err := <-fileErrors:
+			c.logger.Errorf("config watcher error %v", err)
+
+		case <-reloadTimer.C:
+			c.logger.Infof("reload config since file changed")
+			c.Reload()
+
+		case <-hangup:
+			c.logger.Infof("reload config on SIGHUP")
+			c.Reload()
+		}
+	}
+}
+
+// Watch directory instead of file, since editors and k8s configmaps
+// replace file by rename, which drops watch on file.
+func (c *Config) newWatcher() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(*c.ConfigFile)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+func ProvideRedisConfig(config *Config) *infra.RedisConfig {
+	return &infra.RedisConfig{
+		Host: *config.RedisHost,
+		Db:   *config.RedisDb,
+	}
+}
+
+func ProvideMainServerConfig(config *Config) *infra.MainServerConfig {
+	return &infra.MainServerConfig{
+		Host: *config.MainServerHost,
+	}
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var testLoggerFactory = func() *infra.LoggerFactory {
+	loggerFactory := infra.ProvideLoggerFactory()
+	loggerFactory.SetLevel("", zapcore.WarnLevel)
+	return loggerFactory
+}()
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+// Errors of validate about the flag.
+func validateErrors(c *Config, name string) []error {
+	var errs []error
+	for _, err := range c.validate() {
+		if strings.Contains(err.Error(), name+"[") {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func TestValidateMessageRateViolations(t *testing.T) {
+	for _, tc := range []struct {
+		warn       string
+		disconnect string
+		isValid    bool
+	}{
+		{warn: "3", disconnect: "20", isValid: true},
+		{warn: "0", disconnect: "1", isValid: true},
+		{warn: "20", disconnect: "20", isValid: false},
+		{warn: "21", disconnect: "20", isValid: false},
+	} {
+		setFlag(t, "message-rate-warn-violations", tc.warn)
+		setFlag(t, "message-rate-disconnect-violations", tc.disconnect)
+
+		errs := validateErrors(CFG, "message-rate-warn-violations")
+		if isValid := len(errs) == 0; isValid != tc.isValid {
+			t.Fatalf("warn[%v] disconnect[%v] errs %v, want valid [%v]", tc.warn, tc.disconnect, errs, tc.isValid)
+		}
+	}
+}
+
+// Write config file and use it for the test.
+func writeConfigFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Restore flags changed by load or reload, which are not set through
+// setFlag.
+func restoreFlags(t *testing.T, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+		prev := f.Value.String()
+		t.Cleanup(func() { f.Value.Set(prev) })
+	}
+
+	prevOverridden, prevLogger := CFG.overridden, CFG.logger
+	t.Cleanup(func() { CFG.overridden, CFG.logger = prevOverridden, prevLogger })
+	CFG.logger = testLoggerFactory.Create("Config").Sugar()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	restoreFlags(t, "max-dequeue-per-interval", "ticket-stale-seconds", "session-stale-seconds")
+
+	setFlag(t, "server-port", "8080")
+	setFlag(t, "redis-host", "localhost:6379")
+	setFlag(t, "main-server-host", "http://localhost:8888")
+	setFlag(t, "max-dequeue-per-interval", "3")
+
+	t.Setenv("MAX_DEQUEUE_PER_INTERVAL", "4")
+	t.Setenv("TICKET_STALE_SECONDS", "40")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "max-dequeue-per-interval: 5\nticket-stale-seconds: 50\nsession-stale-seconds: 60\n")
+	setFlag(t, "config-file", path)
+
+	if err := CFG.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		got    int
+		want   int
+		source string
+	}{
+		{name: "max-dequeue-per-interval", got: CFG.MaxDequeuePerInterval.Get(), want: 3, source: "flag"},
+		{name: "ticket-stale-seconds", got: CFG.TicketStaleSeconds.Get(), want: 40, source: "env"},
+		{name: "session-stale-seconds", got: CFG.SessionStaleSeconds.Get(), want: 60, source: ""},
+	} {
+		if tc.got != tc.want || CFG.overridden[tc.name] != tc.source {
+			t.Fatalf("%v[%v] from [%v], want [%v] from [%v]", tc.name, tc.got, CFG.overridden[tc.name], tc.want, tc.source)
+		}
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	restoreFlags(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "no-such-setting: 1\n")
+	setFlag(t, "config-file", path)
+
+	if err := CFG.load(); !errors.Is(err, ErrUnknownConfigKey) {
+		t.Fatalf("err[%v], want [%v]", err, ErrUnknownConfigKey)
+	}
+}
+
+func TestReload(t *testing.T) {
+	restoreFlags(t, "session-stale-seconds", "max-dequeue-per-interval")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	setFlag(t, "config-file", path)
+	CFG.overridden = map[string]string{"max-dequeue-per-interval": "env"}
+
+	// Settings overridden by env and not reloadable ones are kept.
+	prevMaxDequeue, prevRedisDb := CFG.MaxDequeuePerInterval.Get(), *CFG.RedisDb
+	writeConfigFile(t, path, "session-stale-seconds: 30\nmax-dequeue-per-interval: 7\nredis-db: 3\n")
+	if err := CFG.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if CFG.SessionStaleSeconds.Get() != 30 || CFG.MaxDequeuePerInterval.Get() != prevMaxDequeue || *CFG.RedisDb != prevRedisDb {
+		t.Fatalf("session-stale-seconds[%v] max-dequeue-per-interval[%v] redis-db[%v], want [30] [%v] [%v]",
+			CFG.SessionStaleSeconds.Get(), CFG.MaxDequeuePerInterval.Get(), *CFG.RedisDb, prevMaxDequeue, prevRedisDb)
+	}
+
+	// Nothing is applied if any setting is invalid.
+	writeConfigFile(t, path, "session-stale-seconds: 0\n")
+	if err := CFG.Reload(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("err[%v], want [%v]", err, ErrInvalidConfig)
+	}
+	if CFG.SessionStaleSeconds.Get() != 30 {
+		t.Fatalf("session-stale-seconds[%v] after invalid reload, want 30 kept", CFG.SessionStaleSeconds.Get())
+	}
+
+	// Removed setting goes back to default.
+	writeConfigFile(t, path, "{}\n")
+	if err := CFG.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if value := CFG.SessionStaleSeconds.String(); value != flag.Lookup("session-stale-seconds").DefValue {
+		t.Fatalf("session-stale-seconds[%v] after removed, want default", value)
+	}
+}
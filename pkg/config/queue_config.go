@@ -2,10 +2,11 @@ package config
 
 import (
 	"context"
+	"fmt"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
-	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -24,27 +25,78 @@ type QueueConfig struct {
 	// For example, if OnlineUsersThreshold is 1000 and
 	// StartQueueThreshold is 80%, queue will start functioning when
 	// OnlineUsers reaches 1000 x 80% = 800. Will stop functioning
-	// when OnlineUsers drops below 800. Default to 100%.
+	// when OnlineUsers drops below StopQueueThreshold. Default to 100%.
 	StartQueueThreshold float32 `redis:"startQueueThreshold"`
 
+	// Percentage of OnlineUsersThreshold that will stop queueing once
+	// started. Lower than StartQueueThreshold so that queue doesn't
+	// flap when OnlineUsers hovers around the threshold. 0 means the
+	// same as StartQueueThreshold.
+	StopQueueThreshold float32 `redis:"stopQueueThreshold"`
+
 	// If false, will not queue no matter what.
 	IsQueueEnabled bool `redis:"isQueueEnabled"`
 
+	// Replaced as a whole on refresh, since it's read by client
+	// goroutines.
+	challenge atomic.Pointer[ChallengeSettings]
+
 	FreeSlots     uint
 	freeSlotsLock sync.Mutex
 
+	// Unix nano time of the last successful refresh from redis and
+	// main server.
+	lastRefreshTime atomic.Int64
+
+	// Whether queue is functioning. Only switched by Run.
+	isQueueing atomic.Bool
+
+	// Time queue last switched on or off. Zero if never switched.
+	switchTime time.Time
+
+	// Notify whether queue is functioning when it switches on or off.
+	NotifySwitch chan bool
+
+	// Signaled when settings are changed through admin api, by this or
+	// other instances.
+	changed chan struct{}
+
+	config      *Config
 	redisClient *redis.Client
 	httpClient  *req.Client
+	metrics     *infra.Metrics
+	clock       infra.Clock
 	logger      *zap.SugaredLogger
 }
 
-func ProvideQueueConfig(redisClient *redis.Client, httpClient *req.Client, loggerFactory *infra.LoggerFactory) *QueueConfig {
-	return &QueueConfig{
+// Challenge that client must solve before its ticket enters queue.
+type ChallengeSettings struct {
+	// Can be "pow" or "captcha". Empty means no challenge.
+	Type string `redis:"challengeType"`
+
+	// Number of leading zero bits the hash of a pow challenge solution
+	// must have. Each additional bit doubles the expected work of
+	// client.
+	Difficulty uint `redis:"challengeDifficulty"`
+}
+
+func ProvideQueueConfig(config *Config, redisClient *redis.Client, httpClient *req.Client, health *infra.Health, metrics *infra.Metrics, clock infra.Clock, loggerFactory *infra.LoggerFactory) *QueueConfig {
+	queueConfig := &QueueConfig{
 		StartQueueThreshold: 1,
+		NotifySwitch:        make(chan bool, 16),
+		changed:             make(chan struct{}, 1),
+		config:              config,
 		redisClient:         redisClient,
 		httpClient:          httpClient,
+		metrics:             metrics,
+		clock:               clock,
 		logger:              loggerFactory.Create("QueueConfig").Sugar(),
 	}
+	queueConfig.lastRefreshTime.Store(clock.Now().UnixNano())
+	queueConfig.challenge.Store(&ChallengeSettings{})
+
+	health.AddReadinessCheck("queueConfig", queueConfig.checkRefresh)
+	return queueConfig
 }
 
 const (
@@ -55,9 +107,65 @@ const (
 	cfgRedisKey = "config"
 )
 
+// Current challenge settings. Don't modify the returned settings.
+func (c *QueueConfig) Challenge() *ChallengeSettings {
+	return c.challenge.Load()
+}
+
 func (c *QueueConfig) ShouldQueue() bool {
-	return c.IsQueueEnabled &&
-		(float32(c.OnlineUsers) >= float32(c.OnlineUsersThreshold)*c.StartQueueThreshold)
+	return c.isQueueing.Load()
+}
+
+// Switch queue on when online users reach start threshold, and off when
+// they drop below stop threshold. Queue stays on or off for a minimum
+// duration after switching, except that disabling queue switches it off
+// immediately.
+func (c *QueueConfig) switchQueue() {
+	isQueueing := c.isQueueing.Load()
+	sinceSwitch := c.clock.Since(c.switchTime)
+
+	stopQueueThreshold := c.StopQueueThreshold
+	if stopQueueThreshold == 0 {
+		stopQueueThreshold = c.StartQueueThreshold
+	}
+
+	var shouldQueue bool
+	switch {
+	case !c.IsQueueEnabled:
+		shouldQueue = false
+	case isQueueing:
+		shouldQueue = float64(c.OnlineUsers) >= c.usersAt(stopQueueThreshold) ||
+			sinceSwitch < time.Duration(*c.config.MinQueueOnSeconds)*time.Second
+	default:
+		shouldQueue = float64(c.OnlineUsers) >= c.usersAt(c.StartQueueThreshold) &&
+			sinceSwitch >= time.Duration(*c.config.MinQueueOffSeconds)*time.Second
+	}
+
+	if shouldQueue == isQueueing {
+		return
+	}
+
+	c.isQueueing.Store(shouldQueue)
+	c.switchTime = c.clock.Now()
+	c.NotifySwitch <- shouldQueue
+
+	if shouldQueue {
+		c.metrics.Add("queueSwitchOn", 1)
+		c.metrics.Set("isQueueing", 1)
+	} else {
+		c.metrics.Add("queueSwitchOff", 1)
+		c.metrics.Set("isQueueing", 0)
+	}
+	c.logger.Infow("queue switched", "isQueueing", shouldQueue, "isQueueEnabled", c.IsQueueEnabled, "onlineUsers", c.OnlineUsers,
+		"onlineUsersThreshold", c.OnlineUsersThreshold, "startQueueThreshold", c.StartQueueThreshold, "stopQueueThreshold", stopQueueThreshold, "sinceLastSwitch", sinceSwitch)
+}
+
+// Number of online users at ratio of OnlineUsersThreshold. Ratio is
+// widened by its shortest decimal form, otherwise float32 0.6 of 100 is
+// slightly above 60 and 60 users never reach it.
+func (c *QueueConfig) usersAt(ratio float32) float64 {
+	decimal, _ := strconv.ParseFloat(strconv.FormatFloat(float64(ratio), 'g', -1, 32), 64)
+	return float64(c.OnlineUsersThreshold) * decimal
 }
 
 func (c *QueueConfig) ReplenishFreeSlots() {
@@ -86,71 +194,157 @@ func (c *QueueConfig) TakeOneSlot() bool {
 	return true
 }
 
+// Config is stale if it hasn't been refreshed for a while, then
+// queueing decisions are made on outdated online users.
+func (c *QueueConfig) checkRefresh(ctx context.Context) error {
+	sinceRefresh := c.clock.Since(time.Unix(0, c.lastRefreshTime.Load()))
+	if sinceRefresh > time.Duration(c.config.ReadyConfigStaleSeconds.Get())*time.Second {
+		return fmt.Errorf("last refresh %v ago", sinceRefresh.Round(time.Second))
+	}
+	return nil
+}
+
+// Give back a slot taken by a ticket that fails to login.
+func (c *QueueConfig) ReturnOneSlot() {
+	c.freeSlotsLock.Lock()
+	defer c.freeSlotsLock.Unlock()
+
+	c.FreeSlots++
+}
+
 func (c *QueueConfig) Run() {
-	ticker := time.NewTicker(cfgUpdateInterval)
-	for ; true; <-ticker.C {
-		c.logger.Infof("updating config")
-
-		if err := c.redisClient.HGetAll(context.TODO(), cfgRedisKey).Scan(c); err != nil {
-			c.logger.Errorf("err reading config from redis %v", err)
-			continue
-		}
-
-		c.logger.Infof("will queue if online users reach %+v", float32(c.OnlineUsersThreshold)*c.StartQueueThreshold)
-
-		onlineResult := &struct {
-			Data struct {
-				OnlineUsers string `json:"onlineUsers"`
-				PlayingAis  string `json:"playingAis"`
-			} `json:"data"`
-		}{}
-
-		resp, err := c.httpClient.R().
-			SetHeader("jtoken", os.Getenv("MAIN_SERVER_API_KEY")).
-			SetResult(onlineResult).
-			Get(os.Getenv("MAIN_SERVER_HOST") + "/queue/online-users")
-
-		if err != nil {
-			c.logger.Errorf("request failed %v", err)
-			continue
-		}
-
-		if resp.IsError() {
-			c.logger.Errorf("request failed with status[%v]", resp.Status)
-			continue
-		}
-
-		c.logger.Infof("retrieved online user result[%+v]", onlineResult)
-
-		newOnlineUsers, err := strconv.Atoi(onlineResult.Data.OnlineUsers)
-		if err != nil {
-			c.logger.Errorf("cannot parse online user number[%v] to int %v", newOnlineUsers, err)
-			continue
-		}
-
-		// Will skip if main server hasn't updated his online user
-		// number. We must do this in case that main server do not
-		// update frequently. In this case, queue server will dequeue
-		// too many users in a short period of time.
-		if newOnlineUsers == int(c.OnlineUsers) {
-			c.logger.Infof("skip update since onlineUsers not change config[%+v]", c)
-			continue
-		}
-
-		c.OnlineUsers = uint(newOnlineUsers)
+	go c.subscribeChanges()
+
+	ticker := c.clock.NewTicker(cfgUpdateInterval)
+	for ; true; c.waitRefresh(ticker) {
+		c.refresh()
+		c.switchQueue()
+	}
+}
+
+// Apply online users and switch queue without redis and main server.
+// For simulation, where Run is not used.
+func (c *QueueConfig) SetOnlineUsers(onlineUsers uint) {
+	if onlineUsers != c.OnlineUsers {
+		c.OnlineUsers = onlineUsers
 		c.ReplenishFreeSlots()
+	}
+	c.switchQueue()
+}
+
+// Read config from redis and online users from main server.
+func (c *QueueConfig) refresh() {
+	c.logger.Infof("updating config")
+
+	if err := c.scan(); err != nil {
+		return
+	}
+
+	c.logger.Infof("will queue if online users reach %+v", c.usersAt(c.StartQueueThreshold))
+
+	onlineResult := &struct {
+		Data struct {
+			OnlineUsers string `json:"onlineUsers"`
+			PlayingAis  string `json:"playingAis"`
+		} `json:"data"`
+	}{}
+
+	resp, err := c.httpClient.R().
+		SetHeader("jtoken", *c.config.MainServerApiKey).
+		SetResult(onlineResult).
+		Get(*c.config.MainServerHost + "/queue/online-users")
+
+	if err != nil {
+		c.logger.Errorf("request failed %v", err)
+		return
+	}
+
+	if resp.IsError() {
+		c.logger.Errorf("request failed with status[%v]", resp.Status)
+		return
+	}
+
+	c.logger.Infof("retrieved online user result[%+v]", onlineResult)
+
+	newOnlineUsers, err := strconv.Atoi(onlineResult.Data.OnlineUsers)
+	if err != nil {
+		c.logger.Errorf("cannot parse online user number[%v] to int %v", newOnlineUsers, err)
+		return
+	}
+	c.lastRefreshTime.Store(c.clock.Now().UnixNano())
+
+	// Will skip if main server hasn't updated his online user
+	// number. We must do this in case that main server do not
+	// update frequently. In this case, queue server will dequeue
+	// too many users in a short period of time.
+	if newOnlineUsers == int(c.OnlineUsers) {
+		c.logger.Infof("skip update since onlineUsers[%v] not change", c.OnlineUsers)
+		return
+	}
+
+	c.OnlineUsers = uint(newOnlineUsers)
+	c.ReplenishFreeSlots()
 
-		if _, err := c.redisClient.HSet(context.TODO(), cfgRedisKey,
-			"onlineUsers", c.OnlineUsers,
-		).Result(); err != nil {
-			c.logger.Errorf("err setting onlineUsers to redis %v", err)
-			continue
-		}
+	if _, err := c.redisClient.HSet(context.TODO(), cfgRedisKey,
+		"onlineUsers", c.OnlineUsers,
+	).Result(); err != nil {
+		c.logger.Errorf("err setting onlineUsers to redis %v", err)
+		return
+	}
+
+	if err := c.scan(); err != nil {
+		return
+	}
+	c.logger.Infof("updated config onlineUsers[%v] threshold[%v] isQueueEnabled[%v] challenge[%+v]",
+		c.OnlineUsers, c.OnlineUsersThreshold, c.IsQueueEnabled, *c.Challenge())
+}
+
+// Wait for next tick, or settings change so it's applied immediately.
+func (c *QueueConfig) waitRefresh(ticker infra.Ticker) {
+	select {
+	case <-ticker.C():
+	case <-c.changed:
+	}
+}
+
+// Read config from redis. Settings edited directly in redis are
+// validated too, current config is kept if they're invalid.
+func (c *QueueConfig) scan() error {
+	cmd := c.redisClient.HGetAll(context.TODO(), cfgRedisKey)
+	settings, err := scanQueueSettings(cmd)
+	if err != nil {
+		c.logger.Errorf("err reading config from redis %v", err)
+		return err
+	}
+
+	if err := settings.Validate(); err != nil {
+		c.logger.Errorf("keep current config since config in redis is invalid %v", err)
+		return err
+	}
+
+	challenge := &ChallengeSettings{}
+	if err := cmd.Scan(challenge); err != nil {
+		c.logger.Errorf("err reading config from redis %v", err)
+		return err
+	}
+	if err := c.validateChallenge(challenge); err != nil {
+		c.logger.Errorf("keep current config since config in redis is invalid %v", err)
+		return err
+	}
+
+	if err := cmd.Scan(c); err != nil {
+		c.logger.Errorf("err reading config from redis %v", err)
+		return err
+	}
+	c.challenge.Store(challenge)
+	return nil
+}
 
-		if err := c.redisClient.HGetAll(context.TODO(), cfgRedisKey).Scan(c); err != nil {
-			c.logger.Errorf("err reading config from redis %v", err)
-			continue
-		}
-		c.logger.Infof("updated config[%+v]", c)
+// Captcha can't be verified without verify url, every client would be
+// stuck at the challenge.
+func (c *QueueConfig) validateChallenge(challenge *ChallengeSettings) error {
+	if challenge.Type == "captcha" && *c.config.CaptchaVerifyUrl == "" {
+		return fmt.Errorf("%w challengeType[captcha] needs captcha-verify-url", ErrInvalidQueueSettings)
 	}
+	return nil
 }
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// Metrics can only be provided once per process.
+var testMetrics = infra.ProvideMetrics()
+
+// Queue config backed by its own redis, without main server.
+func newTestQueueConfig(t *testing.T) (*QueueConfig, *miniredis.Miniredis, *infra.VirtualClock) {
+	t.Helper()
+
+	testRedis := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedis.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	clock := infra.NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	queueConfig := ProvideQueueConfig(CFG, redisClient, nil, infra.ProvideHealth(), testMetrics, clock, testLoggerFactory)
+	return queueConfig, testRedis, clock
+}
+
+func TestScanChallenge(t *testing.T) {
+	queueConfig, testRedis, _ := newTestQueueConfig(t)
+
+	testRedis.HSet(cfgRedisKey, "challengeType", "pow", "challengeDifficulty", "8")
+	if err := queueConfig.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if challenge := queueConfig.Challenge(); challenge.Type != "pow" || challenge.Difficulty != 8 {
+		t.Fatalf("challenge %+v, want pow of difficulty 8", challenge)
+	}
+
+	// Captcha without verify url keeps current challenge.
+	testRedis.HSet(cfgRedisKey, "challengeType", "captcha")
+	if err := queueConfig.scan(); !errors.Is(err, ErrInvalidQueueSettings) {
+		t.Fatalf("err[%v], want [%v]", err, ErrInvalidQueueSettings)
+	}
+	if challenge := queueConfig.Challenge(); challenge.Type != "pow" {
+		t.Fatalf("challenge %+v, want pow kept", challenge)
+	}
+
+	setFlag(t, "captcha-verify-url", "https://example.com/siteverify")
+	if err := queueConfig.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if challenge := queueConfig.Challenge(); challenge.Type != "captcha" {
+		t.Fatalf("challenge %+v, want captcha", challenge)
+	}
+}
+
+// Switches notified so far.
+func notifiedSwitches(c *QueueConfig) []bool {
+	var switches []bool
+	for {
+		select {
+		case isQueueing := <-c.NotifySwitch:
+			switches = append(switches, isQueueing)
+		default:
+			return switches
+		}
+	}
+}
+
+func TestSwitchQueue(t *testing.T) {
+	setFlag(t, "min-queue-on-seconds", "30")
+	setFlag(t, "min-queue-off-seconds", "60")
+
+	queueConfig, _, clock := newTestQueueConfig(t)
+	queueConfig.IsQueueEnabled = true
+	queueConfig.OnlineUsersThreshold = 100
+	queueConfig.StartQueueThreshold = 0.8
+	queueConfig.StopQueueThreshold = 0.6
+
+	for _, tc := range []struct {
+		name        string
+		elapsed     time.Duration
+		onlineUsers uint
+		isEnabled   bool
+		isQueueing  bool
+	}{
+		{name: "below start", onlineUsers: 79, isEnabled: true, isQueueing: false},
+		{name: "reach start", onlineUsers: 80, isEnabled: true, isQueueing: true},
+		{name: "between stop and start", elapsed: 40 * time.Second, onlineUsers: 70, isEnabled: true, isQueueing: true},
+		{name: "reach stop", onlineUsers: 60, isEnabled: true, isQueueing: true},
+		{name: "below stop", onlineUsers: 59, isEnabled: true, isQueueing: false},
+		{name: "reach start within min off", elapsed: 59 * time.Second, onlineUsers: 90, isEnabled: true, isQueueing: false},
+		{name: "reach start after min off", elapsed: time.Second, onlineUsers: 90, isEnabled: true, isQueueing: true},
+		{name: "below stop within min on", elapsed: 29 * time.Second, onlineUsers: 10, isEnabled: true, isQueueing: true},
+		{name: "below stop after min on", elapsed: time.Second, onlineUsers: 10, isEnabled: true, isQueueing: false},
+		{name: "reach start after min off again", elapsed: time.Minute, onlineUsers: 90, isEnabled: true, isQueueing: true},
+		{name: "disabled within min on", onlineUsers: 90, isEnabled: false, isQueueing: false},
+	} {
+		wasQueueing := queueConfig.ShouldQueue()
+
+		clock.Advance(tc.elapsed)
+		queueConfig.IsQueueEnabled = tc.isEnabled
+		queueConfig.SetOnlineUsers(tc.onlineUsers)
+
+		if isQueueing := queueConfig.ShouldQueue(); isQueueing != tc.isQueueing {
+			t.Fatalf("%v: isQueueing[%v], want [%v]", tc.name, isQueueing, tc.isQueueing)
+		}
+
+		var wantSwitches []bool
+		if tc.isQueueing != wasQueueing {
+			wantSwitches = []bool{tc.isQueueing}
+		}
+		if switches := notifiedSwitches(queueConfig); len(switches) != len(wantSwitches) || (len(switches) == 1 && switches[0] != wantSwitches[0]) {
+			t.Fatalf("%v: notified %v, want %v", tc.name, switches, wantSwitches)
+		}
+	}
+}
+
+func TestSwitchQueueSingleThreshold(t *testing.T) {
+	setFlag(t, "min-queue-on-seconds", "0")
+	setFlag(t, "min-queue-off-seconds", "0")
+
+	queueConfig, _, _ := newTestQueueConfig(t)
+	queueConfig.IsQueueEnabled = true
+	queueConfig.OnlineUsersThreshold = 100
+	queueConfig.StartQueueThreshold = 0.8
+
+	// Zero stop threshold is the same as start threshold.
+	for _, tc := range []struct {
+		onlineUsers uint
+		isQueueing  bool
+	}{
+		{onlineUsers: 80, isQueueing: true},
+		{onlineUsers: 79, isQueueing: false},
+		{onlineUsers: 80, isQueueing: true},
+	} {
+		queueConfig.SetOnlineUsers(tc.onlineUsers)
+		if isQueueing := queueConfig.ShouldQueue(); isQueueing != tc.isQueueing {
+			t.Fatalf("isQueueing[%v] at onlineUsers[%v], want [%v]", isQueueing, tc.onlineUsers, tc.isQueueing)
+		}
+	}
+}
+
+func TestReadinessConfigStale(t *testing.T) {
+	setFlag(t, "ready-config-stale-seconds", "60")
+
+	health := infra.ProvideHealth()
+	clock := infra.NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ProvideQueueConfig(CFG, nil, nil, health, testMetrics, clock, testLoggerFactory)
+
+	clock.Advance(60 * time.Second)
+	if isReady, results := health.Readiness(context.Background()); !isReady {
+		t.Fatalf("not ready with queueConfig %+v", results["queueConfig"])
+	}
+
+	// Not refreshed from redis and main server since.
+	clock.Advance(time.Second)
+	if isReady, results := health.Readiness(context.Background()); isReady || results["queueConfig"].Ok {
+		t.Fatalf("ready[%v] with queueConfig %+v, want stale", isReady, results["queueConfig"])
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrInvalidQueueSettings = errors.New("invalid queue settings")
+	ErrVersionConflict      = errors.New("queue config has been changed by others")
+	ErrVersionNotFound      = errors.New("version not found in history")
+)
+
+const (
+	// Append-only list of QueueConfigChange json, oldest first.
+	cfgHistoryRedisKey = "config:history"
+
+	// Set to version of settings on every change. Watched instead of
+	// config hash, which every instance writes onlineUsers to.
+	cfgVersionRedisKey = "config:version"
+
+	// Version of the new config is published to this channel on every
+	// change, so that every instance refreshes immediately.
+	cfgChangedChannel = "config:changed"
+)
+
+// Part of queue config that ops can change through admin api. Stored in
+// redis config hash together with data from main server.
+type QueueSettings struct {
+	// Incremented on every change made through admin api. Zero if
+	// never changed.
+	Version int64 `redis:"version" json:"version"`
+
+	IsQueueEnabled bool `redis:"isQueueEnabled" json:"isQueueEnabled"`
+
+	OnlineUsersThreshold uint `redis:"onlineUsersThreshold" json:"onlineUsersThreshold"`
+
+	StartQueueThreshold float32 `redis:"startQueueThreshold" json:"startQueueThreshold"`
+
+	// 0 means the same as StartQueueThreshold.
+	StopQueueThreshold float32 `redis:"stopQueueThreshold" json:"stopQueueThreshold"`
+}
+
+// Fields not given are kept.
+type QueueSettingsUpdate struct {
+	IsQueueEnabled *bool `json:"isQueueEnabled"`
+
+	OnlineUsersThreshold *uint `json:"onlineUsersThreshold"`
+
+	StartQueueThreshold *float32 `json:"startQueueThreshold"`
+
+	StopQueueThreshold *float32 `json:"stopQueueThreshold"`
+}
+
+// One entry of change history.
+type QueueConfigChange struct {
+	Version int64 `json:"version"`
+
+	Time time.Time `json:"time"`
+
+	// Name of admin principal who made the change.
+	Principal string `json:"principal"`
+
+	Old *QueueSettings `json:"old"`
+
+	New *QueueSettings `json:"new"`
+
+	// Version rolled back to. Zero if it's not a rollback.
+	RollbackTo int64 `json:"rollbackTo,omitempty"`
+}
+
+func (s *QueueSettings) Validate() error {
+	if s.StartQueueThreshold <= 0 || s.StartQueueThreshold > 1 {
+		return fmt.Errorf("%w startQueueThreshold[%v] must be within (0, 1]", ErrInvalidQueueSettings, s.StartQueueThreshold)
+	}
+
+	if s.StopQueueThreshold < 0 || s.StopQueueThreshold > s.StartQueueThreshold {
+		return fmt.Errorf("%w stopQueueThreshold[%v] must be within [0, startQueueThreshold]", ErrInvalidQueueSettings, s.StopQueueThreshold)
+	}
+
+	// Everyone would be queued.
+	if s.IsQueueEnabled && s.OnlineUsersThreshold == 0 {
+		return fmt.Errorf("%w onlineUsersThreshold must be positive when queue is enabled", ErrInvalidQueueSettings)
+	}
+
+	return nil
+}
+
+// Missing fields of redis config hash are default values.
+func scanQueueSettings(cmd *redis.StringStringMapCmd) (*QueueSettings, error) {
+	settings := &QueueSettings{StartQueueThreshold: 1}
+	if err := cmd.Scan(settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (c *QueueConfig) GetSettings(ctx context.Context) (*QueueSettings, error) {
+	return scanQueueSettings(c.redisClient.HGetAll(ctx, cfgRedisKey))
+}
+
+// Apply update if current version is still version, which client read
+// before making the update.
+func (c *QueueConfig) UpdateSettings(ctx context.Context, version int64, update *QueueSettingsUpdate, principal string) (*QueueConfigChange, error) {
+	return c.changeSettings(ctx, version, principal, 0, func(settings *QueueSettings) {
+		if update.IsQueueEnabled != nil {
+			settings.IsQueueEnabled = *update.IsQueueEnabled
+		}
+		if update.OnlineUsersThreshold != nil {
+			settings.OnlineUsersThreshold = *update.OnlineUsersThreshold
+		}
+		if update.StartQueueThreshold != nil {
+			settings.StartQueueThreshold = *update.StartQueueThreshold
+		}
+		if update.StopQueueThreshold != nil {
+			settings.StopQueueThreshold = *update.StopQueueThreshold
+		}
+	})
+}
+
+// Restore settings of a previous version as a new version, so history
+// stays append-only.
+func (c *QueueConfig) RollbackSettings(ctx context.Context, version int64, toVersion int64, principal string) (*QueueConfigChange, error) {
+	history, err := c.History(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *QueueSettings
+	for _, change := range history {
+		if change.Version == toVersion {
+			target = change.New
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("%w [%v]", ErrVersionNotFound, toVersion)
+	}
+
+	return c.changeSettings(ctx, version, principal, toVersion, func(settings *QueueSettings) {
+		settings.IsQueueEnabled = target.IsQueueEnabled
+		settings.OnlineUsersThreshold = target.OnlineUsersThreshold
+		settings.StartQueueThreshold = target.StartQueueThreshold
+		settings.StopQueueThreshold = target.StopQueueThreshold
+	})
+}
+
+// Change settings in a redis transaction, which fails if settings are
+// changed by others in between.
+func (c *QueueConfig) changeSettings(ctx context.Context, version int64, principal string, rollbackTo int64, apply func(settings *QueueSettings)) (*QueueConfigChange, error) {
+	var change *QueueConfigChange
+	err := c.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		oldSettings, err := scanQueueSettings(tx.HGetAll(ctx, cfgRedisKey))
+		if err != nil {
+			return err
+		}
+
+		if oldSettings.Version != version {
+			return fmt.Errorf("%w current version[%v] but update is based on version[%v]", ErrVersionConflict, oldSettings.Version, version)
+		}
+
+		newSettings := *oldSettings
+		apply(&newSettings)
+		newSettings.Version++
+		if err := newSettings.Validate(); err != nil {
+			return err
+		}
+
+		change = &QueueConfigChange{
+			Version:    newSettings.Version,
+			Time:       time.Now(),
+			Principal:  principal,
+			Old:        oldSettings,
+			New:        &newSettings,
+			RollbackTo: rollbackTo,
+		}
+		changeJson, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, cfgRedisKey,
+				"version", newSettings.Version,
+				"isQueueEnabled", newSettings.IsQueueEnabled,
+				"onlineUsersThreshold", newSettings.OnlineUsersThreshold,
+				"startQueueThreshold", newSettings.StartQueueThreshold,
+				"stopQueueThreshold", newSettings.StopQueueThreshold,
+			)
+			pipe.Set(ctx, cfgVersionRedisKey, newSettings.Version, 0)
+			pipe.RPush(ctx, cfgHistoryRedisKey, changeJson)
+			pipe.Publish(ctx, cfgChangedChannel, newSettings.Version)
+			return nil
+		})
+		return err
+	}, cfgVersionRedisKey)
+
+	if err == redis.TxFailedErr {
+		return nil, fmt.Errorf("%w during update", ErrVersionConflict)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Infow("queue settings changed", "principal", principal, "version", change.Version, "old", change.Old, "new", change.New, "rollbackTo", change.RollbackTo)
+	return change, nil
+}
+
+// Return the last limit changes, newest first. Zero limit means all.
+func (c *QueueConfig) History(ctx context.Context, limit int64) ([]*QueueConfigChange, error) {
+	start := -limit
+	if limit <= 0 {
+		start = 0
+	}
+
+	values, err := c.redisClient.LRange(ctx, cfgHistoryRedisKey, start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*QueueConfigChange, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		change := &QueueConfigChange{}
+		if err := json.Unmarshal([]byte(values[i]), change); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+// Ask Run to refresh whenever any instance changes settings. Reconnect
+// is handled by redis client.
+func (c *QueueConfig) subscribeChanges() {
+	pubsub := c.redisClient.Subscribe(context.Background(), cfgChangedChannel)
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		c.logger.Infof("queue settings changed to version[%v], refresh now", message.Payload)
+		select {
+		case c.changed <- struct{}{}:
+		default:
+			// A refresh is already pending.
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func boolPtr(value bool) *bool { return &value }
+
+func uintPtr(value uint) *uint { return &value }
+
+func float32Ptr(value float32) *float32 { return &value }
+
+func TestUpdateSettings(t *testing.T) {
+	queueConfig, _, _ := newTestQueueConfig(t)
+	ctx := context.Background()
+
+	change, err := queueConfig.UpdateSettings(ctx, 0, &QueueSettingsUpdate{
+		IsQueueEnabled:       boolPtr(true),
+		OnlineUsersThreshold: uintPtr(1000),
+		StartQueueThreshold:  float32Ptr(0.8),
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Version != 1 || change.Old.Version != 0 || change.Principal != "alice" {
+		t.Fatalf("change %+v, want version 1 by alice", change)
+	}
+
+	// Fields not given are kept.
+	change, err = queueConfig.UpdateSettings(ctx, 1, &QueueSettingsUpdate{StopQueueThreshold: float32Ptr(0.6)}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings := change.New; settings.Version != 2 || !settings.IsQueueEnabled || settings.OnlineUsersThreshold != 1000 || settings.StopQueueThreshold != 0.6 {
+		t.Fatalf("settings %+v after partial update", settings)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		version int64
+		update  *QueueSettingsUpdate
+		err     error
+	}{
+		{name: "stale version", version: 1, update: &QueueSettingsUpdate{IsQueueEnabled: boolPtr(false)}, err: ErrVersionConflict},
+		{name: "zero start threshold", version: 2, update: &QueueSettingsUpdate{StartQueueThreshold: float32Ptr(0)}, err: ErrInvalidQueueSettings},
+		{name: "stop above start", version: 2, update: &QueueSettingsUpdate{StopQueueThreshold: float32Ptr(0.9)}, err: ErrInvalidQueueSettings},
+		{name: "zero online users threshold", version: 2, update: &QueueSettingsUpdate{OnlineUsersThreshold: uintPtr(0)}, err: ErrInvalidQueueSettings},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := queueConfig.UpdateSettings(ctx, tc.version, tc.update, "mallory"); !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+		})
+	}
+
+	// Rejected updates are not recorded.
+	settings, err := queueConfig.GetSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := queueConfig.History(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Version != 2 || len(history) != 2 {
+		t.Fatalf("version[%v] with [%v] changes, want version 2 with 2 changes", settings.Version, len(history))
+	}
+}
+
+func TestUpdateSettingsDuringRefresh(t *testing.T) {
+	queueConfig, testRedis, _ := newTestQueueConfig(t)
+	ctx := context.Background()
+
+	// Another instance writes online users to config hash between read
+	// and update.
+	change, err := queueConfig.changeSettings(ctx, 0, "alice", 0, func(settings *QueueSettings) {
+		testRedis.HSet(cfgRedisKey, "onlineUsers", "1234")
+		settings.OnlineUsersThreshold = 1000
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Version != 1 || change.New.OnlineUsersThreshold != 1000 {
+		t.Fatalf("change %+v, want version 1 with threshold 1000", change)
+	}
+	if onlineUsers := testRedis.HGet(cfgRedisKey, "onlineUsers"); onlineUsers != "1234" {
+		t.Fatalf("onlineUsers[%v], want kept", onlineUsers)
+	}
+
+	// Settings changed by another admin in between still conflict.
+	_, err = queueConfig.changeSettings(ctx, 1, "alice", 0, func(settings *QueueSettings) {
+		if _, err := queueConfig.UpdateSettings(ctx, 1, &QueueSettingsUpdate{OnlineUsersThreshold: uintPtr(2000)}, "bob"); err != nil {
+			t.Error(err)
+		}
+		settings.OnlineUsersThreshold = 3000
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("err[%v], want [%v]", err, ErrVersionConflict)
+	}
+
+	settings, err := queueConfig.GetSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Version != 2 || settings.OnlineUsersThreshold != 2000 {
+		t.Fatalf("settings %+v, want version 2 by bob", settings)
+	}
+}
+
+func TestRollbackSettings(t *testing.T) {
+	queueConfig, _, _ := newTestQueueConfig(t)
+	ctx := context.Background()
+
+	for version, threshold := range []uint{100, 200, 300} {
+		if _, err := queueConfig.UpdateSettings(ctx, int64(version), &QueueSettingsUpdate{OnlineUsersThreshold: uintPtr(threshold)}, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	change, err := queueConfig.RollbackSettings(ctx, 3, 1, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Version != 4 || change.RollbackTo != 1 || change.New.OnlineUsersThreshold != 100 || change.Old.OnlineUsersThreshold != 300 {
+		t.Fatalf("rollback change %+v, want version 4 restoring threshold 100", change)
+	}
+
+	if _, err := queueConfig.RollbackSettings(ctx, 4, 99, "bob"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("err[%v], want [%v]", err, ErrVersionNotFound)
+	}
+	if _, err := queueConfig.RollbackSettings(ctx, 3, 2, "bob"); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("err[%v], want [%v]", err, ErrVersionConflict)
+	}
+
+	// Newest first.
+	history, err := queueConfig.History(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Version != 4 || history[1].Version != 3 {
+		t.Fatalf("history %+v, want versions 4 and 3", history)
+	}
+}
+
+func TestScanInvalidSettings(t *testing.T) {
+	queueConfig, testRedis, _ := newTestQueueConfig(t)
+
+	testRedis.HSet(cfgRedisKey, "isQueueEnabled", "1", "onlineUsersThreshold", "1000", "startQueueThreshold", "0.8")
+	if err := queueConfig.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Typo edited directly in redis keeps current config.
+	testRedis.HSet(cfgRedisKey, "startQueueThreshold", "8")
+	if err := queueConfig.scan(); !errors.Is(err, ErrInvalidQueueSettings) {
+		t.Fatalf("err[%v], want [%v]", err, ErrInvalidQueueSettings)
+	}
+	if queueConfig.StartQueueThreshold != 0.8 {
+		t.Fatalf("startQueueThreshold[%v], want 0.8 kept", queueConfig.StartQueueThreshold)
+	}
+}
+
+func TestSubscribeChanges(t *testing.T) {
+	queueConfig, _, _ := newTestQueueConfig(t)
+	go queueConfig.subscribeChanges()
+
+	// Subscription is asynchronous, so keep changing until notified.
+	deadline := time.After(5 * time.Second)
+	for version := int64(0); ; version++ {
+		if _, err := queueConfig.UpdateSettings(context.Background(), version, &QueueSettingsUpdate{IsQueueEnabled: boolPtr(version%2 == 0), OnlineUsersThreshold: uintPtr(100)}, "alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-queueConfig.changed:
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("not notified of settings change")
+		}
+	}
+}
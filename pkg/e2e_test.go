@@ -0,0 +1,1501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/client"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/mainserver"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Online users threshold of the suite. Queue is on since fake main
+// server reports more than half of it, with 10 free slots.
+const (
+	testOnlineUsersThreshold = 100
+	testOnlineUsers          = 90
+)
+
+// Time allowed for an expected event, longer than a few dequeue
+// intervals.
+const eventWait = 10 * time.Second
+
+var (
+	fakeMainServer *mainserver.Fake
+	testRedis      *miniredis.Miniredis
+	serverUrl      string
+
+	// Admin api, read by tests for metrics.
+	adminUrl string
+
+	// Every span of the suite, ended ones only.
+	testSpans *tracetest.InMemoryExporter
+)
+
+// Run the whole server once for the suite, since metrics and config
+// are process wide. Tests run one by one and use their own client ids.
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	var err error
+	testRedis, err = miniredis.Run()
+	if err != nil {
+		log.Fatalf("cannot start redis %v", err)
+	}
+
+	fakeMainServer = mainserver.NewFake()
+	fakeMainServer.SetOnlineUsers(testOnlineUsers)
+
+	testRedis.HSet("config",
+		"isQueueEnabled", "1",
+		"onlineUsersThreshold", strconv.Itoa(testOnlineUsersThreshold),
+		"startQueueThreshold", "0.5",
+	)
+
+	port, err := freePort()
+	if err != nil {
+		log.Fatalf("cannot find free port %v", err)
+	}
+	serverUrl = fmt.Sprintf("127.0.0.1:%v", port)
+
+	adminPort, err := freePort()
+	if err != nil {
+		log.Fatalf("cannot find free port %v", err)
+	}
+	adminUrl = fmt.Sprintf("127.0.0.1:%v", adminPort)
+
+	principalsFile, err := writeTestPrincipals()
+	if err != nil {
+		log.Fatalf("cannot write admin principals %v", err)
+	}
+	defer os.Remove(principalsFile)
+
+	for name, value := range map[string]string{
+		"server-port":                   strconv.Itoa(port),
+		"plain-http":                    "true",
+		"admin-addr":                    adminUrl,
+		"admin-principals-file":         principalsFile,
+		"redis-host":                    testRedis.Addr(),
+		"main-server-host":              fakeMainServer.URL,
+		"dequeue-interval-seconds":      "1",
+		"notify-stats-interval-seconds": "1",
+		"min-queue-on-seconds":          "0",
+		"min-queue-off-seconds":         "0",
+		"login-retry-count":             "0",
+		"requeue-backoff-seconds":       "1",
+		// Lets tests take their own client ip by X-Forwarded-For.
+		"trusted-proxy-cidrs": "127.0.0.1/32",
+		"store-urls":          "test=https://example.com/app",
+		// Only used by clients offering permessage-deflate.
+		"ws-compression": "true",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			log.Fatalf("cannot set flag[%v] %v", name, err)
+		}
+	}
+
+	var tracerFactory *infra.TracerFactory
+	tracerFactory, testSpans = infra.NewInMemoryTracerFactory()
+
+	server, err := SetupWithTracer(tracerFactory)
+	if err != nil {
+		log.Fatalf("setup failed %v", err)
+	}
+	go server.Run()
+
+	if err := waitQueueing(true); err != nil {
+		log.Fatalf("queue not started %v", err)
+	}
+
+	code := m.Run()
+	fakeMainServer.Close()
+	testRedis.Close()
+	os.Exit(code)
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Admin api key of the viewer that reads metrics.
+const testAdminKey = "test-viewer-key"
+
+func writeTestPrincipals() (string, error) {
+	file, err := os.CreateTemp("", "principals-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, `[{"name": "e2e", "role": "viewer", "key": %q}]`, testAdminKey)
+	return file.Name(), err
+}
+
+// Wait until queue switches to isQueueing, read from metrics.
+func waitQueueing(isQueueing bool) error {
+	want := 0
+	if isQueueing {
+		want = 1
+	}
+
+	deadline := time.Now().Add(eventWait)
+	for time.Now().Before(deadline) {
+		vars := &struct {
+			IsQueueing *int `json:"isQueueing"`
+		}{}
+
+		req, _ := http.NewRequest(http.MethodGet, "http://"+adminUrl+"/metrics", nil)
+		req.Header.Set("X-Api-Key", testAdminKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(vars)
+			resp.Body.Close()
+		}
+		if err == nil && vars.IsQueueing != nil && *vars.IsQueueing == want {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("isQueueing is not %v after %v", isQueueing, eventWait)
+}
+
+// Change online users of main server and let queue config refresh
+// right away instead of waiting for the next interval.
+func setOnlineUsers(onlineUsers uint) {
+	fakeMainServer.SetOnlineUsers(onlineUsers)
+	testRedis.Publish("config:changed", "0")
+}
+
+type testClient struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	codec msg.Codec
+}
+
+// Header of a client of the latest protocol.
+func testHeader(id string, jwt string) http.Header {
+	header := http.Header{}
+	header.Set("id", id)
+	header.Set("platform", "test")
+	header.Set("jwt", jwt)
+	header.Set("protocolVersion", fmt.Sprint(msg.LatestProtocolVersion))
+	return header
+}
+
+// Header of a client before protocol versioning.
+func testHeaderV1(id string) http.Header {
+	header := testHeader(id, "")
+	header.Del("protocolVersion")
+	return header
+}
+
+func dial(t *testing.T, id string, jwt string) *testClient {
+	t.Helper()
+
+	return dialHeader(t, testHeader(id, jwt))
+}
+
+func dialHeader(t *testing.T, header http.Header) *testClient {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+serverUrl+"/ws", header)
+	if err != nil {
+		t.Fatalf("cannot connect %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, codec: msg.JsonCodec}
+}
+
+// Dial asking for codec as subprotocol.
+func dialCodec(t *testing.T, id string, codec msg.Codec) *testClient {
+	t.Helper()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{codec.Name()}}
+	conn, _, err := dialer.Dial("ws://"+serverUrl+"/ws", testHeader(id, ""))
+	if err != nil {
+		t.Fatalf("cannot connect %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if conn.Subprotocol() != codec.Name() {
+		t.Fatalf("subprotocol[%v], want [%v]", conn.Subprotocol(), codec.Name())
+	}
+	return &testClient{t: t, conn: conn, codec: codec}
+}
+
+// Dial with precheck header. Client is nil if server replies without
+// upgrading, with status code and body of the reply.
+func dialPrecheck(t *testing.T, header http.Header) (*testClient, int, []byte) {
+	t.Helper()
+
+	header.Set("precheck", "true")
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+serverUrl+"/ws", header)
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("cannot read body %v", err)
+		}
+		return nil, resp.StatusCode, body
+	} else if err != nil {
+		t.Fatalf("cannot connect %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, codec: msg.JsonCodec}, resp.StatusCode, nil
+}
+
+// Ask /should-queue without opening ws.
+func getShouldQueue(t *testing.T, id string, jwt string) bool {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+serverUrl+"/should-queue", nil)
+	if err != nil {
+		t.Fatalf("cannot create request %v", err)
+	}
+	request.Header = testHeader(id, jwt)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("cannot request should queue %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code[%v], want [%v]", resp.StatusCode, http.StatusOK)
+	}
+	event := &msg.ShouldQueueEvent{}
+	if err := json.NewDecoder(resp.Body).Decode(event); err != nil {
+		t.Fatalf("cannot decode body %v", err)
+	}
+	return event.ShouldQueue
+}
+
+func (c *testClient) send(eventCode msg.EventCode, event any) {
+	c.t.Helper()
+
+	rawEvent, err := json.Marshal(event)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	data, err := c.codec.Marshal(&msg.WsMessage{EventCode: eventCode, EventData: rawEvent})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	messageType := websocket.TextMessage
+	if c.codec.IsBinary() {
+		messageType = websocket.BinaryMessage
+	}
+	if err := c.conn.WriteMessage(messageType, data); err != nil {
+		c.t.Fatalf("cannot send event[%v] %v", eventCode, err)
+	}
+}
+
+// Read the next message as is.
+func (c *testClient) read() []byte {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(eventWait))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("no message received %v", err)
+	}
+	return data
+}
+
+// Read messages until one of eventCode arrives, and unmarshal it into
+// event. Other events are skipped.
+func (c *testClient) expect(eventCode msg.EventCode, event any) {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(eventWait))
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("no event[%v] received %v", eventCode, err)
+		}
+
+		wsMessage := &msg.WsMessage{}
+		if err := c.codec.Unmarshal(data, wsMessage); err != nil {
+			c.t.Fatalf("cannot unmarshal message %v", err)
+		}
+
+		if wsMessage.EventCode != eventCode {
+			continue
+		}
+
+		if err := json.Unmarshal(wsMessage.EventData, event); err != nil {
+			c.t.Fatalf("cannot unmarshal event[%v] %v", eventCode, err)
+		}
+		return
+	}
+}
+
+func (c *testClient) expectShouldQueue(want bool) {
+	c.t.Helper()
+
+	event := &msg.ShouldQueueEvent{}
+	c.expect(msg.ShouldQueueCode, event)
+	if event.ShouldQueue != want {
+		c.t.Fatalf("shouldQueue[%v], want [%v]", event.ShouldQueue, want)
+	}
+}
+
+// Read until server closes connection with closeCode. Client replies
+// close message like gorilla websocket does by default.
+func (c *testClient) expectClose(closeCode int) {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(eventWait))
+	for {
+		_, _, err := c.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+
+		if !websocket.IsCloseError(err, closeCode) {
+			c.t.Fatalf("connection closed with %v, want close code[%v]", err, closeCode)
+		}
+		return
+	}
+}
+
+func (c *testClient) login(token string) {
+	c.t.Helper()
+
+	c.send(msg.LoginCode, &msg.LoginClientEvent{
+		Type:      msg.DeviceLogin,
+		Token:     token,
+		DeviceId:  "device-" + token,
+		SessionId: "session-" + token,
+	})
+}
+
+type sseEvent struct {
+	id   uint64
+	name string
+	data []byte
+}
+
+type sseClient struct {
+	t *testing.T
+
+	// Parsed from session event.
+	ticketId string
+	token    string
+
+	// Id of the last event received.
+	lastId uint64
+
+	events chan *sseEvent
+
+	// Cancel the stream request.
+	cancel func()
+}
+
+// Open sse stream, resuming if header has ticketId. Session event is
+// read right away.
+func dialSse(t *testing.T, header http.Header) *sseClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+serverUrl+"/sse", nil)
+	if err != nil {
+		t.Fatalf("cannot create request %v", err)
+	}
+	request.Header = header
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("cannot open stream %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code[%v], want [%v]", resp.StatusCode, http.StatusOK)
+	}
+
+	c := &sseClient{t: t, events: make(chan *sseEvent, 64), cancel: cancel}
+	t.Cleanup(cancel)
+
+	// Ends once stream ends or is canceled.
+	go func() {
+		defer resp.Body.Close()
+		defer close(c.events)
+
+		reader := bufio.NewReader(resp.Body)
+		event := &sseEvent{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				if event.data != nil {
+					c.events <- event
+				}
+				event = &sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = []byte(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *sseClient) next() *sseEvent {
+	c.t.Helper()
+
+	select {
+	case event, ok := <-c.events:
+		if !ok {
+			c.t.Fatalf("stream ended")
+		}
+		if event.id != 0 {
+			c.lastId = event.id
+		}
+		return event
+	case <-time.After(eventWait):
+		c.t.Fatalf("no event received")
+		return nil
+	}
+}
+
+func (c *sseClient) expectSession() {
+	c.t.Helper()
+
+	event := c.next()
+	session := &struct {
+		TicketId string `json:"ticketId"`
+		Token    string `json:"token"`
+	}{}
+	if event.name != "session" || json.Unmarshal(event.data, session) != nil || session.Token == "" {
+		c.t.Fatalf("event[%v] data[%s], want session", event.name, event.data)
+	}
+	c.ticketId, c.token = session.TicketId, session.Token
+}
+
+// Read events until one of eventCode arrives, and unmarshal it into
+// event. Other events are skipped.
+func (c *sseClient) expect(eventCode msg.EventCode, event any) {
+	c.t.Helper()
+
+	for {
+		sseEvent := c.next()
+		if sseEvent.name != "" {
+			c.t.Fatalf("event[%v] data[%s], want event[%v]", sseEvent.name, sseEvent.data, eventCode)
+		}
+
+		wsMessage := &msg.WsMessage{}
+		if err := json.Unmarshal(sseEvent.data, wsMessage); err != nil {
+			c.t.Fatalf("cannot unmarshal message[%s] %v", sseEvent.data, err)
+		}
+		if wsMessage.EventCode != eventCode {
+			continue
+		}
+
+		if err := json.Unmarshal(wsMessage.EventData, event); err != nil {
+			c.t.Fatalf("cannot unmarshal event[%v] %v", eventCode, err)
+		}
+		return
+	}
+}
+
+// Read events until close event with closeCode.
+func (c *sseClient) expectClose(closeCode int) {
+	c.t.Helper()
+
+	for {
+		event := c.next()
+		if event.name != "close" {
+			continue
+		}
+
+		closeEvent := &struct {
+			Code int `json:"code"`
+		}{}
+		if err := json.Unmarshal(event.data, closeEvent); err != nil || closeEvent.Code != closeCode {
+			c.t.Fatalf("close event[%s], want close code[%v]", event.data, closeCode)
+		}
+		return
+	}
+}
+
+func (c *sseClient) post(eventCode msg.EventCode, event any) {
+	c.t.Helper()
+
+	rawEvent, err := json.Marshal(event)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(&msg.WsMessage{EventCode: eventCode, EventData: rawEvent})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+serverUrl+"/sse/messages", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("cannot create request %v", err)
+	}
+	request.Header.Set("ticketId", c.ticketId)
+	request.Header.Set("sessionToken", c.token)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		c.t.Fatalf("cannot post event[%v] %v", eventCode, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		c.t.Fatalf("status code[%v], want [%v]", resp.StatusCode, http.StatusAccepted)
+	}
+}
+
+// Resume the session with a new stream, events after the last one
+// received are replayed.
+func (c *sseClient) resume() *sseClient {
+	c.t.Helper()
+
+	header := http.Header{}
+	header.Set("ticketId", c.ticketId)
+	header.Set("sessionToken", c.token)
+	header.Set("Last-Event-ID", strconv.FormatUint(c.lastId, 10))
+
+	resumed := dialSse(c.t, header)
+	resumed.expectSession()
+	resumed.lastId = c.lastId
+	return resumed
+}
+
+// Get /healthz or /readyz.
+func getHealth(t *testing.T, path string) (int, *healthResponse) {
+	t.Helper()
+
+	resp, err := http.Get("http://" + serverUrl + path)
+	if err != nil {
+		t.Fatalf("cannot request %v %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	health := &healthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		t.Fatalf("cannot decode %v response %v", path, err)
+	}
+	return resp.StatusCode, health
+}
+
+func TestHealth(t *testing.T) {
+	if statusCode, health := getHealth(t, "/healthz"); statusCode != http.StatusOK || !health.Ok || !health.Checks["queueWorker"].Ok {
+		t.Fatalf("healthz status code[%v] %+v, want ok", statusCode, health)
+	}
+
+	statusCode, health := getHealth(t, "/readyz")
+	if statusCode != http.StatusOK || !health.Ok {
+		t.Fatalf("readyz status code[%v] %+v, want ok", statusCode, health)
+	}
+	for _, name := range []string{"redis", "queueConfig", "mainServer"} {
+		if result, ok := health.Checks[name]; !ok || !result.Ok {
+			t.Fatalf("readyz check[%v] %+v, want ok", name, result)
+		}
+	}
+
+	testRedis.SetError("LOADING redis is loading the dataset in memory")
+	statusCode, health = getHealth(t, "/readyz")
+	testRedis.SetError("")
+	if statusCode != http.StatusServiceUnavailable || health.Ok || health.Checks["redis"].Ok {
+		t.Fatalf("readyz status code[%v] with redis %+v, want not ready", statusCode, health.Checks["redis"])
+	}
+
+	if statusCode, health := getHealth(t, "/readyz"); statusCode != http.StatusOK || !health.Checks["redis"].Ok {
+		t.Fatalf("readyz status code[%v] with redis %+v after redis is back, want ok", statusCode, health.Checks["redis"])
+	}
+}
+
+func TestSessionNeedQueue(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		setup       func(jwt string)
+		shouldQueue bool
+	}{
+		{
+			name:        "new user",
+			setup:       func(jwt string) {},
+			shouldQueue: true,
+		},
+		{
+			name:        "in room",
+			setup:       func(jwt string) { fakeMainServer.SetRoomSession(jwt, "room-1") },
+			shouldQueue: false,
+		},
+		{
+			name:        "fresh user session",
+			setup:       func(jwt string) { fakeMainServer.SetUserSession(jwt, time.Now()) },
+			shouldQueue: false,
+		},
+		{
+			name:        "stale user session",
+			setup:       func(jwt string) { fakeMainServer.SetUserSession(jwt, time.Now().Add(-time.Hour)) },
+			shouldQueue: true,
+		},
+		{
+			name: "maintenance",
+			setup: func(jwt string) {
+				fakeMainServer.Script(mainserver.RoomSessionPath, &mainserver.Response{StatusCode: http.StatusServiceUnavailable})
+			},
+			shouldQueue: false,
+		},
+	} {
+		t.Run(tc.name+"/ws", func(t *testing.T) {
+			id := "session-" + t.Name()
+			jwt := "jwt-" + t.Name()
+			tc.setup(jwt)
+
+			client := dial(t, id, jwt)
+			client.expectShouldQueue(tc.shouldQueue)
+			if !tc.shouldQueue {
+				client.expectClose(websocket.CloseNormalClosure)
+			}
+		})
+
+		t.Run(tc.name+"/precheck", func(t *testing.T) {
+			id := "session-" + t.Name()
+			jwt := "jwt-" + t.Name()
+			tc.setup(jwt)
+
+			client, statusCode, body := dialPrecheck(t, testHeader(id, jwt))
+			if tc.shouldQueue {
+				if client == nil {
+					t.Fatalf("not upgraded, status code[%v] body[%s]", statusCode, body)
+				}
+				client.expectShouldQueue(true)
+				return
+			}
+
+			if client != nil || statusCode != http.StatusOK {
+				t.Fatalf("status code[%v], want [%v] without upgrade", statusCode, http.StatusOK)
+			}
+			event := &msg.ShouldQueueEvent{}
+			if err := json.Unmarshal(body, event); err != nil {
+				t.Fatalf("cannot unmarshal body[%s] %v", body, err)
+			}
+			if event.ShouldQueue {
+				t.Fatalf("shouldQueue[true], want [false]")
+			}
+		})
+
+		t.Run(tc.name+"/sse", func(t *testing.T) {
+			id := "session-" + t.Name()
+			jwt := "jwt-" + t.Name()
+			tc.setup(jwt)
+
+			client := dialSse(t, testHeader(id, jwt))
+			if tc.shouldQueue {
+				client.expectSession()
+			}
+
+			event := &msg.ShouldQueueEvent{}
+			client.expect(msg.ShouldQueueCode, event)
+			if event.ShouldQueue != tc.shouldQueue {
+				t.Fatalf("shouldQueue[%v], want [%v]", event.ShouldQueue, tc.shouldQueue)
+			}
+			if !tc.shouldQueue {
+				client.expectClose(websocket.CloseNormalClosure)
+			}
+		})
+
+		t.Run(tc.name+"/endpoint", func(t *testing.T) {
+			id := "session-" + t.Name()
+			jwt := "jwt-" + t.Name()
+			tc.setup(jwt)
+
+			if shouldQueue := getShouldQueue(t, id, jwt); shouldQueue != tc.shouldQueue {
+				t.Fatalf("shouldQueue[%v], want [%v]", shouldQueue, tc.shouldQueue)
+			}
+		})
+	}
+}
+
+func TestPrecheckRejected(t *testing.T) {
+	t.Run("missing header", func(t *testing.T) {
+		header := testHeader("precheck-"+t.Name(), "jwt-"+t.Name())
+		header.Del("platform")
+
+		client, statusCode, _ := dialPrecheck(t, header)
+		if client != nil || statusCode != http.StatusBadRequest {
+			t.Fatalf("status code[%v], want [%v] without upgrade", statusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("too many connections", func(t *testing.T) {
+		setFlag(t, "max-connections-per-ip", "1")
+
+		// Other tests' connections may not have closed yet.
+		header := testHeader("precheck-"+t.Name()+"-1", "jwt-"+t.Name()+"-1")
+		header.Set(echo.HeaderXForwardedFor, "192.0.2.1")
+		client := dialHeader(t, header)
+		client.expectShouldQueue(true)
+
+		header = testHeader("precheck-"+t.Name()+"-2", "jwt-"+t.Name()+"-2")
+		header.Set(echo.HeaderXForwardedFor, "192.0.2.1")
+		other, statusCode, _ := dialPrecheck(t, header)
+		if other != nil || statusCode != http.StatusConflict {
+			t.Fatalf("status code[%v], want [%v] without upgrade", statusCode, http.StatusConflict)
+		}
+	})
+}
+
+// Set flag for the test, restored once test ends.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+func TestProtocolVersion(t *testing.T) {
+	t.Run("forced update", func(t *testing.T) {
+		setFlag(t, "min-protocol-version", "2")
+
+		// UpdateRequired is sent although version 1 doesn't have it.
+		v1 := dialHeader(t, testHeaderV1("protocol-v1"))
+		v1.expect(msg.UpdateRequiredCode, &msg.UpdateRequiredServerEvent{})
+		v1.expectClose(4426)
+
+		client, statusCode, body := dialPrecheck(t, testHeaderV1("protocol-v1-precheck"))
+		if client != nil || statusCode != http.StatusUpgradeRequired {
+			t.Fatalf("status code[%v], want [%v] without upgrade", statusCode, http.StatusUpgradeRequired)
+		}
+		event := &msg.UpdateRequiredServerEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Fatalf("cannot unmarshal body[%s] %v", body, err)
+		}
+		want := msg.UpdateRequiredServerEvent{IsForced: true, MinVersion: 2, LatestVersion: msg.LatestProtocolVersion, StoreUrl: "https://example.com/app"}
+		if *event != want {
+			t.Fatalf("event[%+v], want [%+v]", event, want)
+		}
+
+		request, err := http.NewRequest(http.MethodGet, "http://"+serverUrl+"/should-queue", nil)
+		if err != nil {
+			t.Fatalf("cannot create request %v", err)
+		}
+		request.Header = testHeaderV1("protocol-v1-should-queue")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("cannot request should queue %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUpgradeRequired {
+			t.Fatalf("status code[%v], want [%v]", resp.StatusCode, http.StatusUpgradeRequired)
+		}
+
+		header := testHeader("protocol-v2", "")
+		header.Set("protocolVersion", "2")
+		dialHeader(t, header).expectShouldQueue(true)
+	})
+
+	t.Run("suggested update to v1", func(t *testing.T) {
+		setFlag(t, "warn-protocol-version", "2")
+
+		client := dialHeader(t, testHeaderV1("protocol-warned-v1"))
+		client.expectShouldQueue(true)
+
+		event := &msg.UpdateRequiredServerEvent{}
+		client.expect(msg.UpdateRequiredCode, event)
+		if event.IsForced || event.MinVersion != 1 || event.StoreUrl != "https://example.com/app" {
+			t.Fatalf("event[%+v], want suggestion with store url", event)
+		}
+	})
+
+	t.Run("v1 rejected login", func(t *testing.T) {
+		for _, tc := range []struct {
+			name      string
+			setup     func(t *testing.T)
+			loginData *msg.LoginClientEvent
+		}{
+			{
+				name:      "invalid login type",
+				loginData: &msg.LoginClientEvent{Type: 99, Token: "token", DeviceId: "device-v1-type"},
+			},
+			{
+				name:      "credential format",
+				loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, DeviceId: "device-v1-format"},
+			},
+			{
+				name: "credential validation",
+				setup: func(t *testing.T) {
+					setFlag(t, "credential-validate-path", "/validate")
+					fakeMainServer.Script(mainserver.AuthorizationPath, &mainserver.Response{StatusCode: http.StatusUnauthorized})
+				},
+				loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "token-v1-validation", DeviceId: "device-v1-validation"},
+			},
+			{
+				name: "too many tickets",
+				setup: func(t *testing.T) {
+					setFlag(t, "max-tickets-per-device", "1")
+					setFlag(t, "credential-validate-path", "/validate")
+
+					// Another client holds the ticket of the device
+					// while its credential is validated, then it's
+					// rejected without entering queue.
+					fakeMainServer.Script(mainserver.AuthorizationPath, &mainserver.Response{StatusCode: http.StatusUnauthorized, Latency: time.Second})
+					before := len(fakeMainServer.Requests(mainserver.AuthorizationPath))
+
+					holder := dial(t, "protocol-v1-tickets-holder", "")
+					holder.expectShouldQueue(true)
+					holder.send(msg.LoginCode, &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "token-holder", DeviceId: "device-v1-tickets"})
+					for len(fakeMainServer.Requests(mainserver.AuthorizationPath)) == before {
+						time.Sleep(10 * time.Millisecond)
+					}
+				},
+				loginData: &msg.LoginClientEvent{Type: msg.DeviceLogin, Token: "token-v1-tickets", DeviceId: "device-v1-tickets"},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				if tc.setup != nil {
+					tc.setup(t)
+				}
+
+				// Version 1 can't receive Error event, so it's closed
+				// instead of left waiting for a ticket.
+				v1 := dialHeader(t, testHeaderV1("protocol-v1-"+tc.loginData.DeviceId))
+				v1.expectShouldQueue(true)
+				v1.send(msg.LoginCode, tc.loginData)
+
+				v1.conn.SetReadDeadline(time.Now().Add(eventWait))
+				for {
+					_, data, err := v1.conn.ReadMessage()
+					if err != nil {
+						if !websocket.IsCloseError(err, client.CloseLoginRejected) {
+							t.Fatalf("connection closed with %v, want close code[%v]", err, client.CloseLoginRejected)
+						}
+						break
+					}
+
+					wsMessage := &msg.WsMessage{}
+					if err := json.Unmarshal(data, wsMessage); err != nil {
+						t.Fatalf("cannot unmarshal message %v", err)
+					}
+					if wsMessage.EventCode > msg.TicketCode {
+						t.Fatalf("event[%v] sent to version 1", wsMessage.EventCode)
+					}
+				}
+			})
+		}
+
+		// Later versions get Error event and stay connected.
+		v2 := dial(t, "protocol-rejected-v2", "")
+		v2.expectShouldQueue(true)
+		v2.login("")
+		v2.expect(msg.ErrorCode, &msg.ErrorServerEvent{})
+	})
+
+	t.Run("suggested update", func(t *testing.T) {
+		setFlag(t, "warn-protocol-version", "3")
+
+		header := testHeader("protocol-warned", "")
+		header.Set("protocolVersion", "2")
+		client := dialHeader(t, header)
+		client.expectShouldQueue(true)
+
+		event := &msg.UpdateRequiredServerEvent{}
+		client.expect(msg.UpdateRequiredCode, event)
+		if event.IsForced || event.StoreUrl != "https://example.com/app" {
+			t.Fatalf("event[%+v], want suggestion with store url", event)
+		}
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		header := testHeader("protocol-invalid", "")
+		header.Set("protocolVersion", "latest")
+		dialHeader(t, header).expectClose(websocket.CloseUnsupportedData)
+	})
+
+	t.Run("capabilities", func(t *testing.T) {
+		header := testHeader("protocol-stats", "")
+		header.Set("protocolVersion", "2")
+		header.Set("capabilities", "queueStats")
+		withStats := dialHeader(t, header)
+
+		header = testHeader("protocol-no-stats", "")
+		header.Set("protocolVersion", "2")
+		header.Set("capabilities", "credentialRefresh")
+		withoutStats := dialHeader(t, header)
+		withoutStats.expectShouldQueue(true)
+
+		// Stats are broadcast to both every second.
+		withStats.expect(msg.QueueStatsCode, &msg.QueueStatsServerEvent{})
+		withStats.expect(msg.QueueStatsCode, &msg.QueueStatsServerEvent{})
+
+		withoutStats.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		for {
+			_, data, err := withoutStats.conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			wsMessage := &msg.WsMessage{}
+			if err := json.Unmarshal(data, wsMessage); err != nil {
+				t.Fatalf("cannot unmarshal message %v", err)
+			}
+			if wsMessage.EventCode == msg.QueueStatsCode {
+				t.Fatalf("QueueStats sent without capability")
+			}
+		}
+	})
+}
+
+// Wait until span of the trace ends.
+func expectSpan(t *testing.T, traceId string, name string) tracetest.SpanStub {
+	t.Helper()
+
+	deadline := time.Now().Add(eventWait)
+	for time.Now().Before(deadline) {
+		for _, span := range testSpans.GetSpans() {
+			if span.SpanContext.TraceID().String() == traceId && span.Name == name {
+				return span
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("span[%v] of trace[%v] not ended", name, traceId)
+	return tracetest.SpanStub{}
+}
+
+func TestLogin(t *testing.T) {
+	before := len(fakeMainServer.Requests(mainserver.AuthorizationPath))
+
+	// Trace started by client.
+	const (
+		traceId      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanId = "00f067aa0ba902b7"
+	)
+	header := testHeader("login", "")
+	header.Set("traceparent", "00-"+traceId+"-"+parentSpanId+"-01")
+
+	client := dialHeader(t, header)
+	client.expectShouldQueue(true)
+	client.login("login-token")
+
+	ticket := &msg.TicketServerEvent{}
+	client.expect(msg.TicketCode, ticket)
+	if ticket.TicketId != "login" {
+		t.Fatalf("ticketId[%v], want [login]", ticket.TicketId)
+	}
+
+	event := &msg.LoginServerEvent{}
+	client.expect(msg.LoginCode, event)
+	if event.StatusCode != http.StatusOK || event.Jwt == "" {
+		t.Fatalf("login event[%+v], want jwt", event)
+	}
+	client.expectClose(websocket.CloseNormalClosure)
+
+	requests := fakeMainServer.Requests(mainserver.AuthorizationPath)[before:]
+	if len(requests) != 1 {
+		t.Fatalf("%v authorization requests, want 1", len(requests))
+	}
+
+	request := requests[0]
+	if request.Path != mainserver.AuthorizationPath+"/device" {
+		t.Errorf("path[%v], want device authorization", request.Path)
+	}
+	if string(request.Body) != `{"uniqueId":"login-token"}` {
+		t.Errorf("body[%s] doesn't carry token", request.Body)
+	}
+	if request.Header.Get("platform") != "test" || request.Header.Get("deviceid") != "device-login-token" || request.Header.Get("sessionid") != "session-login-token" {
+		t.Errorf("header[%v] doesn't carry client info", request.Header)
+	}
+
+	// Main server continues the trace from the login span.
+	loginSpan := expectSpan(t, traceId, "login")
+	if traceparent := request.Header.Get("traceparent"); !strings.HasPrefix(traceparent, "00-"+traceId+"-") {
+		t.Errorf("traceparent[%v] of authorization request, want trace[%v]", traceparent, traceId)
+	}
+
+	sessionSpan := expectSpan(t, traceId, "ws session")
+	if sessionSpan.Parent.SpanID().String() != parentSpanId {
+		t.Errorf("session span parent[%v], want [%v] of client", sessionSpan.Parent.SpanID(), parentSpanId)
+	}
+	if loginSpan.Parent.SpanID() != sessionSpan.SpanContext.SpanID() {
+		t.Errorf("login span parent[%v], want session span[%v]", loginSpan.Parent.SpanID(), sessionSpan.SpanContext.SpanID())
+	}
+
+	var events []string
+	for _, event := range sessionSpan.Events {
+		events = append(events, event.Name)
+	}
+	for _, want := range []string{"register", "enter queue", "dequeue", "login finished", "close"} {
+		found := false
+		for _, event := range events {
+			found = found || event == want
+		}
+		if !found {
+			t.Errorf("session span events %v, want [%v]", events, want)
+		}
+	}
+}
+
+func TestSseLogin(t *testing.T) {
+	client := dialSse(t, testHeader("sse-login", ""))
+	client.expectSession()
+	client.expect(msg.ShouldQueueCode, &msg.ShouldQueueEvent{})
+
+	client.post(msg.LoginCode, &msg.LoginClientEvent{
+		Type:      msg.DeviceLogin,
+		Token:     "sse-login-token",
+		DeviceId:  "device-sse-login-token",
+		SessionId: "session-sse-login-token",
+	})
+
+	ticket := &msg.TicketServerEvent{}
+	client.expect(msg.TicketCode, ticket)
+	if ticket.TicketId != "sse-login" {
+		t.Fatalf("ticketId[%v], want [sse-login]", ticket.TicketId)
+	}
+
+	event := &msg.LoginServerEvent{}
+	client.expect(msg.LoginCode, event)
+	if event.StatusCode != http.StatusOK || event.Jwt == "" {
+		t.Fatalf("login event[%+v], want jwt", event)
+	}
+	client.expectClose(websocket.CloseNormalClosure)
+}
+
+func TestSseResume(t *testing.T) {
+	client := dialSse(t, testHeader("sse-resume", ""))
+	client.expectSession()
+	client.expect(msg.ShouldQueueCode, &msg.ShouldQueueEvent{})
+
+	// Events sent while stream is broken are replayed on resume.
+	client.cancel()
+	client.post(msg.LoginCode, &msg.LoginClientEvent{
+		Type:      msg.DeviceLogin,
+		Token:     "sse-resume-token",
+		DeviceId:  "device-sse-resume-token",
+		SessionId: "session-sse-resume-token",
+	})
+
+	resumed := client.resume()
+	ticket := &msg.TicketServerEvent{}
+	resumed.expect(msg.TicketCode, ticket)
+	if ticket.TicketId != "sse-resume" {
+		t.Fatalf("ticketId[%v], want [sse-resume]", ticket.TicketId)
+	}
+
+	resumed.expect(msg.LoginCode, &msg.LoginServerEvent{})
+	resumed.expectClose(websocket.CloseNormalClosure)
+
+	// Session is gone once closed.
+	header := http.Header{}
+	header.Set("ticketId", client.ticketId)
+	header.Set("sessionToken", client.token)
+	request, err := http.NewRequest(http.MethodGet, "http://"+serverUrl+"/sse", nil)
+	if err != nil {
+		t.Fatalf("cannot create request %v", err)
+	}
+	request.Header = header
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("cannot resume %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status code[%v], want [%v]", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, tc := range []struct {
+		codec msg.Codec
+
+		// Encoding of ShouldQueue true.
+		shouldQueue []byte
+	}{
+		{
+			codec:       msg.JsonCodec,
+			shouldQueue: []byte(`{"eventCode":1000,"eventData":{"shouldQueue":true}}`),
+		},
+		{
+			codec: msg.MsgpackCodec,
+			shouldQueue: append(append(append(append(
+				[]byte{0x82, 0xa9}, "eventCode"...),
+				0xcd, 0x03, 0xe8, 0xa9), "eventData"...),
+				append([]byte{0x81, 0xab}, append([]byte("shouldQueue"), 0xc3)...)...),
+		},
+		{
+			codec: msg.ProtobufCodec,
+			shouldQueue: append(append(
+				[]byte{0x08, 0xe8, 0x07, 0x12, 0x13, 0x0a, 0x11, 0x0a, 0x0b}, "shouldQueue"...),
+				0x12, 0x02, 0x20, 0x01),
+		},
+	} {
+		t.Run(tc.codec.Name(), func(t *testing.T) {
+			id := "codec-" + tc.codec.Name()
+			client := dialCodec(t, id, tc.codec)
+			if data := client.read(); !bytes.Equal(data, tc.shouldQueue) {
+				t.Fatalf("ShouldQueue event[%x], want [%x]", data, tc.shouldQueue)
+			}
+			client.login(id + "-token")
+
+			ticket := &msg.TicketServerEvent{}
+			client.expect(msg.TicketCode, ticket)
+			if ticket.TicketId != id {
+				t.Fatalf("ticketId[%v], want [%v]", ticket.TicketId, id)
+			}
+
+			event := &msg.LoginServerEvent{}
+			client.expect(msg.LoginCode, event)
+			if event.StatusCode != http.StatusOK || event.Jwt == "" {
+				t.Fatalf("login event[%+v], want jwt", event)
+			}
+			client.expectClose(websocket.CloseNormalClosure)
+		})
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response *mainserver.Response
+		reason   msg.ErrorReasonCode
+
+		// Whether ticket is requeued and logged in again.
+		isRetried bool
+
+		// Times ticket can be requeued, default if empty.
+		maxAttempts string
+	}{
+		{
+			name:      "main server error",
+			response:  &mainserver.Response{StatusCode: http.StatusInternalServerError},
+			reason:    msg.LoginFailedReason,
+			isRetried: true,
+		},
+		{
+			name:      "network failure",
+			response:  &mainserver.Response{Drop: true, Latency: 500 * time.Millisecond},
+			reason:    msg.LoginFailedReason,
+			isRetried: true,
+		},
+		{
+			name:      "maintenance",
+			response:  &mainserver.Response{StatusCode: http.StatusServiceUnavailable},
+			reason:    msg.MaintenanceReason,
+			isRetried: true,
+		},
+		{
+			name:      "rejected",
+			response:  &mainserver.Response{StatusCode: http.StatusUnauthorized},
+			reason:    msg.LoginRejectedReason,
+			isRetried: false,
+		},
+		{
+			name:        "requeue exhausted",
+			response:    &mainserver.Response{StatusCode: http.StatusInternalServerError},
+			reason:      msg.LoginRejectedReason,
+			isRetried:   false,
+			maxAttempts: "0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.maxAttempts != "" {
+				setFlag(t, "requeue-max-attempts", tc.maxAttempts)
+			}
+			fakeMainServer.Script(mainserver.AuthorizationPath, tc.response)
+
+			client := dial(t, "failure-"+t.Name(), "")
+			client.expectShouldQueue(true)
+			client.login("failure-token")
+
+			errorEvent := &msg.ErrorServerEvent{}
+			client.expect(msg.ErrorCode, errorEvent)
+			if errorEvent.Reason != tc.reason {
+				t.Fatalf("error reason[%v], want [%v]", errorEvent.Reason, tc.reason)
+			}
+
+			event := &msg.LoginServerEvent{}
+			client.expect(msg.LoginCode, event)
+			if isLoggedIn := event.Jwt != ""; isLoggedIn != tc.isRetried {
+				t.Fatalf("login event[%+v] after failure, want logged in [%v]", event, tc.isRetried)
+			}
+
+			// Client is released whether it's logged in or rejected.
+			client.expectClose(websocket.CloseNormalClosure)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// Only the first message is allowed.
+	setFlag(t, "message-burst", "1")
+	setFlag(t, "message-rate-per-second", "0.001")
+	setFlag(t, "message-rate-warn-violations", "2")
+	setFlag(t, "message-rate-disconnect-violations", "4")
+
+	client := dial(t, "rate-"+t.Name(), "")
+	client.expectShouldQueue(true)
+
+	// Solution without pending challenge is ignored by hub.
+	for i := 0; i < 5; i++ {
+		client.send(msg.ChallengeCode, &msg.ChallengeClientEvent{})
+	}
+
+	event := &msg.ErrorServerEvent{}
+	client.expect(msg.ErrorCode, event)
+	if event.Reason != msg.RateLimitedReason {
+		t.Fatalf("error reason[%v], want [%v]", event.Reason, msg.RateLimitedReason)
+	}
+	client.expectClose(websocket.ClosePolicyViolation)
+}
+
+func TestQueueSwitchOff(t *testing.T) {
+	waiting := dial(t, "switch-waiting", "")
+	waiting.expectShouldQueue(true)
+
+	queued := dial(t, "switch-queued", "")
+	queued.expectShouldQueue(true)
+
+	// Keep ticket in queue until queue switches off.
+	setOnlineUsers(testOnlineUsersThreshold)
+	t.Cleanup(func() {
+		setOnlineUsers(testOnlineUsers)
+		if err := waitQueueing(true); err != nil {
+			t.Error(err)
+		}
+	})
+	queued.login("switch-token")
+	queued.expect(msg.TicketCode, &msg.TicketServerEvent{})
+
+	setOnlineUsers(10)
+	if err := waitQueueing(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client without login request logins by itself, and the one in
+	// queue is flushed to login.
+	waiting.expectShouldQueue(false)
+
+	event := &msg.LoginServerEvent{}
+	queued.expect(msg.LoginCode, event)
+	if event.Jwt == "" {
+		t.Fatalf("login event[%+v], want jwt", event)
+	}
+
+	dial(t, "switch-new", "").expectShouldQueue(false)
+}
+
+func TestCompression(t *testing.T) {
+	// Compress every message, since events of the suite are small.
+	setFlag(t, "ws-compression-min-bytes", "0")
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws://"+serverUrl+"/ws", testHeader("compression", ""))
+	if err != nil {
+		t.Fatalf("cannot connect %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if extensions := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(extensions, "permessage-deflate") {
+		t.Fatalf("extensions[%v], want permessage-deflate", extensions)
+	}
+
+	// Without login, since free slots of the suite are limited.
+	client := &testClient{t: t, conn: conn, codec: msg.JsonCodec}
+	client.expectShouldQueue(true)
+
+	// Shared message, written as prepared frames.
+	stats := &msg.QueueStatsServerEvent{}
+	client.expect(msg.QueueStatsCode, stats)
+	if stats.AvgWaitMsec == 0 {
+		t.Fatalf("stats[%+v], want average wait", stats)
+	}
+}
+
+// Bytes read from a connection, ie. bandwidth used by server.
+type countingConn struct {
+	net.Conn
+
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Broadcast to many connections, encoding per connection like before,
+// or once as a shared message written as prepared frames, with and
+// without permessage-deflate. Reports bytes on the wire per message
+// received by a client. QueueStats is too small for deflate to shrink,
+// while a Login event carrying jwt shrinks at default level but not at
+// level 1, which stores small messages as is.
+func BenchmarkBroadcast(b *testing.B) {
+	const clients = 100
+
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"uid":"8f14e45fceea167a5a36dedd4bea2543","platform":"Android","deviceId":"b6d767d2f8ed5d21a44b0e5886680cb9","sessionId":"3c59dc048e8850243be8079a5c74d079","iat":1760000000,"exp":1760086400}`))
+	signature := sha256.Sum256([]byte(claims))
+	jwt := "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9." + claims + "." + base64.RawURLEncoding.EncodeToString(signature[:])
+
+	for _, tc := range []struct {
+		name      string
+		eventCode msg.EventCode
+		event     any
+	}{
+		{"QueueStats", msg.QueueStatsCode, &msg.QueueStatsServerEvent{HeadPosition: 123456, TailPosition: 173456, AvgWaitMsec: 1834000}},
+		{"Login", msg.LoginCode, &msg.LoginServerEvent{StatusCode: http.StatusOK, Jwt: jwt}},
+	} {
+		rawEvent, err := json.Marshal(tc.event)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, compression := range []struct {
+			name  string
+			level int
+		}{
+			{"off", 0},
+			{"level1", flate.BestSpeed},
+			{"level6", flate.DefaultCompression},
+		} {
+			for _, isPrepared := range []bool{false, true} {
+				name := fmt.Sprintf("%v/compression=%v/prepared=%v", tc.name, compression.name, isPrepared)
+				b.Run(name, func(b *testing.B) {
+					conns, received, wireBytes := benchmarkConns(b, clients, compression.name != "off")
+					for _, conn := range conns {
+						conn.SetCompressionLevel(compression.level)
+					}
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if isPrepared {
+							wsMessage := msg.NewSharedMessage(tc.eventCode, rawEvent)
+							for _, conn := range conns {
+								prepared, err := msg.Prepare(msg.JsonCodec, wsMessage)
+								if err != nil {
+									b.Fatal(err)
+								}
+								if err := conn.WritePreparedMessage(prepared); err != nil {
+									b.Fatal(err)
+								}
+							}
+						} else {
+							for _, conn := range conns {
+								data, err := msg.Encode(msg.JsonCodec, &msg.WsMessage{EventCode: tc.eventCode, EventData: rawEvent})
+								if err != nil {
+									b.Fatal(err)
+								}
+								if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+									b.Fatal(err)
+								}
+							}
+						}
+					}
+
+					for received.Load() < int64(b.N*clients) {
+						time.Sleep(time.Millisecond)
+					}
+					b.StopTimer()
+					b.ReportMetric(float64(wireBytes.Load())/float64(b.N*clients), "wire-B/msg")
+				})
+			}
+		}
+	}
+}
+
+// Server side of clients connected over loopback. Clients count
+// messages and bytes they receive.
+func benchmarkConns(b *testing.B, clients int, compression bool) ([]*websocket.Conn, *atomic.Int64, *atomic.Int64) {
+	b.Helper()
+
+	upgrader := &websocket.Upgrader{EnableCompression: compression}
+	accepted := make(chan *websocket.Conn, clients)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	b.Cleanup(server.Close)
+
+	received := &atomic.Int64{}
+	wireBytes := &atomic.Int64{}
+	dialer := &websocket.Dialer{
+		EnableCompression: compression,
+		NetDial: func(network string, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, n: wireBytes}, nil
+		},
+	}
+
+	conns := make([]*websocket.Conn, 0, clients)
+	for i := 0; i < clients; i++ {
+		clientConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			b.Fatalf("cannot connect %v", err)
+		}
+		b.Cleanup(func() { clientConn.Close() })
+		go func() {
+			for {
+				if _, _, err := clientConn.ReadMessage(); err != nil {
+					return
+				}
+				received.Add(1)
+			}
+		}()
+
+		conn := <-accepted
+		b.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn)
+	}
+
+	// Handshake is not part of the broadcast.
+	wireBytes.Store(0)
+	return conns, received, wireBytes
+}
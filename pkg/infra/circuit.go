@@ -0,0 +1,93 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	// Circuit opens after this number of consecutive failed requests.
+	circuitFailureThreshold = 5
+
+	// Circuit is half-open after being open for this long.
+	circuitOpenDuration = 30 * time.Second
+)
+
+// Main server that requests are made to. Provided by config package,
+// which infra can't import.
+type MainServerConfig struct {
+	// Base url, eg. http://localhost:8888.
+	Host string
+}
+
+// Track state of main server from outcome of requests made to it. Open
+// if main server keeps failing. Half-open after a while, so that server
+// is ready again and the next request decides: closed on success, open
+// again on failure. Requests are not blocked by it, the state is only
+// reported.
+type Circuit struct {
+	// Only requests to this host are tracked.
+	host string
+
+	consecutiveFailures int
+
+	// Time circuit opened. Zero if closed.
+	openTime time.Time
+
+	clock Clock
+
+	mux sync.Mutex
+}
+
+func ProvideMainServerCircuit(mainServerConfig *MainServerConfig, health *Health, clock Clock) *Circuit {
+	circuit := &Circuit{clock: clock}
+	if mainServerUrl, err := url.Parse(mainServerConfig.Host); err == nil {
+		circuit.host = mainServerUrl.Host
+	}
+
+	health.AddReadinessCheck("mainServer", circuit.Check)
+	return circuit
+}
+
+// Record outcome of a request. Failure means network error or 5xx
+// response.
+func (c *Circuit) Report(host string, isFailure bool) {
+	if host != c.host {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if !isFailure {
+		c.consecutiveFailures = 0
+		c.openTime = time.Time{}
+		return
+	}
+
+	c.consecutiveFailures++
+	if c.isHalfOpen() || (c.consecutiveFailures >= circuitFailureThreshold && c.openTime.IsZero()) {
+		c.openTime = c.clock.Now()
+	}
+}
+
+// Lock must be held.
+func (c *Circuit) isHalfOpen() bool {
+	return !c.openTime.IsZero() && c.clock.Since(c.openTime) >= circuitOpenDuration
+}
+
+func (c *Circuit) Check(ctx context.Context) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.openTime.IsZero() || c.isHalfOpen() {
+		return nil
+	}
+	return fmt.Errorf("%w since %v after %v consecutive failures", ErrCircuitOpen, c.openTime.Format(time.RFC3339), c.consecutiveFailures)
+}
@@ -0,0 +1,86 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestCircuit(t *testing.T) (*Circuit, *Health, *VirtualClock) {
+	t.Helper()
+
+	health := ProvideHealth()
+	clock := NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return ProvideMainServerCircuit(&MainServerConfig{Host: "http://main-server:8888"}, health, clock), health, clock
+}
+
+func reportFailures(circuit *Circuit, count int) {
+	for i := 0; i < count; i++ {
+		circuit.Report("main-server:8888", true)
+	}
+}
+
+func TestCircuit(t *testing.T) {
+	circuit, health, clock := newTestCircuit(t)
+	ctx := context.Background()
+
+	// Closed until consecutive failures reach threshold.
+	reportFailures(circuit, circuitFailureThreshold-1)
+	circuit.Report("main-server:8888", false)
+	reportFailures(circuit, circuitFailureThreshold-1)
+	if err := circuit.Check(ctx); err != nil {
+		t.Fatalf("err[%v] before threshold, want closed", err)
+	}
+
+	reportFailures(circuit, 1)
+	if err := circuit.Check(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err[%v] at threshold, want [%v]", err, ErrCircuitOpen)
+	}
+	if isReady, results := health.Readiness(ctx); isReady || results["mainServer"].Ok {
+		t.Fatalf("ready[%v] with mainServer %+v, want not ready", isReady, results["mainServer"])
+	}
+
+	// Still open before open duration, even with more failures.
+	clock.Advance(circuitOpenDuration - time.Second)
+	reportFailures(circuit, 1)
+	if err := circuit.Check(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err[%v] before open duration, want [%v]", err, ErrCircuitOpen)
+	}
+
+	// Half-open lets server be ready, and one failure opens it again.
+	clock.Advance(time.Second)
+	if err := circuit.Check(ctx); err != nil {
+		t.Fatalf("err[%v] after open duration, want half-open", err)
+	}
+	reportFailures(circuit, 1)
+	if err := circuit.Check(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err[%v] after failure when half-open, want [%v]", err, ErrCircuitOpen)
+	}
+
+	// Success when half-open closes it.
+	clock.Advance(circuitOpenDuration)
+	if err := circuit.Check(ctx); err != nil {
+		t.Fatalf("err[%v] after open duration, want half-open", err)
+	}
+	circuit.Report("main-server:8888", false)
+	reportFailures(circuit, circuitFailureThreshold-1)
+	if err := circuit.Check(ctx); err != nil {
+		t.Fatalf("err[%v] after success, want closed", err)
+	}
+	if isReady, _ := health.Readiness(ctx); !isReady {
+		t.Fatalf("not ready with closed circuit")
+	}
+}
+
+func TestCircuitOtherHost(t *testing.T) {
+	circuit, _, _ := newTestCircuit(t)
+
+	// Eg. captcha verification.
+	for i := 0; i < circuitFailureThreshold; i++ {
+		circuit.Report("captcha:443", true)
+	}
+	if err := circuit.Check(context.Background()); err != nil {
+		t.Fatalf("err[%v] after failures of other host, want closed", err)
+	}
+}
@@ -0,0 +1,150 @@
+package infra
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of time for queue, its config and main server circuit, so that
+// their behavior can be simulated with virtual time.
+type Clock interface {
+	Now() time.Time
+
+	Since(t time.Time) time.Duration
+
+	NewTicker(d time.Duration) Ticker
+}
+
+// Same as time.Ticker. C is a method so that virtual ticker can be
+// used in its place.
+type Ticker interface {
+	C() <-chan time.Time
+
+	Reset(d time.Duration)
+
+	Stop()
+}
+
+func ProvideClock() Clock {
+	return &realClock{}
+}
+
+type realClock struct{}
+
+func (c *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (c *realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Reset(d time.Duration) {
+	t.ticker.Reset(d)
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Clock that only moves when Advance is called.
+type VirtualClock struct {
+	now time.Time
+
+	tickers []*virtualTicker
+
+	// Lock for protecting now and tickers.
+	mux sync.Mutex
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.now
+}
+
+func (c *VirtualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	ticker := &virtualTicker{
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   c.now.Add(d),
+		clock:  c,
+	}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// Move time forward and fire tickers that are due. Like time.Ticker, a
+// tick is dropped if the previous one has not been received.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, ticker := range c.tickers {
+		for !ticker.isStopped && !ticker.next.After(c.now) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+			}
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+}
+
+type virtualTicker struct {
+	c chan time.Time
+
+	period time.Duration
+
+	// Time of the next tick.
+	next time.Time
+
+	isStopped bool
+
+	clock *VirtualClock
+}
+
+func (t *virtualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTicker) Reset(d time.Duration) {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+
+	t.period = d
+	t.next = t.clock.now.Add(d)
+	t.isStopped = false
+}
+
+func (t *virtualTicker) Stop() {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+
+	t.isStopped = true
+}
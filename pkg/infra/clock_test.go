@@ -0,0 +1,61 @@
+package infra
+
+import (
+	"testing"
+	"time"
+)
+
+// Ticks fired so far.
+func firedTicks(ticker Ticker) []time.Time {
+	var ticks []time.Time
+	for {
+		select {
+		case tick := <-ticker.C():
+			ticks = append(ticks, tick)
+		default:
+			return ticks
+		}
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(start)
+
+	ticker := clock.NewTicker(10 * time.Second)
+	clock.Advance(9 * time.Second)
+	if ticks := firedTicks(ticker); len(ticks) != 0 {
+		t.Fatalf("fired %v before period", ticks)
+	}
+	if since := clock.Since(start); since != 9*time.Second {
+		t.Fatalf("since[%v], want 9s", since)
+	}
+
+	clock.Advance(time.Second)
+	if ticks := firedTicks(ticker); len(ticks) != 1 || !ticks[0].Equal(start.Add(10*time.Second)) {
+		t.Fatalf("fired %v, want a tick at 10s", ticks)
+	}
+
+	// Like time.Ticker, ticks not received are dropped.
+	clock.Advance(35 * time.Second)
+	if ticks := firedTicks(ticker); len(ticks) != 1 || !ticks[0].Equal(start.Add(20*time.Second)) {
+		t.Fatalf("fired %v, want only the tick at 20s", ticks)
+	}
+
+	// Reset counts period from now.
+	ticker.Reset(20 * time.Second)
+	clock.Advance(19 * time.Second)
+	if ticks := firedTicks(ticker); len(ticks) != 0 {
+		t.Fatalf("fired %v before reset period", ticks)
+	}
+	clock.Advance(time.Second)
+	if ticks := firedTicks(ticker); len(ticks) != 1 || !ticks[0].Equal(start.Add(65*time.Second)) {
+		t.Fatalf("fired %v, want a tick at 65s", ticks)
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	if ticks := firedTicks(ticker); len(ticks) != 0 {
+		t.Fatalf("fired %v after stop", ticks)
+	}
+}
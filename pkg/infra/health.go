@@ -0,0 +1,138 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Time allowed for all readiness checks to finish.
+const readinessTimeout = 3 * time.Second
+
+// Return error if the dependency is not ready.
+type HealthCheck func(ctx context.Context) error
+
+type CheckResult struct {
+	Ok bool `json:"ok"`
+
+	Detail string `json:"detail,omitempty"`
+}
+
+type heartbeat struct {
+	lastBeat time.Time
+
+	// Worker is viewed as stuck if it hasn't beaten for this long.
+	maxSilence time.Duration
+}
+
+// Health collects heartbeats of worker goroutines for liveness, and
+// checks of dependencies for readiness.
+type Health struct {
+	// Key value: worker name -> heartbeat.
+	heartbeats map[string]*heartbeat
+
+	// Key value: dependency name -> check.
+	readinessChecks map[string]HealthCheck
+
+	// Lock for protecting heartbeats and readinessChecks maps.
+	mux sync.Mutex
+}
+
+func ProvideHealth() *Health {
+	return &Health{
+		heartbeats:      make(map[string]*heartbeat),
+		readinessChecks: make(map[string]HealthCheck),
+	}
+}
+
+// Start watching a worker. Worker must call Beat at least once per
+// maxSilence, otherwise process is viewed as not alive.
+func (h *Health) Watch(name string, maxSilence time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.heartbeats[name] = &heartbeat{
+		lastBeat:   time.Now(),
+		maxSilence: maxSilence,
+	}
+}
+
+func (h *Health) Beat(name string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if beat, ok := h.heartbeats[name]; ok {
+		beat.lastBeat = time.Now()
+	}
+}
+
+func (h *Health) AddReadinessCheck(name string, check HealthCheck) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.readinessChecks[name] = check
+}
+
+// Alive if every watched worker has beaten recently.
+func (h *Health) Liveness() (bool, map[string]*CheckResult) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	isAlive := true
+	results := make(map[string]*CheckResult, len(h.heartbeats))
+	for name, beat := range h.heartbeats {
+		silence := time.Since(beat.lastBeat)
+		result := &CheckResult{
+			Ok:     silence <= beat.maxSilence,
+			Detail: fmt.Sprintf("last beat %v ago", silence.Round(time.Millisecond)),
+		}
+		if !result.Ok {
+			isAlive = false
+		}
+		results[name] = result
+	}
+	return isAlive, results
+}
+
+// Ready if every readiness check passes. Checks run concurrently.
+func (h *Health) Readiness(ctx context.Context) (bool, map[string]*CheckResult) {
+	h.mux.Lock()
+	checks := make(map[string]HealthCheck, len(h.readinessChecks))
+	for name, check := range h.readinessChecks {
+		checks[name] = check
+	}
+	h.mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var resultsMux sync.Mutex
+	results := make(map[string]*CheckResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+
+			result := &CheckResult{Ok: true}
+			if err := check(ctx); err != nil {
+				result.Ok = false
+				result.Detail = err.Error()
+			}
+
+			resultsMux.Lock()
+			results[name] = result
+			resultsMux.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	isReady := true
+	for _, result := range results {
+		if !result.Ok {
+			isReady = false
+		}
+	}
+	return isReady, results
+}
@@ -0,0 +1,72 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLiveness(t *testing.T) {
+	health := ProvideHealth()
+	health.Watch("worker", 50*time.Millisecond)
+
+	if isAlive, results := health.Liveness(); !isAlive || !results["worker"].Ok {
+		t.Fatalf("alive[%v] with worker %+v, want alive", isAlive, results["worker"])
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if isAlive, results := health.Liveness(); isAlive || results["worker"].Ok {
+		t.Fatalf("alive[%v] with worker %+v, want stuck", isAlive, results["worker"])
+	}
+
+	health.Beat("worker")
+	if isAlive, _ := health.Liveness(); !isAlive {
+		t.Fatalf("not alive after beat")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	health := ProvideHealth()
+
+	var isDown bool
+	health.AddReadinessCheck("dependency", func(ctx context.Context) error {
+		if isDown {
+			return errors.New("down")
+		}
+		return nil
+	})
+	health.AddReadinessCheck("other", func(ctx context.Context) error { return nil })
+
+	if isReady, results := health.Readiness(context.Background()); !isReady || len(results) != 2 {
+		t.Fatalf("ready[%v] with %v, want ready with 2 checks", isReady, results)
+	}
+
+	isDown = true
+	isReady, results := health.Readiness(context.Background())
+	if isReady || results["dependency"].Ok || results["dependency"].Detail != "down" || !results["other"].Ok {
+		t.Fatalf("ready[%v] with dependency %+v other %+v, want only dependency failed", isReady, results["dependency"], results["other"])
+	}
+}
+
+func TestReadinessRedisDown(t *testing.T) {
+	loggerFactory := ProvideLoggerFactory()
+	loggerFactory.SetLevel("", zapcore.WarnLevel)
+
+	testRedis := miniredis.RunT(t)
+	health := ProvideHealth()
+	redisClient := ProvideRedisClient(&RedisConfig{Host: testRedis.Addr()}, health, loggerFactory)
+	defer redisClient.Close()
+
+	if isReady, results := health.Readiness(context.Background()); !isReady {
+		t.Fatalf("not ready with redis %+v", results["redis"])
+	}
+
+	testRedis.Close()
+	if isReady, results := health.Readiness(context.Background()); isReady || results["redis"].Ok {
+		t.Fatalf("ready[%v] with redis %+v, want not ready", isReady, results["redis"])
+	}
+}
@@ -1,17 +1,77 @@
 package infra
 
 import (
+	"net/http"
 	"time"
 
 	"github.com/imroc/req/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func ProvideHttpClient() *req.Client {
+func ProvideHttpClient(tracerFactory *TracerFactory, mainServerCircuit *Circuit) *req.Client {
 	return req.C(). // Use C() to create a client and set with chainable client settings.
 		// Timeout of all requests.
 		SetTimeout(10 * time.Second).
 		// Enable retry and set the maximum retry count.
 		SetCommonRetryCount(3).
 		// Set the retry sleep interval with a commonly used algorithm: capped exponential backoff with jitter (https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/).
-		SetCommonRetryFixedInterval(3 * time.Second)
+		SetCommonRetryFixedInterval(3 * time.Second).
+		// Trace every attempt of a request as child span of the request's
+		// context, and propagate trace context to the receiver.
+		WrapRoundTripFunc(traceRoundTrip(tracerFactory.Create("HttpClient"), tracerFactory)).
+		// Report outcome of every attempt to main server circuit.
+		WrapRoundTripFunc(reportRoundTrip(mainServerCircuit))
+}
+
+func reportRoundTrip(circuit *Circuit) req.RoundTripWrapperFunc {
+	return func(rt req.RoundTripper) req.RoundTripFunc {
+		return func(r *req.Request) (*req.Response, error) {
+			resp, err := rt.RoundTrip(r)
+			if r.URL != nil {
+				circuit.Report(r.URL.Host, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+			}
+			return resp, err
+		}
+	}
+}
+
+func traceRoundTrip(tracer trace.Tracer, tracerFactory *TracerFactory) req.RoundTripWrapperFunc {
+	return func(rt req.RoundTripper) req.RoundTripFunc {
+		return func(r *req.Request) (*req.Response, error) {
+			path := r.RawURL
+			if r.URL != nil {
+				path = r.URL.Path
+			}
+
+			ctx, span := tracer.Start(r.Context(), r.Method+" "+path,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", path),
+					attribute.Int("http.request.resend_count", r.RetryAttempt),
+				),
+			)
+			defer span.End()
+
+			if r.Headers == nil {
+				r.Headers = make(http.Header)
+			}
+			tracerFactory.Inject(ctx, r.Headers)
+
+			resp, err := rt.RoundTrip(r)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return resp, err
+			}
+
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+			return resp, err
+		}
+	}
 }
@@ -1,52 +1,219 @@
 package infra
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var (
-	// Allow changing log level at run time.
-	LoggerLevel = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+const (
+	// Level of loggers that have not been set individually.
+	defaultLoggerLevel = zapcore.InfoLevel
+
+	// Sampling counts log entries with the same level and message
+	// within this interval.
+	samplingTick = time.Second
 )
 
+var ErrInvalidLoggerEnv = errors.New("invalid logger env")
+
 type LoggerFactory struct {
-	baseLogger *zap.Logger
+	encoder zapcore.Encoder
+
+	output zapcore.WriteSyncer
+
+	errorOutput zapcore.WriteSyncer
+
+	// Log only first samplingInitial entries with the same level and
+	// message per samplingTick, then every samplingThereafter-th
+	// entry. Zero samplingInitial disables sampling. Only debug and
+	// info are sampled, warn and above are never dropped.
+	samplingInitial    int
+	samplingThereafter int
+
+	// Allow changing log level at run time. Each named logger has its
+	// own level. Key value: logger name -> level.
+	levels map[string]zap.AtomicLevel
+
+	// Cores are shared by loggers of the same name, so that sampling
+	// applies to all of them and a sampler isn't allocated per logger.
+	// Key value: logger name -> core.
+	cores map[string]zapcore.Core
+
+	// Level applied to loggers created in the future.
+	defaultLevel zapcore.Level
+
+	// Lock for protecting levels, cores and defaultLevel.
+	levelsMux sync.Mutex
 }
 
+// Create a logger with its own run time adjustable level. Loggers
+// created with the same name share the same level. Use With() to
+// attach fields such as client id instead of putting them in name.
 func (f *LoggerFactory) Create(name string) *zap.Logger {
-	return f.baseLogger.Named(name)
+	return zap.New(f.coreOf(name), zap.ErrorOutput(f.errorOutput)).Named(name)
 }
 
+// Set level of the named logger. Empty name sets level of all loggers,
+// including the ones created in the future.
+func (f *LoggerFactory) SetLevel(name string, level zapcore.Level) {
+	f.levelsMux.Lock()
+	defer f.levelsMux.Unlock()
+
+	if name == "" {
+		f.defaultLevel = level
+		for _, atomicLevel := range f.levels {
+			atomicLevel.SetLevel(level)
+		}
+		return
+	}
+
+	atomicLevel, ok := f.levels[name]
+	if !ok {
+		atomicLevel = zap.NewAtomicLevelAt(level)
+		f.levels[name] = atomicLevel
+	}
+	atomicLevel.SetLevel(level)
+}
+
+// Current level of each named logger. Key value: logger name -> level.
+func (f *LoggerFactory) Levels() map[string]string {
+	f.levelsMux.Lock()
+	defer f.levelsMux.Unlock()
+
+	levels := make(map[string]string, len(f.levels))
+	for name, atomicLevel := range f.levels {
+		levels[name] = atomicLevel.String()
+	}
+	return levels
+}
+
+func (f *LoggerFactory) coreOf(name string) zapcore.Core {
+	f.levelsMux.Lock()
+	defer f.levelsMux.Unlock()
+
+	if core, ok := f.cores[name]; ok {
+		return core
+	}
+
+	atomicLevel, ok := f.levels[name]
+	if !ok {
+		atomicLevel = zap.NewAtomicLevelAt(f.defaultLevel)
+		f.levels[name] = atomicLevel
+	}
+
+	var core zapcore.Core = zapcore.NewCore(f.encoder, f.output, atomicLevel)
+	if f.samplingInitial > 0 {
+		sampled := zapcore.NewCore(f.encoder, f.output, zap.LevelEnablerFunc(func(level zapcore.Level) bool {
+			return level < zapcore.WarnLevel && atomicLevel.Enabled(level)
+		}))
+		unsampled := zapcore.NewCore(f.encoder, f.output, zap.LevelEnablerFunc(func(level zapcore.Level) bool {
+			return level >= zapcore.WarnLevel && atomicLevel.Enabled(level)
+		}))
+		core = zapcore.NewTee(
+			zapcore.NewSamplerWithOptions(sampled, samplingTick, f.samplingInitial, f.samplingThereafter),
+			unsampled,
+		)
+	}
+	f.cores[name] = core
+	return core
+}
+
+// Logger options are read from env since logger is created before
+// anything else:
+//   - LOG_ENCODING: "console" (default) or "json" for log aggregation.
+//   - LOG_SAMPLING_INITIAL, LOG_SAMPLING_THEREAFTER: sampling of
+//     repeated log entries, disabled if not set.
+//
+// Invalid values are logged as warnings and the default is used.
 func ProvideLoggerFactory() *LoggerFactory {
+	var envErrors []error
+
 	// See the documentation for Config and zapcore.EncoderConfig for all the
 	// available options.
-	var cfg = zap.Config{
-		Level:            LoggerLevel,
-		Development:      false,
-		Encoding:         "console",
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stderr"},
-		EncoderConfig: zapcore.EncoderConfig{
-			// Keys can be anything except the empty string.
-			TimeKey:  "time",
-			LevelKey: "level",
-			NameKey:  "name",
-			// CallerKey:      "caller",
-			// FunctionKey:    "function",
-			MessageKey:     "message",
-			StacktraceKey:  "stacktrace",
-			LineEnding:     zapcore.DefaultLineEnding,
-			EncodeLevel:    zapcore.CapitalColorLevelEncoder,
-			EncodeTime:     zapcore.ISO8601TimeEncoder,
-			EncodeDuration: zapcore.MillisDurationEncoder,
-			EncodeCaller:   zapcore.ShortCallerEncoder,
-		},
-	}
-	logger := zap.Must(cfg.Build())
-	logger.Info("logger created")
-
-	return &LoggerFactory{
-		baseLogger: logger,
+	encoderConfig := zapcore.EncoderConfig{
+		// Keys can be anything except the empty string.
+		TimeKey:  "time",
+		LevelKey: "level",
+		NameKey:  "name",
+		// CallerKey:      "caller",
+		// FunctionKey:    "function",
+		MessageKey:     "message",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.CapitalColorLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.MillisDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	}
+
+	var encoder zapcore.Encoder
+	switch encoding := os.Getenv("LOG_ENCODING"); encoding {
+	case "json":
+		encoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder // No color codes in json.
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "", "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		envErrors = append(envErrors, fmt.Errorf("%w LOG_ENCODING[%v] is neither console nor json", ErrInvalidLoggerEnv, encoding))
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+
+	output, _, err := zap.Open("stdout")
+	if err != nil {
+		panic(err)
+	}
+	errorOutput, _, err := zap.Open("stderr")
+	if err != nil {
+		panic(err)
+	}
+
+	// Missing values disable sampling, so do invalid ones rather than
+	// drop more than intended.
+	samplingInitial, initialErr := loggerEnvCount("LOG_SAMPLING_INITIAL")
+	samplingThereafter, thereafterErr := loggerEnvCount("LOG_SAMPLING_THEREAFTER")
+	for _, err := range []error{initialErr, thereafterErr} {
+		if err != nil {
+			envErrors = append(envErrors, err)
+			samplingInitial, samplingThereafter = 0, 0
+		}
+	}
+
+	factory := &LoggerFactory{
+		encoder:            encoder,
+		output:             output,
+		errorOutput:        errorOutput,
+		samplingInitial:    samplingInitial,
+		samplingThereafter: samplingThereafter,
+		levels:             make(map[string]zap.AtomicLevel),
+		cores:              make(map[string]zapcore.Core),
+		defaultLevel:       defaultLoggerLevel,
+	}
+	logger := factory.Create("LoggerFactory")
+	for _, err := range envErrors {
+		logger.Warn("default is used", zap.Error(err))
+	}
+	logger.Info("logger created", zap.String("encoding", os.Getenv("LOG_ENCODING")), zap.Int("samplingInitial", samplingInitial), zap.Int("samplingThereafter", samplingThereafter))
+
+	return factory
+}
+
+// Non-negative number from env. Zero if not set.
+func loggerEnvCount(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("%w %v[%v] is not a non-negative integer", ErrInvalidLoggerEnv, name, value)
 	}
+	return count, nil
 }
@@ -0,0 +1,110 @@
+package infra
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Factory writing to buf, keeping the first entry of each message per
+// sampling tick.
+func newSampledLoggerFactory(buf *bytes.Buffer) *LoggerFactory {
+	return &LoggerFactory{
+		encoder:            zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+		output:             zapcore.AddSync(buf),
+		errorOutput:        zapcore.AddSync(buf),
+		samplingInitial:    1,
+		samplingThereafter: 0,
+		levels:             make(map[string]zap.AtomicLevel),
+		cores:              make(map[string]zapcore.Core),
+		defaultLevel:       zapcore.DebugLevel,
+	}
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newSampledLoggerFactory(&buf).Create("Test")
+
+	for i := 0; i < 5; i++ {
+		logger.Debug("repeated debug")
+		logger.Info("repeated info")
+		logger.Warn("repeated warn")
+		logger.Error("repeated error")
+	}
+
+	for message, want := range map[string]int{
+		"repeated debug": 1,
+		"repeated info":  1,
+		"repeated warn":  5,
+		"repeated error": 5,
+	} {
+		if cnt := strings.Count(buf.String(), message); cnt != want {
+			t.Errorf("logged [%v] %v times, want %v", message, cnt, want)
+		}
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	factory := newSampledLoggerFactory(&buf)
+	logger := factory.Create("Test")
+
+	// Level still applies to unsampled levels.
+	factory.SetLevel("Test", zapcore.ErrorLevel)
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	if log := buf.String(); strings.Contains(log, "info") || strings.Contains(log, "warn") || !strings.Contains(log, "error") {
+		t.Fatalf("log[%v], want only error", log)
+	}
+}
+
+func TestLoggerEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		encoding           string
+		initial            string
+		thereafter         string
+		samplingInitial    int
+		samplingThereafter int
+	}{
+		{name: "not set", samplingInitial: 0, samplingThereafter: 0},
+		{name: "sampling", initial: "100", thereafter: "10", samplingInitial: 100, samplingThereafter: 10},
+		{name: "json", encoding: "json", initial: "100", samplingInitial: 100, samplingThereafter: 0},
+		{name: "negative", initial: "-1", thereafter: "10"},
+		{name: "not a number", initial: "100", thereafter: "ten"},
+		{name: "unknown encoding", encoding: "xml", initial: "100", thereafter: "10", samplingInitial: 100, samplingThereafter: 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("LOG_ENCODING", tc.encoding)
+			t.Setenv("LOG_SAMPLING_INITIAL", tc.initial)
+			t.Setenv("LOG_SAMPLING_THEREAFTER", tc.thereafter)
+
+			factory := ProvideLoggerFactory()
+			if factory.samplingInitial != tc.samplingInitial || factory.samplingThereafter != tc.samplingThereafter {
+				t.Fatalf("sampling initial[%v] thereafter[%v], want [%v] [%v]", factory.samplingInitial, factory.samplingThereafter, tc.samplingInitial, tc.samplingThereafter)
+			}
+		})
+	}
+}
+
+func TestLoggerEnvCount(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "0": 0, "5": 5} {
+		t.Setenv("LOG_TEST_COUNT", value)
+		if count, err := loggerEnvCount("LOG_TEST_COUNT"); err != nil || count != want {
+			t.Fatalf("count[%v] %v of [%v], want [%v]", count, err, value, want)
+		}
+	}
+
+	for _, value := range []string{"-1", "1.5", "many", " 5"} {
+		t.Setenv("LOG_TEST_COUNT", value)
+		if _, err := loggerEnvCount("LOG_TEST_COUNT"); !errors.Is(err, ErrInvalidLoggerEnv) {
+			t.Fatalf("err[%v] of [%v], want [%v]", err, value, ErrInvalidLoggerEnv)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package infra
+
+import (
+	"expvar"
+)
+
+// Name of the expvar map that holds all metrics of this server. Only
+// this map is served, not the whole expvar output which includes
+// command line flags.
+const metricsName = "loginQueue"
+
+type Metrics struct {
+	vars *expvar.Map
+}
+
+func ProvideMetrics() *Metrics {
+	return &Metrics{
+		vars: expvar.NewMap(metricsName),
+	}
+}
+
+// Add delta to the counter of key. Counter is created if it does not
+// exist.
+func (m *Metrics) Add(key string, delta int64) {
+	m.vars.Add(key, delta)
+}
+
+// Set gauge of key to value. Gauge is created if it does not exist.
+func (m *Metrics) Set(key string, value int64) {
+	gauge, ok := m.vars.Get(key).(*expvar.Int)
+	if !ok {
+		gauge = new(expvar.Int)
+		m.vars.Set(key, gauge)
+	}
+	gauge.Set(value)
+}
+
+// Every metric as a json object.
+func (m *Metrics) String() string {
+	return m.vars.String()
+}
@@ -0,0 +1,236 @@
+package infra
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol lets L4 load balancers pass the original client
+// address by prepending a header to the tcp stream. Spec:
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var (
+	ErrNoProxyHeader      = errors.New("no proxy protocol header")
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// "PROXY TCP6 <39 chars> <39 chars> 65535 65535\r\n" is the
+	// longest possible v1 header.
+	proxyV1MaxLength = 107
+
+	// Signature, version and command, family, address length.
+	proxyV2HeaderLength = 16
+)
+
+type proxyProtocolListener struct {
+	net.Listener
+
+	// Time allowed to read the proxy header after connection is
+	// accepted.
+	headerTimeout time.Duration
+}
+
+// Wrap listener so that RemoteAddr of accepted connections is the
+// client address in proxy protocol v1 or v2 header. Connections
+// without a valid header are closed on first read.
+func NewProxyProtocolListener(listener net.Listener, headerTimeout time.Duration) net.Listener {
+	return &proxyProtocolListener{
+		Listener:      listener,
+		headerTimeout: headerTimeout,
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// Header is parsed lazily on first Read or RemoteAddr, so a slow
+// client cannot block Accept.
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+
+	headerTimeout time.Duration
+
+	headerOnce sync.Once
+
+	// Client address from header. Nil if header carries no address
+	// (LOCAL or UNKNOWN), in which case the real remote address is
+	// used.
+	remoteAddr net.Addr
+
+	headerErr error
+
+	deadlineLock sync.Mutex
+
+	// Read deadline set by the owner of the connection, restored after
+	// the header is read.
+	readDeadline time.Time
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.headerOnce.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.headerOnce.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.deadlineLock.Lock()
+	headerDeadline := time.Now().Add(c.headerTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(headerDeadline) {
+		headerDeadline = c.readDeadline
+	}
+	c.Conn.SetReadDeadline(headerDeadline)
+	c.deadlineLock.Unlock()
+
+	// Deadline belongs to the owner of the connection, so whatever it
+	// set, even during the header, is put back.
+	defer func() {
+		c.deadlineLock.Lock()
+		defer c.deadlineLock.Unlock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+	}()
+
+	// Shortest v1 header is longer than v2 signature.
+	prefix, err := c.reader.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		c.remoteAddr, c.headerErr = readProxyV2Header(c.reader)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		c.remoteAddr, c.headerErr = readProxyV1Header(c.reader)
+	case err != nil && err != io.EOF:
+		c.headerErr = err
+	default:
+		c.headerErr = ErrNoProxyHeader
+	}
+}
+
+// Format: "PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n".
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// Addresses are followed by optional TLVs which are ignored.
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command is used by health checks of load balancer. Other
+	// than that only PROXY command is defined.
+	switch versionCommand & 0x0f {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+		return proxyV2Address(family, payload)
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+}
+
+func proxyV2Address(family byte, payload []byte) (net.Addr, error) {
+
+	switch family {
+	case 0x11: // TCP over IPv4.
+		if len(payload) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6.
+		if len(payload) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,196 @@
+package infra
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Proxy protocol v2 header of command and family, followed by payload.
+func proxyV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// Source, destination addresses and ports.
+func proxyV2Payload(src net.IP, dst net.IP, srcPort uint16, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+// Connection accepted by proxy protocol listener, after the peer sent
+// data and closed its write side.
+func acceptProxied(t *testing.T, headerTimeout time.Duration, data []byte) net.Conn {
+	t.Helper()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewProxyProtocolListener(tcpListener, headerTimeout)
+	t.Cleanup(func() { listener.Close() })
+
+	peer, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	// Nil data means the peer sends nothing.
+	if data != nil {
+		if _, err := peer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		peer.(*net.TCPConn).CloseWrite()
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ipv4Payload := proxyV2Payload(net.IPv4(203, 0, 113, 7).To4(), net.IPv4(10, 0, 0, 1).To4(), 51000, 443)
+	ipv6Payload := proxyV2Payload(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), 51000, 443)
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+
+		// Empty means the peer address.
+		remoteAddr string
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"), remoteAddr: "203.0.113.7:51000"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n"), remoteAddr: "[2001:db8::7]:51000"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 tcp4", header: proxyV2Header(0x1, 0x11, ipv4Payload), remoteAddr: "203.0.113.7:51000"},
+		{name: "v2 tcp6", header: proxyV2Header(0x1, 0x21, ipv6Payload), remoteAddr: "[2001:db8::7]:51000"},
+		{name: "v2 tlv", header: proxyV2Header(0x1, 0x11, append(ipv4Payload, 0x04, 0x00, 0x01, 0xff)), remoteAddr: "203.0.113.7:51000"},
+		{name: "v2 local", header: proxyV2Header(0x0, 0x00, nil)},
+		{name: "v2 unspecified family", header: proxyV2Header(0x1, 0x00, nil)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := acceptProxied(t, time.Second, append(tc.header, "GET /"...))
+
+			remoteAddr := tc.remoteAddr
+			if remoteAddr == "" {
+				remoteAddr = conn.LocalAddr().(*net.TCPAddr).IP.String()
+			}
+			if !strings.HasPrefix(conn.RemoteAddr().String(), remoteAddr) {
+				t.Fatalf("remote addr[%v], want [%v]", conn.RemoteAddr(), remoteAddr)
+			}
+
+			// Header is not part of the stream.
+			data, err := io.ReadAll(conn)
+			if err != nil || string(data) != "GET /" {
+				t.Fatalf("read [%s] %v, want [GET /]", data, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolInvalid(t *testing.T) {
+	ipv4Payload := proxyV2Payload(net.IPv4(203, 0, 113, 7).To4(), net.IPv4(10, 0, 0, 1).To4(), 51000, 443)
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n"), err: ErrNoProxyHeader},
+		{name: "empty", header: []byte{}, err: ErrNoProxyHeader},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1"), err: io.EOF},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), err: ErrInvalidProxyHeader},
+		{name: "v1 missing port", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000\r\n"), err: ErrInvalidProxyHeader},
+		{name: "v1 udp", header: []byte("PROXY UDP4 203.0.113.7 10.0.0.1 51000 443\r\n"), err: ErrInvalidProxyHeader},
+		{name: "v1 invalid ip", header: []byte("PROXY TCP4 203.0.113 10.0.0.1 51000 443\r\n"), err: ErrInvalidProxyHeader},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 65536 443\r\n"), err: ErrInvalidProxyHeader},
+		{name: "v2 truncated header", header: proxyV2Header(0x1, 0x11, ipv4Payload)[:14], err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated payload", header: proxyV2Header(0x1, 0x11, ipv4Payload)[:20], err: io.ErrUnexpectedEOF},
+		{name: "v2 version 1", header: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0x00, 0x00), err: ErrInvalidProxyHeader},
+		{name: "v2 unknown command", header: proxyV2Header(0x2, 0x11, ipv4Payload), err: ErrInvalidProxyHeader},
+		{name: "v2 short tcp4 address", header: proxyV2Header(0x1, 0x11, ipv4Payload[:8]), err: ErrInvalidProxyHeader},
+		{name: "v2 short tcp6 address", header: proxyV2Header(0x1, 0x21, ipv4Payload), err: ErrInvalidProxyHeader},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := acceptProxied(t, time.Second, tc.header)
+
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+
+			// Peer address is kept.
+			if remoteAddr := conn.RemoteAddr().(*net.TCPAddr); !remoteAddr.IP.IsLoopback() {
+				t.Fatalf("remote addr[%v], want peer address", remoteAddr)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderTimeout(t *testing.T) {
+	conn := acceptProxied(t, 50*time.Millisecond, nil)
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err[%v], want [%v]", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("header read for [%v], want about header timeout", elapsed)
+	}
+}
+
+func TestProxyProtocolKeepsDeadline(t *testing.T) {
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"
+
+	t.Run("earlier than header timeout", func(t *testing.T) {
+		conn := acceptProxied(t, time.Minute, nil)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("err[%v], want [%v]", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("after header", func(t *testing.T) {
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := NewProxyProtocolListener(tcpListener, time.Minute)
+		defer listener.Close()
+
+		peer, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		peer.Write([]byte(header))
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Set by the server before the header is read, and still in
+		// effect for the request once the peer stops sending.
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if conn.RemoteAddr().String() != "203.0.113.7:51000" {
+			t.Fatalf("remote addr[%v], want [203.0.113.7:51000]", conn.RemoteAddr())
+		}
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("err[%v], want [%v]", err, os.ErrDeadlineExceeded)
+		}
+	})
+}
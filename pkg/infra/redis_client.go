@@ -2,26 +2,31 @@ package infra
 
 import (
 	"context"
-	"os"
-	"strconv"
 
 	"github.com/go-redis/redis/v8"
 )
 
-func ProvideRedisClient(loggerFactory *LoggerFactory) (*redis.Client, error) {
-	logger := loggerFactory.Create("RedisClient").Sugar()
-	redisDb, err := strconv.Atoi(os.Getenv("REDIS_DB"))
-	if err != nil {
-		logger.Errorf("invalid redis db %v", err)
-		return nil, err
-	}
+// Where redis is. Provided by config package, which infra can't import.
+type RedisConfig struct {
+	Host string
+
+	Db int
+}
 
-	return redis.NewClient(&redis.Options{
-		Addr: os.Getenv("REDIS_HOST"),
-		DB:   redisDb,
+func ProvideRedisClient(redisConfig *RedisConfig, health *Health, loggerFactory *LoggerFactory) *redis.Client {
+	logger := loggerFactory.Create("RedisClient").Sugar()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: redisConfig.Host,
+		DB:   redisConfig.Db,
 		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
-			logger.Infof("redis connected to host[%v] db[%v]", os.Getenv("REDIS_HOST"), redisDb)
+			logger.Infof("redis connected to host[%v] db[%v]", redisConfig.Host, redisConfig.Db)
 			return nil
 		},
-	}), nil
+	})
+
+	health.AddReadinessCheck("redis", func(ctx context.Context) error {
+		return redisClient.Ping(ctx).Err()
+	})
+
+	return redisClient
 }
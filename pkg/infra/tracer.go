@@ -0,0 +1,93 @@
+package infra
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type TracerFactory struct {
+	provider trace.TracerProvider
+
+	// W3C trace context, carried in traceparent and tracestate
+	// headers.
+	propagator propagation.TextMapPropagator
+
+	// Flush spans that have not been exported yet. Nil for no-op
+	// provider.
+	shutdown func(context.Context) error
+}
+
+func (f *TracerFactory) Create(name string) trace.Tracer {
+	return f.provider.Tracer(name)
+}
+
+// Write trace context of ctx into header, so the receiver can continue
+// the trace.
+func (f *TracerFactory) Inject(ctx context.Context, header http.Header) {
+	f.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Read trace context from header into ctx.
+func (f *TracerFactory) Extract(ctx context.Context, header http.Header) context.Context {
+	return f.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+func (f *TracerFactory) Shutdown(ctx context.Context) error {
+	if f.shutdown == nil {
+		return nil
+	}
+	return f.shutdown(ctx)
+}
+
+// Tracing is disabled unless an OTLP endpoint is set. The exporter,
+// sampler and resource are configured with standard OTEL_* env, eg.
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_TRACES_SAMPLER and
+// OTEL_SERVICE_NAME.
+func ProvideTracerFactory(loggerFactory *LoggerFactory) (*TracerFactory, error) {
+	logger := loggerFactory.Create("TracerFactory").Sugar()
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		logger.Infow("tracing disabled since no otlp endpoint is set")
+		return &TracerFactory{
+			provider:   noop.NewTracerProvider(),
+			propagator: propagator,
+		}, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		logger.Errorw("cannot create otlp exporter", "err", err)
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	logger.Infow("tracing enabled")
+
+	return &TracerFactory{
+		provider:   provider,
+		propagator: propagator,
+		shutdown:   provider.Shutdown,
+	}, nil
+}
+
+// Tracer factory that records every span in memory. Used to inspect
+// spans in tests and simulations.
+func NewInMemoryTracerFactory() (*TracerFactory, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	return &TracerFactory{
+		provider:   provider,
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		shutdown:   provider.Shutdown,
+	}, exporter
+}
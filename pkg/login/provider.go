@@ -0,0 +1,119 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+)
+
+var ErrMissingField = errors.New("missing login field")
+
+// Provider knows how to login a client of one login type through
+// main server authorization api.
+type Provider interface {
+	// Name of the provider, used in logs.
+	Name() string
+
+	// Path of main server authorization api for this provider,
+	// appended to /api/user/authorization.
+	Path() string
+
+	// Build request body of authorization api from client's login
+	// request. Return error if required fields are missing.
+	MarshalRequest(loginData *msg.LoginClientEvent) ([]byte, error)
+
+	// Extract jwt from response body of authorization api.
+	ParseResponse(body []byte) (string, error)
+}
+
+// Fields of client login request that can be put into request body.
+const (
+	TokenField    = "token"
+	AccountField  = "account"
+	DeviceIdField = "deviceId"
+)
+
+type FieldProviderConfig struct {
+	Type msg.LoginTypeCode `json:"type"`
+
+	Name string `json:"name"`
+
+	Path string `json:"path"`
+
+	// Request body fields of authorization api. Key value: body field
+	// name -> client login request field (TokenField, AccountField or
+	// DeviceIdField).
+	Fields map[string]string `json:"fields"`
+}
+
+// Provider that maps client login request fields to a flat json
+// request body. Covers all providers main server currently has, so
+// new ones can be added by config only.
+type FieldProvider struct {
+	config FieldProviderConfig
+}
+
+func NewFieldProvider(config FieldProviderConfig) (*FieldProvider, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("provider[%v] has no path", config.Name)
+	}
+
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("provider[%v] has no fields", config.Name)
+	}
+
+	for bodyField, loginField := range config.Fields {
+		switch loginField {
+		case TokenField, AccountField, DeviceIdField:
+		default:
+			return nil, fmt.Errorf("provider[%v] body field[%v] maps to unknown login field[%v]", config.Name, bodyField, loginField)
+		}
+	}
+
+	return &FieldProvider{config: config}, nil
+}
+
+func (p *FieldProvider) Name() string {
+	return p.config.Name
+}
+
+func (p *FieldProvider) Path() string {
+	return p.config.Path
+}
+
+func (p *FieldProvider) MarshalRequest(loginData *msg.LoginClientEvent) ([]byte, error) {
+	body := make(map[string]string, len(p.config.Fields))
+	for bodyField, loginField := range p.config.Fields {
+		var value string
+		switch loginField {
+		case TokenField:
+			value = loginData.Token
+		case AccountField:
+			value = loginData.Account
+		case DeviceIdField:
+			value = loginData.DeviceId
+		}
+
+		if value == "" {
+			return nil, fmt.Errorf("%w %v", ErrMissingField, loginField)
+		}
+		body[bodyField] = value
+	}
+
+	return json.Marshal(body)
+}
+
+func (p *FieldProvider) ParseResponse(body []byte) (string, error) {
+	authData := &struct {
+		Data struct {
+			Jwt string `json:"jwt"`
+		} `json:"data"`
+	}{}
+
+	if err := json.Unmarshal(body, authData); err != nil {
+		return "", err
+	}
+
+	return authData.Data.Jwt, nil
+}
@@ -0,0 +1,115 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"reflect"
+	"testing"
+)
+
+func TestFieldProviderMarshalRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fields    map[string]string
+		loginData *msg.LoginClientEvent
+		body      map[string]string
+		err       error
+	}{
+		{
+			name:      "token",
+			fields:    map[string]string{"accessToken": TokenField},
+			loginData: &msg.LoginClientEvent{Token: "abc", DeviceId: "device"},
+			body:      map[string]string{"accessToken": "abc"},
+		},
+		{
+			// Used to break json built with fmt.Sprintf.
+			name:      "quotes and backslashes",
+			fields:    map[string]string{"token": TokenField},
+			loginData: &msg.LoginClientEvent{Token: `a"b\c","admin":"true`},
+			body:      map[string]string{"token": `a"b\c","admin":"true`},
+		},
+		{
+			name:      "several fields",
+			fields:    map[string]string{"email": AccountField, "otp": TokenField, "device": DeviceIdField},
+			loginData: &msg.LoginClientEvent{Token: "123456", Account: "player@example.com", DeviceId: "device"},
+			body:      map[string]string{"email": "player@example.com", "otp": "123456", "device": "device"},
+		},
+		{
+			name:      "missing field",
+			fields:    map[string]string{"email": AccountField, "otp": TokenField},
+			loginData: &msg.LoginClientEvent{Token: "123456"},
+			err:       ErrMissingField,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, err := NewFieldProvider(FieldProviderConfig{Name: "test", Path: "/test", Fields: tc.fields})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := provider.MarshalRequest(tc.loginData)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Fatalf("invalid json %s %v", data, err)
+			}
+			if !reflect.DeepEqual(body, tc.body) {
+				t.Fatalf("body %v, want %v", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestFieldProviderParseResponse(t *testing.T) {
+	provider, err := NewFieldProvider(defaultProviderConfigs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		jwt     string
+		isError bool
+	}{
+		{name: "jwt", body: `{"data":{"jwt":"header.claims.signature"},"message":"ok"}`, jwt: "header.claims.signature"},
+		{name: "no jwt", body: `{"data":{}}`, jwt: ""},
+		{name: "not json", body: `<html>Bad Gateway</html>`, isError: true},
+		{name: "truncated", body: `{"data":{"jwt":"abc`, isError: true},
+		{name: "jwt not a string", body: `{"data":{"jwt":1}}`, isError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jwt, err := provider.ParseResponse([]byte(tc.body))
+			if (err != nil) != tc.isError {
+				t.Fatalf("err[%v], want error[%v]", err, tc.isError)
+			}
+			if jwt != tc.jwt {
+				t.Fatalf("jwt[%v], want [%v]", jwt, tc.jwt)
+			}
+		})
+	}
+}
+
+func TestNewFieldProviderInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config FieldProviderConfig
+	}{
+		{name: "no path", config: FieldProviderConfig{Name: "test", Fields: map[string]string{"token": TokenField}}},
+		{name: "no fields", config: FieldProviderConfig{Name: "test", Path: "/test"}},
+		{name: "unknown login field", config: FieldProviderConfig{Name: "test", Path: "/test", Fields: map[string]string{"token": "password"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewFieldProvider(tc.config); err == nil {
+				t.Fatalf("no error for config %+v", tc.config)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package login
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var ErrInvalidProvidersFile = errors.New("invalid login providers file")
+
+// Providers that main server supports out of the box. Can be
+// overridden or extended by providers file.
+var defaultProviderConfigs = []FieldProviderConfig{
+	{Type: msg.FacebookLogin, Name: "facebook", Path: "/facebook", Fields: map[string]string{"token": TokenField}},
+	{Type: msg.GoogleLogin, Name: "google", Path: "/google", Fields: map[string]string{"token": TokenField}},
+	{Type: msg.AppleLogin, Name: "apple", Path: "/apple", Fields: map[string]string{"accessToken": TokenField}},
+	{Type: msg.LineLogin, Name: "line", Path: "/line", Fields: map[string]string{"accessToken": TokenField}},
+	{Type: msg.DeviceLogin, Name: "device", Path: "/device", Fields: map[string]string{"uniqueId": TokenField}},
+}
+
+// Registry of login providers. Key value: login type -> provider.
+// Providers are only registered during setup, so no lock is needed.
+type Registry struct {
+	providers map[msg.LoginTypeCode]Provider
+
+	logger *zap.SugaredLogger
+}
+
+func ProvideRegistry(config *config.Config, loggerFactory *infra.LoggerFactory) (*Registry, error) {
+	registry := &Registry{
+		providers: make(map[msg.LoginTypeCode]Provider),
+		logger:    loggerFactory.Create("LoginRegistry").Sugar(),
+	}
+
+	providerConfigs := defaultProviderConfigs
+	if *config.LoginProvidersFile != "" {
+		fileConfigs, err := loadProviderConfigs(*config.LoginProvidersFile)
+		if err != nil {
+			registry.logger.Errorf("cannot load login providers file[%v] %v", *config.LoginProvidersFile, err)
+			return nil, err
+		}
+		providerConfigs = append(providerConfigs, fileConfigs...)
+	}
+
+	for _, providerConfig := range providerConfigs {
+		provider, err := NewFieldProvider(providerConfig)
+		if err != nil {
+			registry.logger.Errorf("invalid login provider %v", err)
+			return nil, err
+		}
+		registry.Register(providerConfig.Type, provider)
+	}
+
+	return registry, nil
+}
+
+// Register provider for the login type. Replace existing one if any.
+func (r *Registry) Register(loginType msg.LoginTypeCode, provider Provider) {
+	if existing, ok := r.providers[loginType]; ok {
+		r.logger.Infof("replace login provider[%v] with [%v] for type[%v]", existing.Name(), provider.Name(), loginType)
+	}
+	r.providers[loginType] = provider
+}
+
+func (r *Registry) Get(loginType msg.LoginTypeCode) (Provider, bool) {
+	provider, ok := r.providers[loginType]
+	return provider, ok
+}
+
+// Entry of providers file. Type is a pointer so that a missing one is
+// not taken for FacebookLogin.
+type providerFileEntry struct {
+	Type *msg.LoginTypeCode `json:"type"`
+
+	Name string `json:"name"`
+
+	Path string `json:"path"`
+
+	Fields map[string]string `json:"fields"`
+}
+
+// Providers file is a json array of FieldProviderConfig. Every entry
+// needs type, name and path, and types must be unique.
+func loadProviderConfigs(path string) ([]FieldProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var entries []providerFileEntry
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%w cannot parse json %v", ErrInvalidProvidersFile, err)
+	}
+
+	providerConfigs := make([]FieldProviderConfig, 0, len(entries))
+	types := make(map[msg.LoginTypeCode]string, len(entries))
+	for i, entry := range entries {
+		if entry.Type == nil || entry.Name == "" || entry.Path == "" {
+			return nil, fmt.Errorf("%w entry[%v] needs type, name and path", ErrInvalidProvidersFile, i)
+		}
+
+		if name, ok := types[*entry.Type]; ok {
+			return nil, fmt.Errorf("%w providers[%v] and [%v] have same type[%v]", ErrInvalidProvidersFile, name, entry.Name, *entry.Type)
+		}
+		types[*entry.Type] = entry.Name
+
+		providerConfigs = append(providerConfigs, FieldProviderConfig{
+			Type:   *entry.Type,
+			Name:   entry.Name,
+			Path:   entry.Path,
+			Fields: entry.Fields,
+		})
+	}
+
+	return providerConfigs, nil
+}
@@ -0,0 +1,122 @@
+package login
+
+import (
+	"errors"
+	"flag"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/msg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var testLoggerFactory = func() *infra.LoggerFactory {
+	loggerFactory := infra.ProvideLoggerFactory()
+	loggerFactory.SetLevel("", zapcore.WarnLevel)
+	return loggerFactory
+}()
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+// Write providers file and use it for the test.
+func setProvidersFile(t *testing.T, providers string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "providers.json")
+	if err := os.WriteFile(path, []byte(providers), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "login-providers-file", path)
+}
+
+func TestRegistryBuiltIn(t *testing.T) {
+	registry, err := ProvideRegistry(config.CFG, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for loginType, path := range map[msg.LoginTypeCode]string{
+		msg.FacebookLogin: "/facebook",
+		msg.GoogleLogin:   "/google",
+		msg.AppleLogin:    "/apple",
+		msg.LineLogin:     "/line",
+		msg.DeviceLogin:   "/device",
+	} {
+		if provider, ok := registry.Get(loginType); !ok || provider.Path() != path {
+			t.Fatalf("provider of type[%v] %v, want path[%v]", loginType, provider, path)
+		}
+	}
+
+	// Others are only declared in providers file.
+	if provider, ok := registry.Get(5); ok {
+		t.Fatalf("provider[%v] of undeclared type", provider.Name())
+	}
+}
+
+func TestRegistryProvidersFile(t *testing.T) {
+	setProvidersFile(t, `[
+		{"type": 7, "name": "email", "path": "/email", "fields": {"email": "account", "otp": "token"}},
+		{"type": 4, "name": "device-v2", "path": "/device/v2", "fields": {"deviceId": "deviceId"}}
+	]`)
+
+	registry, err := ProvideRegistry(config.CFG, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provider, ok := registry.Get(7); !ok || provider.Path() != "/email" {
+		t.Fatalf("provider of type[7] %v, want added from file", provider)
+	}
+	if provider, ok := registry.Get(msg.DeviceLogin); !ok || provider.Path() != "/device/v2" {
+		t.Fatalf("provider of type[%v] %v, want replaced by file", msg.DeviceLogin, provider)
+	}
+	if provider, ok := registry.Get(msg.FacebookLogin); !ok || provider.Path() != "/facebook" {
+		t.Fatalf("provider of type[%v] %v, want built-in", msg.FacebookLogin, provider)
+	}
+}
+
+func TestRegistryInvalidProvidersFile(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		providers string
+		err       error
+	}{
+		{name: "not json", providers: `[{"type": 5,`, err: ErrInvalidProvidersFile},
+		{name: "not array", providers: `{"type": 5, "name": "twitch", "path": "/twitch", "fields": {"accessToken": "token"}}`, err: ErrInvalidProvidersFile},
+		{name: "no type", providers: `[{"name": "twitch", "path": "/twitch", "fields": {"accessToken": "token"}}]`, err: ErrInvalidProvidersFile},
+		{name: "no name", providers: `[{"type": 5, "path": "/twitch", "fields": {"accessToken": "token"}}]`, err: ErrInvalidProvidersFile},
+		{name: "no path", providers: `[{"type": 5, "name": "twitch", "fields": {"accessToken": "token"}}]`, err: ErrInvalidProvidersFile},
+		{name: "unknown key", providers: `[{"type": 5, "name": "twitch", "path": "/twitch", "field": {"accessToken": "token"}}]`, err: ErrInvalidProvidersFile},
+		{
+			name: "duplicate type",
+			providers: `[
+				{"type": 5, "name": "twitch", "path": "/twitch", "fields": {"accessToken": "token"}},
+				{"type": 5, "name": "steam", "path": "/steam", "fields": {"ticket": "token"}}
+			]`,
+			err: ErrInvalidProvidersFile,
+		},
+		{name: "no fields", providers: `[{"type": 5, "name": "twitch", "path": "/twitch"}]`},
+		{name: "unknown login field", providers: `[{"type": 5, "name": "twitch", "path": "/twitch", "fields": {"accessToken": "password"}}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setProvidersFile(t, tc.providers)
+
+			_, err := ProvideRegistry(config.CFG, testLoggerFactory)
+			if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+				t.Fatalf("err[%v], want [%v]", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package mainserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of main server api that queue server calls.
+const (
+	RoomSessionPath = "/api/room/session"
+	UserSessionPath = "/api/user/session"
+	OnlineUsersPath = "/queue/online-users"
+
+	// Prefix of login and credential validation of every provider.
+	AuthorizationPath = "/api/user/authorization"
+)
+
+// Scripted response of one request.
+type Response struct {
+	// Zero means 200.
+	StatusCode int
+
+	// Marshaled to json. Nil means the body fake server gives from its
+	// state.
+	Body any
+
+	// Wait before responding.
+	Latency time.Duration
+
+	// Close connection without responding, like a network failure.
+	Drop bool
+}
+
+// Request received by fake server, recorded for assertions.
+type Request struct {
+	Method string
+
+	Path string
+
+	Header http.Header
+
+	Body []byte
+}
+
+// In-process main server for tests. It keeps sessions and online users
+// like the real one, and responses of each path can be scripted to
+// simulate latency and failures.
+type Fake struct {
+	// Base url, used as main server host.
+	URL string
+
+	server *httptest.Server
+
+	onlineUsers uint
+
+	// Key value: jwt -> room id.
+	roomSessions map[string]string
+
+	// Key value: jwt -> last heartbeat time.
+	userSessions map[string]time.Time
+
+	// Responses used one by one before falling back to defaults.
+	// Key value: path -> responses.
+	scripts map[string][]*Response
+
+	// Response of every request after scripts run out. Key value:
+	// path -> response.
+	defaults map[string]*Response
+
+	requests []*Request
+
+	// Number of successful logins, used for issuing jwt.
+	logins int
+
+	// Lock for protecting all of above except URL and server.
+	mux sync.Mutex
+}
+
+func NewFake() *Fake {
+	f := &Fake{
+		roomSessions: make(map[string]string),
+		userSessions: make(map[string]time.Time),
+		scripts:      make(map[string][]*Response),
+		defaults:     make(map[string]*Response),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	f.URL = f.server.URL
+	return f
+}
+
+func (f *Fake) Close() {
+	f.server.Close()
+}
+
+func (f *Fake) SetOnlineUsers(onlineUsers uint) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.onlineUsers = onlineUsers
+}
+
+// Client with jwt is playing in a room. Empty room id removes the
+// session.
+func (f *Fake) SetRoomSession(jwt string, roomId string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if roomId == "" {
+		delete(f.roomSessions, jwt)
+		return
+	}
+	f.roomSessions[jwt] = roomId
+}
+
+// Client with jwt has logged in and last sent heartbeat at
+// lastHeartbeat. Zero time removes the session.
+func (f *Fake) SetUserSession(jwt string, lastHeartbeat time.Time) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if lastHeartbeat.IsZero() {
+		delete(f.userSessions, jwt)
+		return
+	}
+	f.userSessions[jwt] = lastHeartbeat
+}
+
+// Respond the next requests of path with responses in order. Path of
+// authorization api is AuthorizationPath for all providers.
+func (f *Fake) Script(path string, responses ...*Response) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.scripts[path] = append(f.scripts[path], responses...)
+}
+
+// Respond every request of path with response after scripts run out,
+// eg. 503 for maintenance. Nil goes back to responding from state.
+func (f *Fake) SetDefault(path string, response *Response) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if response == nil {
+		delete(f.defaults, path)
+		return
+	}
+	f.defaults[path] = response
+}
+
+// Requests received on path so far, oldest first.
+func (f *Fake) Requests(path string) []*Request {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	var requests []*Request
+	for _, request := range f.requests {
+		if routeOf(request.Path) == path {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func routeOf(path string) string {
+	if strings.HasPrefix(path, AuthorizationPath+"/") {
+		return AuthorizationPath
+	}
+	return path
+}
+
+func (f *Fake) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	route := routeOf(r.URL.Path)
+	response := f.record(route, &Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+
+	if response.Latency > 0 {
+		select {
+		case <-time.After(response.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if response.Drop {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	responseBody := response.Body
+	if responseBody == nil {
+		responseBody, statusCode = f.respond(route, r, statusCode)
+	}
+	if responseBody == nil {
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(responseBody)
+}
+
+// Record request and pick its response. Response without body is
+// responded from state.
+func (f *Fake) record(route string, request *Request) *Response {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.requests = append(f.requests, request)
+
+	if scripted := f.scripts[route]; len(scripted) > 0 {
+		f.scripts[route] = scripted[1:]
+		return scripted[0]
+	}
+	if response, ok := f.defaults[route]; ok {
+		return response
+	}
+	return &Response{}
+}
+
+// Body of response from state, same format as the real main server.
+// Body of error responses is nil.
+func (f *Fake) respond(route string, r *http.Request, statusCode int) (any, int) {
+	if statusCode < http.StatusOK || statusCode >= http.StatusMultipleChoices {
+		return nil, statusCode
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	type data map[string]any
+
+	switch route {
+	case OnlineUsersPath:
+		return data{"data": data{
+			"onlineUsers": strconv.Itoa(int(f.onlineUsers)),
+			"playingAis":  "0",
+		}}, statusCode
+
+	case RoomSessionPath:
+		roomId, ok := f.roomSessions[r.Header.Get("jwt")]
+		return data{"data": data{
+			"isInRoom": ok,
+			"roomId":   roomId,
+		}}, statusCode
+
+	case UserSessionPath:
+		lastHeartbeat, ok := f.userSessions[r.Header.Get("jwt")]
+		if !ok {
+			return nil, http.StatusNotFound
+		}
+		return data{"data": data{
+			"jwt":           r.Header.Get("jwt"),
+			"lastHeartbeat": lastHeartbeat.Format(time.RFC3339),
+		}}, statusCode
+
+	case AuthorizationPath:
+		if r.Method != http.MethodPost {
+			return nil, http.StatusMethodNotAllowed
+		}
+		f.logins++
+		return data{"data": data{
+			"jwt": fmt.Sprintf("jwt-%v", f.logins),
+		}}, statusCode
+
+	default:
+		return nil, http.StatusNotFound
+	}
+}
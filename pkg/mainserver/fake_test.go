@@ -0,0 +1,213 @@
+package mainserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake closed on cleanup.
+func newTestFake(t *testing.T) *Fake {
+	t.Helper()
+
+	fake := NewFake()
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// Request path of fake with jwt header, and decode the json body if
+// any into result.
+func request(t *testing.T, fake *Fake, method string, path string, jwt string, body string, result any) int {
+	t.Helper()
+
+	httpRequest, err := http.NewRequest(method, fake.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwt != "" {
+		httpRequest.Header.Set("jwt", jwt)
+	}
+
+	resp, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		t.Fatalf("cannot request %v %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			t.Fatalf("invalid json %s %v", data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type onlineUsersResult struct {
+	Data struct {
+		OnlineUsers string `json:"onlineUsers"`
+	} `json:"data"`
+}
+
+type jwtResult struct {
+	Data struct {
+		Jwt string `json:"jwt"`
+	} `json:"data"`
+}
+
+func TestFakeOnlineUsers(t *testing.T) {
+	fake := newTestFake(t)
+
+	for onlineUsers, want := range map[uint]string{0: "0", 4990: "4990"} {
+		fake.SetOnlineUsers(onlineUsers)
+
+		result := &onlineUsersResult{}
+		if statusCode := request(t, fake, http.MethodGet, OnlineUsersPath, "", "", result); statusCode != http.StatusOK {
+			t.Fatalf("status code[%v], want [%v]", statusCode, http.StatusOK)
+		}
+		if result.Data.OnlineUsers != want {
+			t.Fatalf("onlineUsers[%v], want [%v]", result.Data.OnlineUsers, want)
+		}
+	}
+}
+
+func TestFakeAuthorization(t *testing.T) {
+	fake := newTestFake(t)
+
+	// Every provider path, each login gets its own jwt.
+	jwts := make(map[string]bool)
+	for _, provider := range []string{"/facebook", "/device", "/email"} {
+		result := &jwtResult{}
+		body := `{"token":"abc"}`
+		if statusCode := request(t, fake, http.MethodPost, AuthorizationPath+provider, "", body, result); statusCode != http.StatusOK {
+			t.Fatalf("status code[%v] of [%v], want [%v]", statusCode, provider, http.StatusOK)
+		}
+		if result.Data.Jwt == "" || jwts[result.Data.Jwt] {
+			t.Fatalf("jwt[%v] of [%v], want a new one", result.Data.Jwt, provider)
+		}
+		jwts[result.Data.Jwt] = true
+	}
+
+	if statusCode := request(t, fake, http.MethodGet, AuthorizationPath+"/device", "", "", nil); statusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status code[%v] of get, want [%v]", statusCode, http.StatusMethodNotAllowed)
+	}
+
+	requests := fake.Requests(AuthorizationPath)
+	if len(requests) != 4 || requests[0].Path != AuthorizationPath+"/facebook" || string(requests[0].Body) != `{"token":"abc"}` {
+		t.Fatalf("recorded [%v] requests, want 4 of authorization with body", len(requests))
+	}
+	if len(fake.Requests(OnlineUsersPath)) != 0 {
+		t.Fatalf("recorded requests of other path")
+	}
+}
+
+func TestFakeSessions(t *testing.T) {
+	fake := newTestFake(t)
+	lastHeartbeat := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake.SetRoomSession("jwt-playing", "room-1")
+	fake.SetUserSession("jwt-playing", lastHeartbeat)
+
+	room := &struct {
+		Data struct {
+			IsInRoom bool   `json:"isInRoom"`
+			RoomId   string `json:"roomId"`
+		} `json:"data"`
+	}{}
+	request(t, fake, http.MethodGet, RoomSessionPath, "jwt-playing", "", room)
+	if !room.Data.IsInRoom || room.Data.RoomId != "room-1" {
+		t.Fatalf("room session %+v, want in room-1", room.Data)
+	}
+
+	user := &struct {
+		Data struct {
+			LastHeartbeat time.Time `json:"lastHeartbeat"`
+		} `json:"data"`
+	}{}
+	if statusCode := request(t, fake, http.MethodGet, UserSessionPath, "jwt-playing", "", user); statusCode != http.StatusOK || !user.Data.LastHeartbeat.Equal(lastHeartbeat) {
+		t.Fatalf("status code[%v] lastHeartbeat[%v], want [%v]", statusCode, user.Data.LastHeartbeat, lastHeartbeat)
+	}
+
+	// Removed sessions.
+	fake.SetRoomSession("jwt-playing", "")
+	fake.SetUserSession("jwt-playing", time.Time{})
+	room.Data.IsInRoom = true
+	request(t, fake, http.MethodGet, RoomSessionPath, "jwt-playing", "", room)
+	if room.Data.IsInRoom {
+		t.Fatalf("still in room after session removed")
+	}
+	if statusCode := request(t, fake, http.MethodGet, UserSessionPath, "jwt-playing", "", nil); statusCode != http.StatusNotFound {
+		t.Fatalf("status code[%v] without user session, want [%v]", statusCode, http.StatusNotFound)
+	}
+
+	if statusCode := request(t, fake, http.MethodGet, "/api/unknown", "", "", nil); statusCode != http.StatusNotFound {
+		t.Fatalf("status code[%v] of unknown path, want [%v]", statusCode, http.StatusNotFound)
+	}
+}
+
+func TestFakeScript(t *testing.T) {
+	fake := newTestFake(t)
+	fake.SetOnlineUsers(100)
+
+	fake.Script(OnlineUsersPath,
+		&Response{StatusCode: http.StatusBadGateway},
+		&Response{Body: map[string]any{"data": map[string]any{"onlineUsers": "7"}}},
+	)
+	fake.SetDefault(OnlineUsersPath, &Response{StatusCode: http.StatusServiceUnavailable})
+
+	// Scripts in order, then default, then state again after default
+	// is removed.
+	for i, want := range []struct {
+		statusCode  int
+		onlineUsers string
+	}{
+		{statusCode: http.StatusBadGateway},
+		{statusCode: http.StatusOK, onlineUsers: "7"},
+		{statusCode: http.StatusServiceUnavailable},
+		{statusCode: http.StatusServiceUnavailable},
+	} {
+		result := &onlineUsersResult{}
+		if statusCode := request(t, fake, http.MethodGet, OnlineUsersPath, "", "", result); statusCode != want.statusCode || result.Data.OnlineUsers != want.onlineUsers {
+			t.Fatalf("request[%v] status code[%v] onlineUsers[%v], want [%v] [%v]", i, statusCode, result.Data.OnlineUsers, want.statusCode, want.onlineUsers)
+		}
+	}
+
+	fake.SetDefault(OnlineUsersPath, nil)
+	result := &onlineUsersResult{}
+	if statusCode := request(t, fake, http.MethodGet, OnlineUsersPath, "", "", result); statusCode != http.StatusOK || result.Data.OnlineUsers != "100" {
+		t.Fatalf("status code[%v] onlineUsers[%v], want from state", statusCode, result.Data.OnlineUsers)
+	}
+
+	// Scripts of authorization apply to every provider.
+	fake.Script(AuthorizationPath, &Response{StatusCode: http.StatusUnauthorized})
+	if statusCode := request(t, fake, http.MethodPost, AuthorizationPath+"/google", "", "{}", nil); statusCode != http.StatusUnauthorized {
+		t.Fatalf("status code[%v] of scripted login, want [%v]", statusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestFakeLatencyAndDrop(t *testing.T) {
+	fake := newTestFake(t)
+	fake.Script(AuthorizationPath,
+		&Response{Latency: 100 * time.Millisecond},
+		&Response{Drop: true},
+	)
+
+	start := time.Now()
+	if statusCode := request(t, fake, http.MethodPost, AuthorizationPath+"/device", "", "{}", nil); statusCode != http.StatusOK {
+		t.Fatalf("status code[%v], want [%v]", statusCode, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("responded after [%v], want latency", elapsed)
+	}
+
+	resp, err := http.Post(fake.URL+AuthorizationPath+"/device", "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("status code[%v] of dropped request, want network error", resp.StatusCode)
+	}
+}
@@ -0,0 +1,136 @@
+package msg
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Wire format of WsMessage, negotiated as websocket subprotocol of the
+// same name. Event data is kept as json in memory and converted by
+// binary codecs.
+type Codec interface {
+	Name() string
+
+	// Whether messages are sent as binary frames, otherwise text.
+	IsBinary() bool
+
+	Marshal(wsMessage *WsMessage) ([]byte, error)
+
+	Unmarshal(data []byte, wsMessage *WsMessage) error
+}
+
+var (
+	// Default for clients that don't ask for a subprotocol.
+	JsonCodec Codec = jsonCodec{}
+
+	MsgpackCodec Codec = msgpackCodec{}
+
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+// Supported codecs in the order server prefers when client offers
+// more than one.
+var Codecs = []Codec{MsgpackCodec, ProtobufCodec, JsonCodec}
+
+func CodecNames() []string {
+	names := make([]string, 0, len(Codecs))
+	for _, codec := range Codecs {
+		names = append(names, codec.Name())
+	}
+	return names
+}
+
+// Codec of the negotiated subprotocol. Json if none is negotiated.
+func CodecOf(subprotocol string) Codec {
+	for _, codec := range Codecs {
+		if codec.Name() == subprotocol {
+			return codec
+		}
+	}
+	return JsonCodec
+}
+
+// Marshal wsMessage with codec. Shared messages are marshalled once
+// per codec.
+func Encode(codec Codec, wsMessage *WsMessage) ([]byte, error) {
+	if wsMessage.encodings == nil {
+		return codec.Marshal(wsMessage)
+	}
+
+	wsMessage.encodings.mux.Lock()
+	defer wsMessage.encodings.mux.Unlock()
+
+	return wsMessage.encodings.encode(codec, wsMessage)
+}
+
+// Websocket frames of a shared message encoded with codec, written to
+// every connection by WritePreparedMessage without encoding or
+// compressing again. Nil if message is not shared, since preparing
+// costs more than writing it once.
+func Prepare(codec Codec, wsMessage *WsMessage) (*websocket.PreparedMessage, error) {
+	if wsMessage.encodings == nil {
+		return nil, nil
+	}
+
+	wsMessage.encodings.mux.Lock()
+	defer wsMessage.encodings.mux.Unlock()
+
+	if prepared, ok := wsMessage.encodings.prepared[codec.Name()]; ok {
+		return prepared, nil
+	}
+
+	data, err := wsMessage.encodings.encode(codec, wsMessage)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(MessageType(codec), data)
+	if err != nil {
+		return nil, err
+	}
+	wsMessage.encodings.prepared[codec.Name()] = prepared
+	return prepared, nil
+}
+
+// Websocket message type of codec.
+func MessageType(codec Codec) int {
+	if codec.IsBinary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// Must hold mux.
+func (e *encodings) encode(codec Codec, wsMessage *WsMessage) ([]byte, error) {
+	if data, ok := e.byCodec[codec.Name()]; ok {
+		return data, nil
+	}
+
+	data, err := codec.Marshal(wsMessage)
+	if err != nil {
+		return nil, err
+	}
+	e.byCodec[codec.Name()] = data
+	return data, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) IsBinary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(wsMessage *WsMessage) ([]byte, error) {
+	return json.Marshal(wsMessage)
+}
+
+func (jsonCodec) Unmarshal(data []byte, wsMessage *WsMessage) error {
+	return json.Unmarshal(data, wsMessage)
+}
@@ -7,6 +7,11 @@ const (
 	LoginCode       EventCode = 1001
 	QueueStatsCode  EventCode = 1002
 	TicketCode      EventCode = 1003
+	ErrorCode       EventCode = 1004
+	ChallengeCode   EventCode = 1005
+
+	CredentialExpiredCode EventCode = 1006
+	UpdateRequiredCode    EventCode = 1007
 )
 
 type LoginTypeCode uint
@@ -19,6 +24,37 @@ const (
 	DeviceLogin   LoginTypeCode = 4
 )
 
+// Starts from 1, so that an unset reason is not taken for one.
+type ErrorReasonCode uint
+
+const (
+	// Device has reached the max number of tickets it can hold.
+	TooManyTicketsReason ErrorReasonCode = 1
+
+	// Challenge solution is wrong. A new challenge will be sent.
+	ChallengeFailedReason ErrorReasonCode = 2
+
+	// Client sends too many messages. Further messages will be
+	// dropped and client will be disconnected if it keeps sending.
+	RateLimitedReason ErrorReasonCode = 3
+
+	// Login credential is invalid or expired. Client should get a new
+	// credential and send login request again.
+	InvalidCredentialReason ErrorReasonCode = 4
+
+	// Login failed due to network or main server error after
+	// retrying. Ticket is put back to the front of queue.
+	LoginFailedReason ErrorReasonCode = 5
+
+	// Login rejected by main server. Client should check its
+	// credential and send login request again.
+	LoginRejectedReason ErrorReasonCode = 6
+
+	// Main server is under maintenance. Ticket is put back to the
+	// front of queue.
+	MaintenanceReason ErrorReasonCode = 7
+)
+
 type ShouldQueueEvent struct {
 	ShouldQueue bool `json:"shouldQueue"`
 }
@@ -26,6 +62,7 @@ type ShouldQueueEvent struct {
 type LoginClientEvent struct {
 	Type      LoginTypeCode `json:"type"`
 	Token     string        `json:"token"`
+	Account   string        `json:"account"`
 	DeviceId  string        `json:"deviceId"`
 	SessionId string        `json:"sessionId"`
 }
@@ -45,3 +82,33 @@ type TicketServerEvent struct {
 	TicketId string `json:"ticketId"`
 	Position int32  `json:"position"`
 }
+
+type ErrorServerEvent struct {
+	Reason  ErrorReasonCode `json:"reason"`
+	Message string          `json:"message"`
+}
+
+type ChallengeServerEvent struct {
+	Type       string `json:"type"`
+	Seed       string `json:"seed"`
+	Difficulty uint   `json:"difficulty"`
+}
+
+type ChallengeClientEvent struct {
+	Solution string `json:"solution"`
+}
+
+type CredentialExpiredServerEvent struct {
+	Type LoginTypeCode `json:"type"`
+}
+
+type UpdateRequiredServerEvent struct {
+	// Client must update to connect, otherwise it's a suggestion.
+	IsForced bool `json:"isForced"`
+
+	MinVersion    ProtocolVersion `json:"minVersion"`
+	LatestVersion ProtocolVersion `json:"latestVersion"`
+
+	// App store link of client's platform. Empty if not configured.
+	StoreUrl string `json:"storeUrl"`
+}
@@ -1,8 +1,53 @@
 package msg
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
 
 type WsMessage struct {
 	EventCode EventCode       `json:"eventCode"`
 	EventData json.RawMessage `json:"eventData"`
+
+	// Encoded message by codec name. Only set on messages shared by
+	// many clients, so that each codec encodes it once.
+	encodings *encodings
+
+	// Sent to clients of every protocol version and capabilities.
+	isVersionless bool
+}
+
+type encodings struct {
+	byCodec map[string][]byte
+
+	// Websocket frames by codec name. Each is compressed at most once
+	// per compression level, on demand.
+	prepared map[string]*websocket.PreparedMessage
+
+	mux sync.Mutex
+}
+
+// Message broadcast to many clients, eg. queue stats.
+func NewSharedMessage(eventCode EventCode, eventData json.RawMessage) *WsMessage {
+	return &WsMessage{
+		EventCode: eventCode,
+		EventData: eventData,
+		encodings: &encodings{
+			byCodec:  make(map[string][]byte),
+			prepared: make(map[string]*websocket.PreparedMessage),
+		},
+	}
+}
+
+// Message sent even to clients whose protocol doesn't have the event,
+// eg. asking outdated clients to update. Clients ignore event codes
+// they don't know.
+func NewVersionlessMessage(eventCode EventCode, eventData json.RawMessage) *WsMessage {
+	return &WsMessage{
+		EventCode:     eventCode,
+		EventData:     eventData,
+		isVersionless: true,
+	}
 }
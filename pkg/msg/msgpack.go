@@ -0,0 +1,88 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// WsMessage as a msgpack map of eventCode and eventData, with event
+// data converted from json to the equivalent msgpack value.
+type msgpackCodec struct{}
+
+type msgpackMessage struct {
+	// Pointer so that a missing event code is told from zero.
+	EventCode *int64 `msgpack:"eventCode"`
+
+	EventData any `msgpack:"eventData"`
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) IsBinary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(wsMessage *WsMessage) ([]byte, error) {
+	var eventData any
+	if len(wsMessage.EventData) > 0 {
+		if err := json.Unmarshal(wsMessage.EventData, &eventData); err != nil {
+			return nil, err
+		}
+	}
+
+	eventCode := int64(wsMessage.EventCode)
+
+	// Json numbers are decoded as float64, which hold every number of
+	// the events exactly. Whole ones are sent as integers as before.
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.UseCompactInts(true)
+	encoder.UseCompactFloats(true)
+	encoder.SetSortMapKeys(true)
+	if err := encoder.Encode(&msgpackMessage{EventCode: &eventCode, EventData: eventData}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, wsMessage *WsMessage) error {
+	reader := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(reader)
+
+	// Structs are also decoded from arrays, which clients must not send.
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return fmt.Errorf("%w %v", ErrInvalidMessage, err)
+	}
+	if !msgpcode.IsFixedMap(code) && code != msgpcode.Map16 && code != msgpcode.Map32 {
+		return fmt.Errorf("%w msgpack message is not a map", ErrInvalidMessage)
+	}
+
+	message := &msgpackMessage{}
+	if err := decoder.Decode(message); err != nil {
+		return fmt.Errorf("%w %v", ErrInvalidMessage, err)
+	}
+	if reader.Len() > 0 {
+		return fmt.Errorf("%w trailing bytes after msgpack value", ErrInvalidMessage)
+	}
+
+	if message.EventCode == nil || *message.EventCode < 0 {
+		return fmt.Errorf("%w eventCode is missing or negative", ErrInvalidMessage)
+	}
+
+	// Fails on maps with non-string keys, which json can't hold.
+	eventData, err := json.Marshal(message.EventData)
+	if err != nil {
+		return fmt.Errorf("%w %v", ErrInvalidMessage, err)
+	}
+
+	wsMessage.EventCode = EventCode(*message.EventCode)
+	wsMessage.EventData = eventData
+	return nil
+}
@@ -0,0 +1,146 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encode value as msgpack as a client would.
+func encodeMsgpack(t testing.TB, value any) []byte {
+	t.Helper()
+
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Whether both are the same json value, regardless of key order.
+func isSameJson(t testing.TB, a []byte, b []byte) bool {
+	t.Helper()
+
+	var valueA, valueB any
+	if err := json.Unmarshal(a, &valueA); err != nil {
+		t.Fatalf("invalid json %s %v", a, err)
+	}
+	if err := json.Unmarshal(b, &valueB); err != nil {
+		t.Fatalf("invalid json %s %v", b, err)
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		eventCode EventCode
+		eventData string
+	}{
+		{name: "ticket", eventCode: TicketCode, eventData: `{"ticketId":"abc","position":12,"waitSeconds":1.5}`},
+		{name: "nested", eventCode: ChallengeCode, eventData: `{"challenge":{"type":"pow","difficulty":20,"nonces":[1,-2,3.25]},"isRequired":true,"reason":null}`},
+		{name: "large numbers", eventCode: QueueStatsCode, eventData: `{"max":9007199254740992,"min":-9007199254740992}`},
+		{name: "empty", eventCode: ErrorCode, eventData: `{}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := MsgpackCodec.Marshal(&WsMessage{EventCode: tc.eventCode, EventData: json.RawMessage(tc.eventData)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wsMessage := &WsMessage{}
+			if err := MsgpackCodec.Unmarshal(data, wsMessage); err != nil {
+				t.Fatal(err)
+			}
+			if wsMessage.EventCode != tc.eventCode || !isSameJson(t, wsMessage.EventData, []byte(tc.eventData)) {
+				t.Fatalf("decoded [%v] %s, want [%v] %s", wsMessage.EventCode, wsMessage.EventData, tc.eventCode, tc.eventData)
+			}
+		})
+	}
+}
+
+func TestMsgpackWireFormat(t *testing.T) {
+	data, err := MsgpackCodec.Marshal(&WsMessage{EventCode: TicketCode, EventData: json.RawMessage(`{"position":12,"ticketId":"abc"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain map of compact values, readable by any msgpack library.
+	var decoded map[string]any
+	if err := msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"eventCode": uint16(TicketCode),
+		"eventData": map[string]any{"position": int8(12), "ticketId": "abc"},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Fatalf("decoded %#v, want %#v", decoded, want)
+	}
+
+	// Keys are sorted so same message is encoded the same.
+	again, err := MsgpackCodec.Marshal(&WsMessage{EventCode: TicketCode, EventData: json.RawMessage(`{"ticketId":"abc","position":12}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Fatalf("encoded % x and % x of same message", data, again)
+	}
+}
+
+func TestMsgpackInvalid(t *testing.T) {
+	valid := encodeMsgpack(t, map[string]any{"eventCode": 1, "eventData": map[string]any{}})
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "truncated", data: valid[:len(valid)-1]},
+		{name: "trailing bytes", data: append(append([]byte{}, valid...), 0xc0)},
+		{name: "not a map", data: encodeMsgpack(t, []int{1, 2})},
+		{name: "missing event code", data: encodeMsgpack(t, map[string]any{"eventData": map[string]any{}})},
+		{name: "negative event code", data: encodeMsgpack(t, map[string]any{"eventCode": -1})},
+		{name: "string event code", data: encodeMsgpack(t, map[string]any{"eventCode": "1"})},
+		{name: "non-string key in event data", data: encodeMsgpack(t, map[string]any{"eventCode": 1, "eventData": map[int]any{1: "a"}})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := MsgpackCodec.Unmarshal(tc.data, &WsMessage{}); !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("err[%v], want [%v]", err, ErrInvalidMessage)
+			}
+		})
+	}
+}
+
+func FuzzMsgpack(f *testing.F) {
+	f.Add(encodeMsgpack(f, map[string]any{"eventCode": 1, "eventData": map[string]any{"ticketId": "abc"}}))
+	f.Add(encodeMsgpack(f, map[string]any{"eventCode": 2, "eventData": []any{1.5, nil, true}}))
+	f.Add([]byte{0x81, 0xa9})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		wsMessage := &WsMessage{}
+		if err := MsgpackCodec.Unmarshal(data, wsMessage); err != nil {
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("err[%v], want [%v]", err, ErrInvalidMessage)
+			}
+			return
+		}
+
+		// Whatever is accepted encodes back to the same message.
+		encoded, err := MsgpackCodec.Marshal(wsMessage)
+		if err != nil {
+			t.Fatalf("cannot encode accepted message %v", err)
+		}
+		again := &WsMessage{}
+		if err := MsgpackCodec.Unmarshal(encoded, again); err != nil {
+			t.Fatalf("cannot decode encoded message %v", err)
+		}
+		if again.EventCode != wsMessage.EventCode || !isSameJson(t, again.EventData, wsMessage.EventData) {
+			t.Fatalf("decoded [%v] %s, want [%v] %s", again.EventCode, again.EventData, wsMessage.EventCode, wsMessage.EventData)
+		}
+	})
+}
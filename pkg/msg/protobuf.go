@@ -0,0 +1,107 @@
+package msg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Field numbers of the protobuf WsMessage.
+const (
+	protobufEventCodeField protowire.Number = 1
+	protobufEventDataField protowire.Number = 2
+)
+
+// WsMessage as protobuf, with event data as the well-known Struct so
+// that no schema is needed per event:
+//
+//	message WsMessage {
+//	  uint32 event_code = 1;
+//	  google.protobuf.Struct event_data = 2;
+//	}
+//
+// Numbers in Struct are doubles, which hold every number of the events
+// exactly.
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) IsBinary() bool {
+	return true
+}
+
+func (protobufCodec) Marshal(wsMessage *WsMessage) ([]byte, error) {
+	data := protowire.AppendTag(nil, protobufEventCodeField, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(wsMessage.EventCode))
+
+	if len(wsMessage.EventData) == 0 {
+		return data, nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(wsMessage.EventData, &fields); err != nil {
+		return nil, err
+	}
+	eventData, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	rawEventData, err := proto.Marshal(eventData)
+	if err != nil {
+		return nil, err
+	}
+
+	data = protowire.AppendTag(data, protobufEventDataField, protowire.BytesType)
+	return protowire.AppendBytes(data, rawEventData), nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, wsMessage *WsMessage) error {
+	eventData := &structpb.Struct{}
+	for len(data) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w %v", ErrInvalidMessage, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case number == protobufEventCodeField && fieldType == protowire.VarintType:
+			eventCode, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return fmt.Errorf("%w %v", ErrInvalidMessage, protowire.ParseError(n))
+			}
+			wsMessage.EventCode = EventCode(eventCode)
+			data = data[n:]
+
+		case number == protobufEventDataField && fieldType == protowire.BytesType:
+			rawEventData, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return fmt.Errorf("%w %v", ErrInvalidMessage, protowire.ParseError(n))
+			}
+			if err := proto.Unmarshal(rawEventData, eventData); err != nil {
+				return fmt.Errorf("%w %v", ErrInvalidMessage, err)
+			}
+			data = data[n:]
+
+		default:
+			// Unknown fields are skipped, like generated code does.
+			n := protowire.ConsumeFieldValue(number, fieldType, data)
+			if n < 0 {
+				return fmt.Errorf("%w %v", ErrInvalidMessage, protowire.ParseError(n))
+			}
+			data = data[n:]
+		}
+	}
+
+	rawEventData, err := json.Marshal(eventData.AsMap())
+	if err != nil {
+		return err
+	}
+	wsMessage.EventData = rawEventData
+	return nil
+}
@@ -0,0 +1,140 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidProtocol = errors.New("invalid protocol")
+
+type ProtocolVersion uint
+
+const (
+	// Protocol before versioning, spoken by clients that don't send
+	// protocolVersion header. Events ShouldQueue, Login, QueueStats and
+	// Ticket.
+	ProtocolV1 ProtocolVersion = 1
+
+	// Adds Error, Challenge, CredentialExpired and UpdateRequired
+	// events, and capabilities.
+	ProtocolV2 ProtocolVersion = 2
+
+	LatestProtocolVersion = ProtocolV2
+)
+
+// Optional feature declared by client. Events of a feature that client
+// doesn't declare are not sent.
+type Capability string
+
+const (
+	// QueueStats events.
+	QueueStatsCapability Capability = "queueStats"
+
+	// CredentialExpired events.
+	CredentialRefreshCapability Capability = "credentialRefresh"
+)
+
+// Capabilities of clients that don't declare any.
+var allCapabilities = []Capability{QueueStatsCapability, CredentialRefreshCapability}
+
+// Capability required to receive an event.
+var eventCapabilities = map[EventCode]Capability{
+	QueueStatsCode:        QueueStatsCapability,
+	CredentialExpiredCode: CredentialRefreshCapability,
+}
+
+// Version that introduced an event. Events not listed are in every
+// version.
+var eventVersions = map[EventCode]ProtocolVersion{
+	ErrorCode:             ProtocolV2,
+	ChallengeCode:         ProtocolV2,
+	CredentialExpiredCode: ProtocolV2,
+	UpdateRequiredCode:    ProtocolV2,
+}
+
+// Convert a message of the latest protocol for clients of an older
+// version. Nil means client can't handle it and message is dropped.
+type Adapter func(wsMessage *WsMessage) *WsMessage
+
+// Adapters by the version they convert to. Versions without one take
+// messages as is.
+var adapters = map[ProtocolVersion]Adapter{
+	ProtocolV1: dropEventsSince(ProtocolV2),
+}
+
+func dropEventsSince(version ProtocolVersion) Adapter {
+	return func(wsMessage *WsMessage) *WsMessage {
+		if since, ok := eventVersions[wsMessage.EventCode]; ok && since >= version {
+			return nil
+		}
+		return wsMessage
+	}
+}
+
+// Protocol a client speaks.
+type Protocol struct {
+	Version ProtocolVersion
+
+	capabilities map[Capability]bool
+}
+
+// Parse protocolVersion and capabilities headers. Missing version means
+// ProtocolV1. Missing capabilities means all of them. Versions newer
+// than the latest are spoken as the latest, unknown capabilities are
+// ignored.
+func ParseProtocol(version string, capabilities string) (*Protocol, error) {
+	protocol := &Protocol{
+		Version:      ProtocolV1,
+		capabilities: make(map[Capability]bool),
+	}
+
+	if version != "" {
+		v, err := strconv.ParseUint(version, 10, 32)
+		if err != nil || v == 0 {
+			return nil, fmt.Errorf("%w version[%v]", ErrInvalidProtocol, version)
+		}
+		protocol.Version = min(ProtocolVersion(v), LatestProtocolVersion)
+	}
+
+	if protocol.Version < ProtocolV2 || capabilities == "" {
+		for _, capability := range allCapabilities {
+			protocol.capabilities[capability] = true
+		}
+		return protocol, nil
+	}
+
+	for _, capability := range strings.Split(capabilities, ",") {
+		protocol.capabilities[Capability(strings.TrimSpace(capability))] = true
+	}
+	return protocol, nil
+}
+
+func (p *Protocol) Has(capability Capability) bool {
+	return p.capabilities[capability]
+}
+
+// Whether client's version has the event, regardless of capabilities.
+func (p *Protocol) Supports(eventCode EventCode) bool {
+	since, ok := eventVersions[eventCode]
+	return !ok || since <= p.Version
+}
+
+// Adapt message of the latest protocol for this client. Nil means the
+// message is not sent. Message is returned as is if unchanged, so that
+// shared messages stay shared. Versionless messages are never adapted.
+func (p *Protocol) Adapt(wsMessage *WsMessage) *WsMessage {
+	if wsMessage.isVersionless {
+		return wsMessage
+	}
+
+	if capability, ok := eventCapabilities[wsMessage.EventCode]; ok && !p.Has(capability) {
+		return nil
+	}
+
+	if adapter, ok := adapters[p.Version]; ok {
+		return adapter(wsMessage)
+	}
+	return wsMessage
+}
@@ -0,0 +1,65 @@
+package msg
+
+import "testing"
+
+func TestAdapt(t *testing.T) {
+	v1, err := ParseProtocol("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := ParseProtocol("2", "credentialRefresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		wsMessage *WsMessage
+		protocol  *Protocol
+		isSent    bool
+	}{
+		{name: "v1 ticket", wsMessage: &WsMessage{EventCode: TicketCode}, protocol: v1, isSent: true},
+		{name: "v1 queue stats", wsMessage: &WsMessage{EventCode: QueueStatsCode}, protocol: v1, isSent: true},
+		{name: "v1 error", wsMessage: &WsMessage{EventCode: ErrorCode}, protocol: v1, isSent: false},
+		{name: "v1 challenge", wsMessage: &WsMessage{EventCode: ChallengeCode}, protocol: v1, isSent: false},
+		{name: "v1 credential expired", wsMessage: &WsMessage{EventCode: CredentialExpiredCode}, protocol: v1, isSent: false},
+		{name: "v1 update required", wsMessage: &WsMessage{EventCode: UpdateRequiredCode}, protocol: v1, isSent: false},
+		{name: "v1 versionless update required", wsMessage: NewVersionlessMessage(UpdateRequiredCode, nil), protocol: v1, isSent: true},
+		{name: "v2 error", wsMessage: &WsMessage{EventCode: ErrorCode}, protocol: v2, isSent: true},
+		{name: "v2 credential expired", wsMessage: &WsMessage{EventCode: CredentialExpiredCode}, protocol: v2, isSent: true},
+		{name: "v2 without queue stats", wsMessage: &WsMessage{EventCode: QueueStatsCode}, protocol: v2, isSent: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			adapted := tc.protocol.Adapt(tc.wsMessage)
+			if isSent := adapted != nil; isSent != tc.isSent {
+				t.Fatalf("sent [%v], want [%v]", isSent, tc.isSent)
+			}
+			if adapted != nil && adapted != tc.wsMessage {
+				t.Fatalf("message changed, want as is")
+			}
+		})
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		version      string
+		capabilities string
+		want         ProtocolVersion
+		isInvalid    bool
+	}{
+		{version: "", want: ProtocolV1},
+		{version: "2", want: ProtocolV2},
+		{version: "99", want: LatestProtocolVersion},
+		{version: "0", isInvalid: true},
+		{version: "latest", isInvalid: true},
+	} {
+		protocol, err := ParseProtocol(tc.version, tc.capabilities)
+		if isInvalid := err != nil; isInvalid != tc.isInvalid {
+			t.Fatalf("version[%v] err[%v], want invalid [%v]", tc.version, err, tc.isInvalid)
+		}
+		if err == nil && protocol.Version != tc.want {
+			t.Fatalf("version[%v] parsed as [%v], want [%v]", tc.version, protocol.Version, tc.want)
+		}
+	}
+}
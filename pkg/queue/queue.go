@@ -10,6 +10,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// Number of ticks a worker can miss before it's viewed as stuck.
+const workerMaxMissedTicks = 3
+
 type Queue struct {
 	// Enter queue request for a ticket from hub.
 	Enter chan TicketId
@@ -18,13 +21,29 @@ type Queue struct {
 	// queue to inactive.
 	Leave chan TicketId
 
-	// Notify hub that a ticket is done queueing.
-	NotifyFinish chan TicketId
+	// Put a dequeued ticket back to the front of queue since its
+	// login failed with a retryable error. Its slot is returned, and
+	// it's not dequeued again until requeue backoff has passed.
+	Requeue chan *Ticket
+
+	// Notify queue that a dequeued ticket failed to login and won't
+	// be put back, so its slot can be returned.
+	Abandon chan *Ticket
+
+	// Notify queue that it switches on or off. Active tickets are
+	// flushed while it's off.
+	Switch chan bool
+
+	// Notify hub that a ticket is done queueing. The ticket is sent
+	// back by Requeue or Abandon if its login fails, but not from the
+	// goroutine reading this, since queue worker blocks on sending to
+	// it when it's full.
+	NotifyFinish chan *Ticket
 
 	// Notify a ticket's data when the enter request is accepted by queue.
 	NotifyTicket chan *Ticket
 
-	// Notify current stats of the queue.
+	// Notify a snapshot of current stats of the queue.
 	NotifyStats chan *Stats
 
 	// A queue of tickets. A ticket can be active or inactive in
@@ -37,143 +56,380 @@ type Queue struct {
 	// dequeue. Key value: ticketId -> ticket.
 	ticketQueue *linkedhashmap.Map
 
+	// Tickets put back by Requeue. They are dequeued before any
+	// ticket in ticketQueue. Key value: ticketId -> ticket.
+	retryQueue *linkedhashmap.Map
+
+	// Current dequeue interval. May be changed by config reload.
+	dequeueInterval time.Duration
+
+	dequeueTicker infra.Ticker
+
+	statsTicker infra.Ticker
+
+	// Nil unless queue is off and tickets are being flushed.
+	flushTicker infra.Ticker
+
 	stats *Stats
 
 	config *config.Config
 
 	queueConfig *config.QueueConfig
 
+	health *infra.Health
+
+	clock infra.Clock
+
 	logger *zap.SugaredLogger
 }
 
-func ProvideQueue(stats *Stats, config *config.Config, queueConfig *config.QueueConfig, loggerFactory *infra.LoggerFactory) *Queue {
+func ProvideQueue(stats *Stats, config *config.Config, queueConfig *config.QueueConfig, health *infra.Health, clock infra.Clock, loggerFactory *infra.LoggerFactory) *Queue {
+	dequeueInterval := time.Duration(config.DequeueIntervalSeconds.Get()) * time.Second
+	statsInterval := time.Duration(*config.NotifyStatsIntervalSeconds) * time.Second
+
+	// Workers are viewed as stuck if they miss a few ticks.
+	health.Watch("queueWorker", dequeueInterval*workerMaxMissedTicks)
+	health.Watch("statsWorker", statsInterval*workerMaxMissedTicks)
+
 	return &Queue{
 		Enter:        make(chan TicketId, 1024),
 		Leave:        make(chan TicketId, 1024),
-		NotifyFinish: make(chan TicketId, 1024),
+		Requeue:      make(chan *Ticket, 1024),
+		Abandon:      make(chan *Ticket, 1024),
+		Switch:       make(chan bool, 16),
+		NotifyFinish: make(chan *Ticket, 1024),
 		NotifyTicket: make(chan *Ticket, 1024),
 		NotifyStats:  make(chan *Stats, 1024),
 		ticketQueue:  linkedhashmap.New(),
+		retryQueue:   linkedhashmap.New(),
+
+		dequeueInterval: dequeueInterval,
+		dequeueTicker:   clock.NewTicker(dequeueInterval),
+		statsTicker:     clock.NewTicker(statsInterval),
 
 		stats:       stats,
 		config:      config,
 		queueConfig: queueConfig,
+		health:      health,
+		clock:       clock,
 		logger:      loggerFactory.Create("Queue").Sugar(),
 	}
 }
 
 func (q *Queue) Run() {
 	go q.queueWorker()
-	go q.statsWorker()
 }
 
 // Don't need lock on ticket and queue since only have 1 goroutine
 // that will access them. Scaling is way harder. If use redis, have to
-// consider multiple login queue worker is reading redis queue.
+// consider multiple login queue worker is reading redis queue. Stats
+// are notified here too, so they are never read while being updated.
 func (q *Queue) queueWorker() {
-	ticker := time.NewTicker(time.Duration(*q.config.DequeueIntervalSeconds) * time.Second)
-	defer ticker.Stop()
+	q.notifyStats()
+	for {
+		select {
+		case ticketId := <-q.Enter:
+			q.enter(ticketId)
+
+		case ticketId := <-q.Leave:
+			q.leave(ticketId)
+
+		case ticket := <-q.Requeue:
+			q.requeue(ticket)
+
+		case ticket := <-q.Abandon:
+			q.abandon(ticket)
+
+		case isQueueing := <-q.Switch:
+			q.switchFlushing(isQueueing)
+
+		case <-q.flushTick():
+			q.flush()
+
+		case <-q.dequeueTicker.C():
+			q.dequeue()
+
+		case <-q.statsTicker.C():
+			q.notifyStats()
+		}
+	}
+}
 
+// Handle requests already sent to queue and ticks that are due, in
+// the calling goroutine instead of workers. Requests are handled in a
+// fixed order, so that a simulation with virtual clock is
+// deterministic. Must not be used together with Run.
+func (q *Queue) RunPending() {
 	for {
 		select {
 		case ticketId := <-q.Enter:
-			q.logger.Debugf("enter ticketId[%+v]", ticketId)
-			var ticket *Ticket
-			if value, doesExist := q.ticketQueue.Get(ticketId); doesExist {
-				// Skip for ticket that's already in queue. Remove it
-				// if it's stale, so new ticket can be inserted into
-				// start of the queue.
-				ticket = value.(*Ticket)
-				if !q.IsTicketStale(ticket) {
-					ticket.isActive = true
-					q.logger.Infof("set back to active ticket[%+v]", ticket)
-					q.NotifyTicket <- ticket
-					continue
-				}
-				q.ticketQueue.Remove(ticket.TicketId)
-				q.logger.Infof("removed stale ticket[%+v]", ticket)
-			}
+			q.enter(ticketId)
+			continue
+		default:
+		}
+
+		select {
+		case ticketId := <-q.Leave:
+			q.leave(ticketId)
+			continue
+		default:
+		}
+
+		select {
+		case ticket := <-q.Requeue:
+			q.requeue(ticket)
+			continue
+		default:
+		}
 
-			ticket = q.push(ticketId)
+		select {
+		case ticket := <-q.Abandon:
+			q.abandon(ticket)
+			continue
+		default:
+		}
+
+		select {
+		case isQueueing := <-q.Switch:
+			q.switchFlushing(isQueueing)
+			continue
+		default:
+		}
+
+		break
+	}
+
+	select {
+	case <-q.flushTick():
+		q.flush()
+	default:
+	}
+
+	select {
+	case <-q.dequeueTicker.C():
+		q.dequeue()
+	default:
+	}
+
+	select {
+	case <-q.statsTicker.C():
+		q.notifyStats()
+	default:
+	}
+}
+
+func (q *Queue) enter(ticketId TicketId) {
+	q.logger.Debugw("enter", "ticketId", ticketId)
+	ticket, doesExist := q.find(ticketId)
+	if doesExist {
+		// Skip for ticket that's already in queue. Remove it if it's
+		// stale, so new ticket can be inserted into start of the
+		// queue.
+		if !q.IsTicketStale(ticket) {
+			ticket.isActive = true
+			q.logger.Infow("set back to active ticket", ticketFields(ticket)...)
 			q.NotifyTicket <- ticket
+			return
+		}
+		q.pop(ticket.TicketId)
+		q.logger.Infow("removed stale ticket", ticketFields(ticket)...)
+	}
 
-		case ticketId := <-q.Leave:
-			q.logger.Debugf("leave ticketId[%+v]", ticketId)
-			value, ok := q.ticketQueue.Get(ticketId)
-			if !ok {
+	ticket = q.push(ticketId)
+	q.NotifyTicket <- ticket
+}
+
+func (q *Queue) leave(ticketId TicketId) {
+	q.logger.Debugw("leave", "ticketId", ticketId)
+	ticket, ok := q.find(ticketId)
+	if !ok {
+		return
+	}
+
+	ticket.isActive = false
+	ticket.inactiveTime = q.clock.Now()
+	q.logger.Infow("set inactive ticket", ticketFields(ticket)...)
+}
+
+func (q *Queue) requeue(dequeued *Ticket) {
+	q.returnSlot(dequeued)
+	if _, ok := q.find(dequeued.TicketId); ok {
+		// Client has entered queue again by itself.
+		return
+	}
+
+	// Take the head position so client sees no one is in front of it.
+	// Wait longer on each attempt before retrying, so a failing main
+	// server is not hit by the same tickets on every tick.
+	now := q.clock.Now()
+	attempts := dequeued.attempts + 1
+	ticket := &Ticket{
+		TicketId:   dequeued.TicketId,
+		Position:   q.stats.HeadPosition,
+		isActive:   true,
+		createTime: now,
+		retryTime:  now.Add(time.Duration(*q.config.RequeueBackoffSeconds*attempts) * time.Second),
+		attempts:   attempts,
+	}
+	q.retryQueue.Put(ticket.TicketId, ticket)
+	q.logger.Infow("requeued ticket", append(ticketFields(ticket), "retryTime", ticket.retryTime, "attempts", attempts)...)
+	q.NotifyTicket <- ticket
+}
+
+func (q *Queue) abandon(ticket *Ticket) {
+	q.logger.Debugw("abandon", "ticketId", ticket.TicketId)
+	q.returnSlot(ticket)
+}
+
+// Return slot taken by a dequeued ticket. Tickets flushed without a
+// slot return nothing.
+func (q *Queue) returnSlot(ticket *Ticket) {
+	if !ticket.hasSlot {
+		return
+	}
+	ticket.hasSlot = false
+	q.queueConfig.ReturnOneSlot()
+}
+
+func (q *Queue) switchFlushing(isQueueing bool) {
+	if isQueueing && q.flushTicker != nil {
+		q.logger.Infof("stop flushing since queue switched on")
+		q.flushTicker.Stop()
+		q.flushTicker = nil
+	} else if !isQueueing && q.flushTicker == nil {
+		q.logger.Infof("start flushing since queue switched off")
+		q.flushTicker = q.clock.NewTicker(time.Second)
+		q.flush()
+	}
+}
+
+// Only ticks while queue is off.
+func (q *Queue) flushTick() <-chan time.Time {
+	if q.flushTicker == nil {
+		return nil
+	}
+	return q.flushTicker.C()
+}
+
+func (q *Queue) dequeue() {
+	q.health.Beat("queueWorker")
+
+	// Dequeue interval may be changed by config reload.
+	if newInterval := time.Duration(q.config.DequeueIntervalSeconds.Get()) * time.Second; newInterval != q.dequeueInterval {
+		q.logger.Infof("dequeue interval changed from [%v] to [%v]", q.dequeueInterval, newInterval)
+		q.dequeueInterval = newInterval
+		q.dequeueTicker.Reset(newInterval)
+		q.health.Watch("queueWorker", newInterval*workerMaxMissedTicks)
+	}
+
+	// Dequeue the first n tickets that is active, skip inactive. If
+	// client is inactive and not stale, we will just skip him until
+	// next ticker. If he never comes back, will be removed due to
+	// stale. Requeued tickets go first.
+	q.logger.Infof("dequeueing")
+	var dequeued []*Ticket
+dequeueLoop:
+	for _, tickets := range []*linkedhashmap.Map{q.retryQueue, q.ticketQueue} {
+		it := tickets.Iterator()
+		for it.Begin(); it.Next(); {
+			ticket := it.Value().(*Ticket)
+			if !ticket.isActive || q.isBackingOff(ticket) {
 				continue
 			}
 
-			ticket := value.(*Ticket)
-			ticket.isActive = false
-			ticket.inactiveTime = time.Now()
-			q.logger.Infof("set inactive ticket[%+v]", ticket)
-
-		case <-ticker.C:
-			// Dequeue the first n tickets that is active, skip
-			// inactive. If client is inactive and not stale, we will
-			// just skip him until next ticker. If he never comes
-			// back, will be removed due to stale.
-			q.logger.Infof("dequeueing")
-			ticketCnt := 0
-			it := q.ticketQueue.Iterator()
-			var waitDurations []time.Duration
-			for it.Begin(); it.Next(); {
-				ticketId, ticket := it.Key().(TicketId), it.Value().(*Ticket)
-				if !ticket.isActive {
-					continue
-				}
-
-				if ticketCnt >= *q.config.MaxDequeuePerInterval {
-					q.logger.Infof("dequeueing done, reach maxDequePerInterval[%v], dequeued ticketCnt[%v]", *q.config.MaxDequeuePerInterval, ticketCnt)
-					break
-				}
-
-				if !q.queueConfig.TakeOneSlot() {
-					q.logger.Infof("dequeueing done, all free slots has been taken, dequeued ticketCnt[%v]", ticketCnt)
-					break
-				}
-
-				q.pop(ticketId)
-				q.NotifyFinish <- ticketId
-
-				waitDuration := time.Since(ticket.createTime)
-				waitDurations = append(waitDurations, waitDuration)
-
-				q.logger.Debugf("dequeue ticket[%+v] waitDuration[%v]", ticket, waitDuration)
-				ticketCnt++
+			if len(dequeued) >= q.config.MaxDequeuePerInterval.Get() {
+				q.logger.Infof("dequeueing done, reach maxDequePerInterval[%v]", q.config.MaxDequeuePerInterval.Get())
+				break dequeueLoop
 			}
 
-			// Remove staled ticket from pool
-			q.logger.Infof("removing stale tickets")
-			ticketCnt = 0
-			for it.Begin(); it.Next(); {
-				ticketId, ticket := it.Key().(TicketId), it.Value().(*Ticket)
-				if !q.IsTicketStale(ticket) {
-					continue
-				}
-
-				q.pop(ticketId)
-				q.logger.Debugf("removed stale ticket[%+v]", ticket)
-				ticketCnt++
+			if !q.queueConfig.TakeOneSlot() {
+				q.logger.Infof("dequeueing done, all free slots has been taken")
+				break dequeueLoop
 			}
-			q.logger.Infof("removing stale tickets done, removed ticketCnt[%v]", ticketCnt)
 
-			// Update stats.
-			q.stats.resetHeadPosition(q.ticketQueue)
-			q.stats.updateAvgWait(waitDurations)
+			ticket.hasSlot = true
+			dequeued = append(dequeued, ticket)
 		}
 	}
+
+	// Tickets are popped after iterating, since removing from the map
+	// shifts its iterator and skips the next ticket.
+	var waitDurations []time.Duration
+	for _, ticket := range dequeued {
+		q.pop(ticket.TicketId)
+		q.NotifyFinish <- ticket
+
+		waitDuration := q.clock.Since(ticket.createTime)
+		waitDurations = append(waitDurations, waitDuration)
+
+		q.logger.Debugw("dequeue ticket", append(ticketFields(ticket), "waitDuration", waitDuration)...)
+	}
+	q.logger.Infof("dequeued ticketCnt[%v]", len(dequeued))
+
+	// Remove staled ticket from pool
+	q.logger.Infof("removing stale tickets")
+	var staleTickets []*Ticket
+	for _, tickets := range []*linkedhashmap.Map{q.retryQueue, q.ticketQueue} {
+		it := tickets.Iterator()
+		for it.Begin(); it.Next(); {
+			if ticket := it.Value().(*Ticket); q.IsTicketStale(ticket) {
+				staleTickets = append(staleTickets, ticket)
+			}
+		}
+	}
+	for _, ticket := range staleTickets {
+		q.pop(ticket.TicketId)
+		q.logger.Debugw("removed stale ticket", ticketFields(ticket)...)
+	}
+	q.logger.Infof("removing stale tickets done, removed ticketCnt[%v]", len(staleTickets))
+
+	// Update stats.
+	q.stats.resetHeadPosition(q.ticketQueue)
+	q.stats.updateAvgWait(waitDurations)
 }
 
-func (q *Queue) statsWorker() {
-	ticker := time.NewTicker(time.Duration(*q.config.NotifyStatsIntervalSeconds) * time.Second)
-	defer ticker.Stop()
+// Release at most FlushPerSecond active tickets regardless of free
+// slots, since queue is off. Keeps flushing tickets that enter later
+// until queue switches on again.
+func (q *Queue) flush() {
+	var flushed []*Ticket
+flushLoop:
+	for _, tickets := range []*linkedhashmap.Map{q.retryQueue, q.ticketQueue} {
+		it := tickets.Iterator()
+		for it.Begin(); it.Next(); {
+			ticket := it.Value().(*Ticket)
+			if !ticket.isActive || q.isBackingOff(ticket) {
+				continue
+			}
+
+			if len(flushed) >= *q.config.FlushPerSecond {
+				break flushLoop
+			}
+			flushed = append(flushed, ticket)
+		}
+	}
 
-	for ; true; <-ticker.C {
-		q.logger.Infof("current stats[%+v]", q.stats)
-		q.NotifyStats <- q.stats
+	for _, ticket := range flushed {
+		// Take a slot if there is one, so it's accounted like a
+		// dequeued ticket. Tickets flushed without a slot don't
+		// return one if their login fails.
+		ticket.hasSlot = q.queueConfig.TakeOneSlot()
+		q.pop(ticket.TicketId)
+		q.NotifyFinish <- ticket
+		q.logger.Debugw("flush ticket", append(ticketFields(ticket), "hasSlot", ticket.hasSlot)...)
 	}
+
+	if len(flushed) > 0 {
+		q.logger.Infof("flushed ticketCnt[%v] remaining ticketCnt[%v]", len(flushed), q.retryQueue.Size()+q.ticketQueue.Size())
+		q.stats.resetHeadPosition(q.ticketQueue)
+	}
+}
+
+func (q *Queue) notifyStats() {
+	q.health.Beat("statsWorker")
+	stats := q.stats.snapshot()
+	q.logger.Infof("current stats[%+v]", stats)
+	q.NotifyStats <- stats
 }
 
 func (q *Queue) push(ticketId TicketId) *Ticket {
@@ -183,30 +439,50 @@ func (q *Queue) push(ticketId TicketId) *Ticket {
 		TicketId:   ticketId,
 		Position:   q.stats.TailPosition,
 		isActive:   true,
-		createTime: time.Now(),
+		createTime: q.clock.Now(),
 	}
 	q.ticketQueue.Put(ticketId, ticket)
 
-	q.logger.Infof("inserted new ticket[%+v]", ticket)
+	q.logger.Infow("inserted new ticket", ticketFields(ticket)...)
 	return ticket
 }
 
 func (q *Queue) pop(ticketId TicketId) {
+	q.retryQueue.Remove(ticketId)
 	q.ticketQueue.Remove(ticketId)
 }
 
+func (q *Queue) find(ticketId TicketId) (*Ticket, bool) {
+	if value, ok := q.retryQueue.Get(ticketId); ok {
+		return value.(*Ticket), true
+	}
+
+	if value, ok := q.ticketQueue.Get(ticketId); ok {
+		return value.(*Ticket), true
+	}
+
+	return nil, false
+}
+
 func (q *Queue) dumpQueue() {
 	var ticketData string
-	it := q.ticketQueue.Iterator()
-	for it.Begin(); it.Next(); {
-		_, ticket := it.Key(), it.Value().(*Ticket)
-		ticketData = ticketData + fmt.Sprintf("ticket[%+v]\n", ticket)
+	for _, tickets := range []*linkedhashmap.Map{q.retryQueue, q.ticketQueue} {
+		it := tickets.Iterator()
+		for it.Begin(); it.Next(); {
+			_, ticket := it.Key(), it.Value().(*Ticket)
+			ticketData = ticketData + fmt.Sprintf("ticket[%+v]\n", ticket)
+		}
 	}
 	q.logger.Debugf("ticketQueue:\n\n" + ticketData + "\n\n")
 }
 
+// Requeued ticket waits until its retry time.
+func (q *Queue) isBackingOff(t *Ticket) bool {
+	return q.clock.Now().Before(t.retryTime)
+}
+
 func (q *Queue) IsTicketStale(t *Ticket) bool {
 	return !t.isActive &&
 		!t.inactiveTime.IsZero() &&
-		t.inactiveTime.Before(time.Now().Add(-time.Duration(*q.config.TicketStaleSeconds)*time.Second))
+		t.inactiveTime.Before(q.clock.Now().Add(-time.Duration(q.config.TicketStaleSeconds.Get())*time.Second))
 }
@@ -0,0 +1,223 @@
+package queue
+
+import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Queue driven by RunPending with virtual clock, and its queue config
+// with the given free slots. Config is the default of flags.
+func newTestQueue(t *testing.T, freeSlots uint) (*Queue, *config.QueueConfig, *infra.VirtualClock) {
+	t.Helper()
+
+	clock := infra.NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	health := infra.ProvideHealth()
+	queueConfig := config.ProvideQueueConfig(config.CFG, nil, nil, health, testMetrics, clock, testLoggerFactory)
+	queueConfig.FreeSlots = freeSlots
+
+	q := ProvideQueue(ProvideStats(config.CFG, testLoggerFactory), config.CFG, queueConfig, health, clock, testLoggerFactory)
+	return q, queueConfig, clock
+}
+
+// Enter tickets and drop their Ticket notifications.
+func enterTickets(q *Queue, ticketIds ...TicketId) {
+	for _, ticketId := range ticketIds {
+		q.Enter <- ticketId
+	}
+	q.RunPending()
+	for range ticketIds {
+		<-q.NotifyTicket
+	}
+}
+
+// Tickets notified as finished so far.
+func finishedTickets(q *Queue) []*Ticket {
+	var tickets []*Ticket
+	for {
+		select {
+		case ticket := <-q.NotifyFinish:
+			tickets = append(tickets, ticket)
+		default:
+			return tickets
+		}
+	}
+}
+
+func TestFlushSlots(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		freeSlots uint
+
+		// Free slots after both flushed tickets fail to login.
+		wantFreeSlots uint
+	}{
+		{name: "no free slot", freeSlots: 0, wantFreeSlots: 0},
+		{name: "one free slot", freeSlots: 1, wantFreeSlots: 1},
+		{name: "enough free slots", freeSlots: 5, wantFreeSlots: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, queueConfig, _ := newTestQueue(t, tc.freeSlots)
+			enterTickets(q, "a", "b")
+
+			q.Switch <- false
+			q.RunPending()
+
+			tickets := finishedTickets(q)
+			if len(tickets) != 2 {
+				t.Fatalf("flushed [%v] tickets, want 2", len(tickets))
+			}
+
+			q.Abandon <- tickets[0]
+			q.Requeue <- tickets[1]
+			q.RunPending()
+
+			if queueConfig.FreeSlots != tc.wantFreeSlots {
+				t.Fatalf("freeSlots[%v] after failed logins, want [%v]", queueConfig.FreeSlots, tc.wantFreeSlots)
+			}
+		})
+	}
+}
+
+func TestDequeue(t *testing.T) {
+	q, queueConfig, clock := newTestQueue(t, 3)
+	enterTickets(q, "a", "b", "c", "d", "e")
+
+	// Leaving ticket is skipped but keeps its place.
+	q.Leave <- "b"
+	q.RunPending()
+
+	clock.Advance(time.Duration(config.CFG.DequeueIntervalSeconds.Get()) * time.Second)
+	q.RunPending()
+
+	var ticketIds []TicketId
+	for _, ticket := range finishedTickets(q) {
+		ticketIds = append(ticketIds, ticket.TicketId)
+	}
+	if len(ticketIds) != 3 || ticketIds[0] != "a" || ticketIds[1] != "c" || ticketIds[2] != "d" {
+		t.Fatalf("dequeued %v, want [a c d]", ticketIds)
+	}
+	if queueConfig.FreeSlots != 0 {
+		t.Fatalf("freeSlots[%v] after dequeue, want 0", queueConfig.FreeSlots)
+	}
+}
+
+func TestAbandonTwice(t *testing.T) {
+	q, queueConfig, clock := newTestQueue(t, 1)
+	enterTickets(q, "a")
+
+	clock.Advance(time.Duration(config.CFG.DequeueIntervalSeconds.Get()) * time.Second)
+	q.RunPending()
+
+	tickets := finishedTickets(q)
+	if len(tickets) != 1 || queueConfig.FreeSlots != 0 {
+		t.Fatalf("dequeued [%v] tickets with freeSlots[%v] left, want 1 ticket and no slot", len(tickets), queueConfig.FreeSlots)
+	}
+
+	// Slot is only returned once for the same dequeue.
+	q.Abandon <- tickets[0]
+	q.Abandon <- tickets[0]
+	q.RunPending()
+
+	if queueConfig.FreeSlots != 1 {
+		t.Fatalf("freeSlots[%v], want 1", queueConfig.FreeSlots)
+	}
+}
+
+func TestRequeueBackoff(t *testing.T) {
+	q, _, clock := newTestQueue(t, 5)
+	enterTickets(q, "a")
+
+	q.Switch <- false
+	q.RunPending()
+	tickets := finishedTickets(q)
+	if len(tickets) != 1 {
+		t.Fatalf("flushed [%v] tickets, want 1", len(tickets))
+	}
+
+	q.Requeue <- tickets[0]
+	q.RunPending()
+	<-q.NotifyTicket
+
+	// Flush ticks every second while queue is off, but requeued ticket
+	// waits for backoff.
+	backoff := time.Duration(*config.CFG.RequeueBackoffSeconds) * time.Second
+	for elapsed := time.Second; elapsed < backoff; elapsed += time.Second {
+		clock.Advance(time.Second)
+		q.RunPending()
+		if tickets := finishedTickets(q); len(tickets) != 0 {
+			t.Fatalf("requeued ticket flushed after [%v], want wait for [%v]", elapsed, backoff)
+		}
+	}
+
+	clock.Advance(time.Second)
+	q.RunPending()
+	tickets = finishedTickets(q)
+	if len(tickets) != 1 || tickets[0].Attempts() != 1 {
+		t.Fatalf("flushed %+v after backoff, want 1 ticket with 1 attempt", tickets)
+	}
+
+	// Backoff grows with attempts.
+	q.Requeue <- tickets[0]
+	q.RunPending()
+	<-q.NotifyTicket
+
+	clock.Advance(backoff)
+	q.RunPending()
+	if tickets := finishedTickets(q); len(tickets) != 0 {
+		t.Fatalf("ticket of 2nd attempt flushed after [%v], want wait for [%v]", backoff, 2*backoff)
+	}
+
+	clock.Advance(backoff)
+	q.RunPending()
+	tickets = finishedTickets(q)
+	if len(tickets) != 1 || tickets[0].Attempts() != 2 {
+		t.Fatalf("flushed %+v after backoff, want 1 ticket with 2 attempts", tickets)
+	}
+}
+
+func TestRunPendingTicks(t *testing.T) {
+	q, _, clock := newTestQueue(t, 5)
+	enterTickets(q, "a")
+
+	// Nothing is dequeued or notified until its interval passes.
+	dequeueInterval := time.Duration(config.CFG.DequeueIntervalSeconds.Get()) * time.Second
+	statsInterval := time.Duration(*config.CFG.NotifyStatsIntervalSeconds) * time.Second
+	for elapsed := time.Second; elapsed < dequeueInterval; elapsed += time.Second {
+		clock.Advance(time.Second)
+		q.RunPending()
+		if tickets := finishedTickets(q); len(tickets) != 0 {
+			t.Fatalf("dequeued %+v after [%v], want wait for [%v]", tickets, elapsed, dequeueInterval)
+		}
+		select {
+		case <-q.NotifyStats:
+			if elapsed%statsInterval != 0 {
+				t.Fatalf("stats notified after [%v], want every [%v]", elapsed, statsInterval)
+			}
+		default:
+			if elapsed%statsInterval == 0 {
+				t.Fatalf("stats not notified after [%v]", elapsed)
+			}
+		}
+	}
+
+	clock.Advance(time.Second)
+	q.RunPending()
+	if tickets := finishedTickets(q); len(tickets) != 1 || tickets[0].TicketId != "a" {
+		t.Fatalf("dequeued %+v after [%v], want [a]", tickets, dequeueInterval)
+	}
+}
@@ -44,6 +44,16 @@ func ProvideStats(config *config.Config, loggerFactory *infra.LoggerFactory) *St
 	}
 }
 
+// Copy of exported fields, safe to be read by other goroutines while
+// queue keeps updating stats.
+func (s *Stats) snapshot() *Stats {
+	return &Stats{
+		HeadPosition:    s.HeadPosition,
+		TailPosition:    s.TailPosition,
+		AvgWaitDuration: s.AvgWaitDuration,
+	}
+}
+
 func (s *Stats) incrTailPosition() {
 	if s.TailPosition < math.MaxInt32 {
 		s.TailPosition += 1
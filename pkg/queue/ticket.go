@@ -22,4 +22,27 @@ type Ticket struct {
 	// default value, then it means this ticket has never been
 	// inactive.
 	inactiveTime time.Time
+
+	// Ticket is skipped by dequeue and flush until this time. Zero if
+	// ticket has never been requeued.
+	retryTime time.Time
+
+	// True if ticket took a free slot when it was dequeued or flushed,
+	// so the slot is returned if its login fails.
+	hasSlot bool
+
+	// Number of times ticket has been put back to queue since its
+	// login failed.
+	attempts int
+}
+
+// Number of times ticket has been put back to queue since its login
+// failed.
+func (t *Ticket) Attempts() int {
+	return t.attempts
+}
+
+// Structured log fields of a ticket.
+func ticketFields(t *Ticket) []interface{} {
+	return []interface{}{"ticketId", t.TicketId, "position", t.Position, "isActive", t.isActive}
 }
@@ -1,29 +1,47 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/admin"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/certs"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"net"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
-	"github.com/imroc/req/v3"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
+// Time allowed to read PROXY protocol header of a new connection.
+const proxyHeaderTimeout = 5 * time.Second
+
 type Server struct {
-	application *Application
-	server      *http.Server
-	logger      *zap.SugaredLogger
+	application   *Application
+	adminServer   *admin.Server
+	certStore     *certs.Store
+	config        *config.Config
+	server        *http.Server
+	tracerFactory *infra.TracerFactory
+	logger        *zap.SugaredLogger
 }
 
-func ProvideServer(application *Application, httpClient *req.Client, loggerFactory *infra.LoggerFactory) *Server {
+func ProvideServer(application *Application, adminServer *admin.Server, certStore *certs.Store, config *config.Config, health *infra.Health, tracerFactory *infra.TracerFactory, loggerFactory *infra.LoggerFactory) (*Server, error) {
 	logger := loggerFactory.Create("Server").Sugar()
 
+	ipExtractor, err := provideIpExtractor(*config.TrustedProxyCidrs)
+	if err != nil {
+		logger.Errorf("invalid trusted proxy cidrs[%v] %v", *config.TrustedProxyCidrs, err)
+		return nil, err
+	}
+
 	e := echo.New()
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.RequestID())
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
@@ -33,7 +51,7 @@ func ProvideServer(application *Application, httpClient *req.Client, loggerFacto
 		LogRequestID: true,
 		LogStatus:    true,
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			logger.Infof("%v %v id[%v] status[%v] latency[%vms]\n", v.Method, v.URI, v.RequestID, v.Status, v.Latency.Milliseconds())
+			logger.Infow("request", "method", v.Method, "uri", v.URI, "requestId", v.RequestID, "status", v.Status, "latencyMs", v.Latency.Milliseconds())
 			return nil
 		},
 	}))
@@ -42,43 +60,124 @@ func ProvideServer(application *Application, httpClient *req.Client, loggerFacto
 		return c.String(http.StatusOK, "Hello, World!\n")
 	})
 
-	e.PUT("/debug", func(c echo.Context) error {
-		infra.LoggerLevel.SetLevel(zapcore.DebugLevel)
-		httpClient.EnableDumpAll()
-		logger.Info("debug logging enabled")
-		return c.NoContent(http.StatusOK)
+	// Process is alive and worker goroutines are not stuck. Orchestrator
+	// should restart the process otherwise.
+	e.GET("/healthz", func(c echo.Context) error {
+		isAlive, results := health.Liveness()
+		return c.JSON(healthStatusCode(isAlive), &healthResponse{
+			Ok:     isAlive,
+			Checks: results,
+		})
 	})
 
-	e.DELETE("/debug", func(c echo.Context) error {
-		infra.LoggerLevel.SetLevel(zapcore.InfoLevel)
-		httpClient.DisableDumpAll()
-		logger.Info("debug logging disabled")
-		return c.NoContent(http.StatusOK)
+	// Dependencies are usable. Load balancer should stop routing new
+	// clients to this server otherwise.
+	e.GET("/readyz", func(c echo.Context) error {
+		isReady, results := health.Readiness(c.Request().Context())
+		if !isReady {
+			logger.Warnw("not ready", "checks", results)
+		}
+		return c.JSON(healthStatusCode(isReady), &healthResponse{
+			Ok:     isReady,
+			Checks: results,
+		})
 	})
 
+	e.GET("/should-queue", application.HandleShouldQueue)
+
 	e.GET("/ws", application.HandleWs)
 
+	e.GET("/sse", application.HandleSse)
+	e.POST("/sse/messages", application.HandleSseMessage)
+
 	return &Server{
 		application: application,
+		adminServer: adminServer,
+		certStore:   certStore,
+		config:      config,
 		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", os.Getenv("SERVER_PORT")),
+			Addr:      fmt.Sprintf(":%v", *config.ServerPort),
 			Handler:   e,
-			TLSConfig: &tls.Config{},
+			TLSConfig: &tls.Config{GetCertificate: certStore.GetCertificate},
 			//ReadTimeout: 30 * time.Second, // customize http.Server timeouts
 		},
-		logger: logger,
+		tracerFactory: tracerFactory,
+		logger:        logger,
+	}, nil
+}
+
+type healthResponse struct {
+	Ok     bool                          `json:"ok"`
+	Checks map[string]*infra.CheckResult `json:"checks"`
+}
+
+func healthStatusCode(isOk bool) int {
+	if isOk {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Only trust X-Forwarded-For header set by proxies in cidrs. Without
+// cidrs echo's default is kept, which takes the headers from any peer.
+func provideIpExtractor(cidrs string) (echo.IPExtractor, error) {
+	if cidrs == "" {
+		return nil, nil
+	}
+
+	trustOptions := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
 	}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		trustOptions = append(trustOptions, echo.TrustIPRange(ipRange))
+	}
+
+	return echo.ExtractIPFromXFFHeader(trustOptions...), nil
 }
 
 func (s *Server) Run() {
 	s.logger.Infof("server running application")
 	go s.application.Run()
+	go s.adminServer.Run()
+	go s.config.Watch()
+
+	if !*s.config.PlainHttp && s.certStore.IsEmpty() {
+		s.logger.Errorf("no tls certificate, set tls cert dir or enable plain http")
+		return
+	}
+	go s.certStore.Watch()
+
+	s.logger.Infof("server starts listening on port[%v] with plainHttp[%v] proxyProtocol[%v]", *s.config.ServerPort, *s.config.PlainHttp, *s.config.ProxyProtocol)
+
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.logger.Error(err)
+		return
+	}
+
+	if *s.config.ProxyProtocol {
+		listener = infra.NewProxyProtocolListener(listener, proxyHeaderTimeout)
+	}
 
-	port := os.Getenv("SERVER_PORT")
-	tlsPrivateKeyPath := os.Getenv("TLS_PRIVATE_KEY_PATH")
-	tlsCertPath := os.Getenv("TLS_CERT_PATH")
-	s.logger.Infof("server starts listening on port[%v] with tlsPrivateKeyPath[%v] tlsCertPath[%v]", port, tlsPrivateKeyPath, tlsCertPath)
-	if err := s.server.ListenAndServeTLS(tlsCertPath, tlsPrivateKeyPath); err != http.ErrServerClosed {
+	// Plain http is for running behind a TLS terminating proxy.
+	if *s.config.PlainHttp {
+		err = s.server.Serve(listener)
+	} else {
+		err = s.server.ServeTLS(listener, "", "")
+	}
+
+	if err != http.ErrServerClosed {
 		s.logger.Error(err)
 	}
+
+	// Export spans that are still buffered.
+	if err := s.tracerFactory.Shutdown(context.Background()); err != nil {
+		s.logger.Errorf("cannot shutdown tracer %v", err)
+	}
 }
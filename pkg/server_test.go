@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIpExtractor(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cidrs      string
+		remoteAddr string
+		ip         string
+	}{
+		{name: "trusted proxy", cidrs: "10.0.0.0/8", remoteAddr: "10.1.2.3:443", ip: "203.0.113.7"},
+		{name: "untrusted peer", cidrs: "10.0.0.0/8", remoteAddr: "198.51.100.9:443", ip: "198.51.100.9"},
+		{name: "one of trusted cidrs", cidrs: "192.168.0.0/16, 10.0.0.0/8", remoteAddr: "10.1.2.3:443", ip: "203.0.113.7"},
+		{name: "private peer not in cidrs", cidrs: "10.0.0.0/8", remoteAddr: "192.168.1.1:443", ip: "192.168.1.1"},
+		{name: "no cidrs", cidrs: "", remoteAddr: "198.51.100.9:443", ip: "203.0.113.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ipExtractor, err := provideIpExtractor(tc.cidrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := echo.New()
+			e.IPExtractor = ipExtractor
+
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = tc.remoteAddr
+			request.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+			if ip := e.NewContext(request, httptest.NewRecorder()).RealIP(); ip != tc.ip {
+				t.Fatalf("ip[%v], want [%v]", ip, tc.ip)
+			}
+		})
+	}
+}
+
+func TestIpExtractorInvalidCidrs(t *testing.T) {
+	if _, err := provideIpExtractor("10.0.0.0/8,10.0.0.1"); err == nil {
+		t.Fatalf("no error for invalid cidr")
+	}
+}
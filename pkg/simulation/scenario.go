@@ -0,0 +1,135 @@
+package simulation
+
+import (
+	"time"
+)
+
+// Traffic pattern of clients and behavior of main server to simulate.
+type Scenario struct {
+	Name string
+
+	Description string
+
+	// Virtual time simulated.
+	Duration time.Duration
+
+	// Same seed gives the same result.
+	Seed int64
+
+	// Number of clients arriving per second at elapsed time since
+	// start.
+	ArrivalRate func(elapsed time.Duration) float64
+
+	// Probability per second that a waiting client disconnects.
+	LeaveRate float64
+
+	// Ratio of disconnected clients that come back after
+	// ReconnectDelay. Others give up.
+	ReconnectRatio float64
+
+	ReconnectDelay time.Duration
+
+	// Online users of main server at start.
+	InitialOnlineUsers uint
+
+	// Average time a logged in user stays on main server.
+	AvgSessionDuration time.Duration
+
+	// Interval main server updates online users it reports. Queue
+	// server sees the number with this delay.
+	ReportInterval time.Duration
+
+	// Queue settings in redis config hash.
+	OnlineUsersThreshold uint
+
+	StartQueueThreshold float32
+
+	// 0 means the same as StartQueueThreshold.
+	StopQueueThreshold float32
+}
+
+func constant(rate float64) func(time.Duration) float64 {
+	return func(elapsed time.Duration) float64 {
+		return rate
+	}
+}
+
+// Arrival rate that jumps from base to peak during [start, end).
+func surge(base float64, peak float64, start time.Duration, end time.Duration) func(time.Duration) float64 {
+	return func(elapsed time.Duration) float64 {
+		if elapsed >= start && elapsed < end {
+			return peak
+		}
+		return base
+	}
+}
+
+// Built-in scenarios, run by cmd/simulate.
+func Scenarios() []*Scenario {
+	return []*Scenario{
+		{
+			Name:                 "steady",
+			Description:          "Arrivals close to capacity of main server.",
+			Duration:             time.Hour,
+			Seed:                 1,
+			ArrivalRate:          constant(4),
+			LeaveRate:            0.002,
+			ReconnectRatio:       0.5,
+			ReconnectDelay:       10 * time.Second,
+			InitialOnlineUsers:   4000,
+			AvgSessionDuration:   20 * time.Minute,
+			ReportInterval:       10 * time.Second,
+			OnlineUsersThreshold: 5000,
+			StartQueueThreshold:  0.9,
+			StopQueueThreshold:   0.8,
+		},
+		{
+			Name:                 "surge",
+			Description:          "Ten times of arrivals for 10 minutes, eg. after a server maintenance.",
+			Duration:             time.Hour,
+			Seed:                 2,
+			ArrivalRate:          surge(3, 30, 10*time.Minute, 20*time.Minute),
+			LeaveRate:            0.002,
+			ReconnectRatio:       0.5,
+			ReconnectDelay:       10 * time.Second,
+			InitialOnlineUsers:   3000,
+			AvgSessionDuration:   20 * time.Minute,
+			ReportInterval:       10 * time.Second,
+			OnlineUsersThreshold: 5000,
+			StartQueueThreshold:  0.9,
+			StopQueueThreshold:   0.8,
+		},
+		{
+			Name:                 "hover",
+			Description:          "Online users hover around start threshold. Queue would flap without a lower stop threshold.",
+			Duration:             time.Hour,
+			Seed:                 3,
+			ArrivalRate:          constant(3.75),
+			LeaveRate:            0.002,
+			ReconnectRatio:       0.5,
+			ReconnectDelay:       10 * time.Second,
+			InitialOnlineUsers:   4500,
+			AvgSessionDuration:   20 * time.Minute,
+			ReportInterval:       10 * time.Second,
+			OnlineUsersThreshold: 5000,
+			StartQueueThreshold:  0.9,
+			StopQueueThreshold:   0.8,
+		},
+		{
+			Name:                 "reconnect",
+			Description:          "Waiting clients on unstable network keep disconnecting and coming back.",
+			Duration:             time.Hour,
+			Seed:                 4,
+			ArrivalRate:          surge(3, 20, 5*time.Minute, 15*time.Minute),
+			LeaveRate:            0.02,
+			ReconnectRatio:       0.9,
+			ReconnectDelay:       20 * time.Second,
+			InitialOnlineUsers:   4000,
+			AvgSessionDuration:   20 * time.Minute,
+			ReportInterval:       10 * time.Second,
+			OnlineUsersThreshold: 5000,
+			StartQueueThreshold:  0.9,
+			StopQueueThreshold:   0.8,
+		},
+	}
+}
@@ -0,0 +1,440 @@
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrBatchTooLarge = errors.New("batch larger than queue channels")
+
+const (
+	// Resolution of virtual time.
+	step = time.Second
+
+	// Same as interval of QueueConfig.Run.
+	refreshInterval = 5 * time.Second
+
+	// Queue is driven in a single goroutine, so no batch can exceed
+	// capacity of its notify channels.
+	maxBatch = 1024
+)
+
+// Fixed start time, so that reports don't depend on when they're run.
+var startTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type clientState int
+
+const (
+	waitingState clientState = iota
+
+	// Disconnected while waiting, will reconnect.
+	disconnectedState
+
+	loggedInState
+
+	// Disconnected and never comes back.
+	abandonedState
+)
+
+type simClient struct {
+	id queue.TicketId
+
+	// Order of first arrival.
+	seq int
+
+	arriveTime time.Time
+
+	// Zero unless disconnected and will reconnect.
+	reconnectTime time.Time
+
+	state clientState
+}
+
+// Main server that counts online users and reports the number
+// periodically, like the real one.
+type fakeMainServer struct {
+	onlineUsers uint
+
+	reportedOnlineUsers uint
+
+	lastReportTime time.Time
+}
+
+type simulation struct {
+	scenario *Scenario
+
+	config *config.Config
+
+	clock *infra.VirtualClock
+
+	queueConfig *config.QueueConfig
+
+	queue *queue.Queue
+
+	mainServer *fakeMainServer
+
+	// Key value: ticketId -> client.
+	clients map[queue.TicketId]*simClient
+
+	// Clients that entered queue, in order of entering. Compacted by
+	// disconnect.
+	waiting []*simClient
+
+	// Clients disconnected and waiting to reconnect, in order of
+	// disconnection.
+	reconnecting []*simClient
+
+	random *rand.Rand
+
+	report *Report
+
+	// Highest seq of clients admitted through queue so far.
+	maxAdmittedSeq int
+}
+
+// Run scenario against queue and queue config of this server with
+// virtual clock and fake main server. Settings not in scenario, eg.
+// dequeue interval, are read from config. Result only depends on
+// scenario and config.
+func Run(scenario *Scenario, cfg *config.Config, metrics *infra.Metrics, loggerFactory *infra.LoggerFactory) (*Report, error) {
+	if cfg.MaxDequeuePerInterval.Get() > maxBatch || *cfg.FlushPerSecond > maxBatch {
+		return nil, fmt.Errorf("%w, max dequeue per interval and flush per second must not exceed %v", ErrBatchTooLarge, maxBatch)
+	}
+
+	clock := infra.NewVirtualClock(startTime)
+	health := infra.ProvideHealth()
+
+	// Redis and main server are never called since Run of queue
+	// config is not used.
+	queueConfig := config.ProvideQueueConfig(cfg, nil, nil, health, metrics, clock, loggerFactory)
+	queueConfig.IsQueueEnabled = true
+	queueConfig.OnlineUsersThreshold = scenario.OnlineUsersThreshold
+	queueConfig.StartQueueThreshold = scenario.StartQueueThreshold
+	queueConfig.StopQueueThreshold = scenario.StopQueueThreshold
+
+	s := &simulation{
+		scenario:    scenario,
+		config:      cfg,
+		clock:       clock,
+		queueConfig: queueConfig,
+		queue:       queue.ProvideQueue(queue.ProvideStats(cfg, loggerFactory), cfg, queueConfig, health, clock, loggerFactory),
+		mainServer: &fakeMainServer{
+			onlineUsers:         scenario.InitialOnlineUsers,
+			reportedOnlineUsers: scenario.InitialOnlineUsers,
+			lastReportTime:      startTime,
+		},
+		clients: make(map[queue.TicketId]*simClient),
+		random:  rand.New(rand.NewSource(scenario.Seed)),
+		report:  &Report{Scenario: scenario.Name},
+	}
+
+	s.run()
+	return s.report, nil
+}
+
+func (s *simulation) run() {
+	s.queueConfig.SetOnlineUsers(s.mainServer.reportedOnlineUsers)
+	s.drain()
+
+	for elapsed := time.Duration(0); elapsed < s.scenario.Duration; elapsed += step {
+		s.clock.Advance(step)
+		now := s.clock.Now()
+
+		s.endSessions()
+		if now.Sub(s.mainServer.lastReportTime) >= s.scenario.ReportInterval {
+			s.mainServer.reportedOnlineUsers = s.mainServer.onlineUsers
+			s.mainServer.lastReportTime = now
+		}
+		if elapsed%refreshInterval == 0 {
+			s.queueConfig.SetOnlineUsers(s.mainServer.reportedOnlineUsers)
+		}
+
+		s.disconnect()
+		s.reconnect(now)
+
+		arrivals := s.poisson(s.scenario.ArrivalRate(elapsed) * step.Seconds())
+		for i := 0; i < arrivals; i++ {
+			s.arrive(now)
+		}
+
+		s.queue.RunPending()
+		s.drain()
+		s.record()
+	}
+
+	for _, client := range s.clients {
+		if client.state == waitingState || client.state == disconnectedState {
+			s.report.StillWaiting++
+		}
+	}
+	s.report.OvershootRatio = s.report.overshootSeconds / s.scenario.Duration.Seconds()
+	s.report.summarize()
+}
+
+// New client connects. It goes to main server directly if queue is
+// off, like the application does.
+func (s *simulation) arrive(now time.Time) {
+	s.report.Arrivals++
+	if !s.queueConfig.ShouldQueue() {
+		s.report.Bypassed++
+		s.mainServer.onlineUsers++
+		return
+	}
+
+	client := &simClient{
+		id:         queue.TicketId(fmt.Sprintf("client-%v", s.report.Arrivals)),
+		seq:        s.report.Arrivals,
+		arriveTime: now,
+		state:      waitingState,
+	}
+	s.clients[client.id] = client
+	s.enter(client)
+}
+
+func (s *simulation) enter(client *simClient) {
+	s.waiting = append(s.waiting, client)
+
+	// Let queue handle requests before channel is full, since nothing
+	// else receives from it.
+	if len(s.queue.Enter) >= cap(s.queue.Enter)/2 {
+		s.queue.RunPending()
+		s.drain()
+	}
+	s.queue.Enter <- client.id
+}
+
+// Waiting clients disconnect randomly. Some of them will come back.
+func (s *simulation) disconnect() {
+	probability := s.scenario.LeaveRate * step.Seconds()
+	if probability <= 0 {
+		return
+	}
+
+	// Iterate in order of entering, since map order is random.
+	waiting := s.waiting[:0]
+	for _, client := range s.waiting {
+		if client.state != waitingState {
+			continue
+		}
+		if s.random.Float64() >= probability {
+			waiting = append(waiting, client)
+			continue
+		}
+
+		if len(s.queue.Leave) >= cap(s.queue.Leave)/2 {
+			s.queue.RunPending()
+			s.drain()
+		}
+		s.queue.Leave <- client.id
+
+		if s.random.Float64() < s.scenario.ReconnectRatio {
+			client.state = disconnectedState
+			client.reconnectTime = s.clock.Now().Add(s.scenario.ReconnectDelay)
+			s.reconnecting = append(s.reconnecting, client)
+			s.report.Disconnects++
+		} else {
+			client.state = abandonedState
+			s.report.Abandoned++
+		}
+	}
+	s.waiting = waiting
+}
+
+func (s *simulation) reconnect(now time.Time) {
+	remaining := s.reconnecting[:0]
+	for _, client := range s.reconnecting {
+		if client.reconnectTime.After(now) {
+			remaining = append(remaining, client)
+			continue
+		}
+
+		// Queue may have been switched off meanwhile.
+		if !s.queueConfig.ShouldQueue() {
+			client.state = loggedInState
+			s.mainServer.onlineUsers++
+			s.report.Bypassed++
+			continue
+		}
+
+		client.state = waitingState
+		client.reconnectTime = time.Time{}
+		s.enter(client)
+	}
+	s.reconnecting = remaining
+}
+
+// Act as hub: receive everything queue notified, and login dequeued
+// clients to main server.
+func (s *simulation) drain() {
+	for {
+		select {
+		case <-s.queue.NotifyTicket:
+		case <-s.queue.NotifyStats:
+
+		case isQueueing := <-s.queueConfig.NotifySwitch:
+			s.report.Switches++
+			s.queue.Switch <- isQueueing
+			s.queue.RunPending()
+
+		case ticket := <-s.queue.NotifyFinish:
+			s.admit(ticket)
+
+		default:
+			return
+		}
+	}
+}
+
+func (s *simulation) admit(ticket *queue.Ticket) {
+	client, ok := s.clients[ticket.TicketId]
+	if !ok || client.state != waitingState {
+		s.queue.Abandon <- ticket
+		return
+	}
+
+	client.state = loggedInState
+	s.mainServer.onlineUsers++
+	s.report.Admitted++
+	s.report.waits = append(s.report.waits, s.clock.Since(client.arriveTime))
+
+	// Someone who arrived later has been admitted first.
+	if client.seq < s.maxAdmittedSeq {
+		s.report.Overtaken++
+	} else {
+		s.maxAdmittedSeq = client.seq
+	}
+}
+
+// Logged in users leave main server after exponentially distributed
+// session durations.
+func (s *simulation) endSessions() {
+	if s.scenario.AvgSessionDuration <= 0 {
+		return
+	}
+
+	mean := float64(s.mainServer.onlineUsers) * step.Seconds() / s.scenario.AvgSessionDuration.Seconds()
+	leaves := uint(s.poisson(mean))
+	if leaves > s.mainServer.onlineUsers {
+		leaves = s.mainServer.onlineUsers
+	}
+	s.mainServer.onlineUsers -= leaves
+}
+
+func (s *simulation) record() {
+	onlineUsers := s.mainServer.onlineUsers
+	if onlineUsers > s.report.PeakOnlineUsers {
+		s.report.PeakOnlineUsers = onlineUsers
+	}
+
+	if onlineUsers > s.scenario.OnlineUsersThreshold {
+		overshoot := onlineUsers - s.scenario.OnlineUsersThreshold
+		if overshoot > s.report.MaxOvershoot {
+			s.report.MaxOvershoot = overshoot
+		}
+		s.report.overshootSeconds += step.Seconds()
+	}
+}
+
+// Number of events in a step with the mean. Normal approximation is
+// used for large mean.
+func (s *simulation) poisson(mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+
+	if mean > 30 {
+		return int(math.Max(0, math.Round(mean+s.random.NormFloat64()*math.Sqrt(mean))))
+	}
+
+	limit := math.Exp(-mean)
+	n, product := 0, s.random.Float64()
+	for product > limit {
+		n++
+		product *= s.random.Float64()
+	}
+	return n
+}
+
+type Report struct {
+	Scenario string
+
+	// Clients that connected, excluding reconnects.
+	Arrivals int
+
+	// Clients that went to main server directly since queue was off.
+	Bypassed int
+
+	// Clients that went to main server through queue.
+	Admitted int
+
+	// Disconnects of waiting clients that came back later.
+	Disconnects int
+
+	// Clients that disconnected while waiting and never came back.
+	Abandoned int
+
+	StillWaiting int
+
+	// Wait of admitted clients since first arrival.
+	WaitP50 time.Duration
+	WaitP90 time.Duration
+	WaitP99 time.Duration
+	WaitMax time.Duration
+
+	PeakOnlineUsers uint
+
+	// Max number of online users over OnlineUsersThreshold.
+	MaxOvershoot uint
+
+	// Ratio of time online users are over OnlineUsersThreshold.
+	OvershootRatio float64
+
+	// Admitted clients that someone who arrived later got admitted
+	// before. Lower is fairer.
+	Overtaken int
+
+	// Times queue switched on or off.
+	Switches int
+
+	waits []time.Duration
+
+	overshootSeconds float64
+}
+
+func (r *Report) summarize() {
+	if len(r.waits) == 0 {
+		return
+	}
+
+	sort.Slice(r.waits, func(i, j int) bool {
+		return r.waits[i] < r.waits[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return r.waits[int(math.Ceil(p*float64(len(r.waits))))-1]
+	}
+
+	r.WaitP50 = percentile(0.5)
+	r.WaitP90 = percentile(0.9)
+	r.WaitP99 = percentile(0.99)
+	r.WaitMax = r.waits[len(r.waits)-1]
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "scenario[%v]\n", r.Scenario)
+	fmt.Fprintf(&b, "  clients    arrivals[%v] bypassed[%v] admitted[%v] stillWaiting[%v] disconnects[%v] abandoned[%v]\n",
+		r.Arrivals, r.Bypassed, r.Admitted, r.StillWaiting, r.Disconnects, r.Abandoned)
+	fmt.Fprintf(&b, "  wait       p50[%v] p90[%v] p99[%v] max[%v]\n", r.WaitP50, r.WaitP90, r.WaitP99, r.WaitMax)
+	fmt.Fprintf(&b, "  online     peak[%v] maxOvershoot[%v] overshootRatio[%.3f]\n", r.PeakOnlineUsers, r.MaxOvershoot, r.OvershootRatio)
+	fmt.Fprintf(&b, "  fairness   overtaken[%v]\n", r.Overtaken)
+	fmt.Fprintf(&b, "  queue      switches[%v]\n", r.Switches)
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package simulation
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Metrics can only be provided once per process.
+	testMetrics = infra.ProvideMetrics()
+
+	testLoggerFactory = func() *infra.LoggerFactory {
+		loggerFactory := infra.ProvideLoggerFactory()
+		loggerFactory.SetLevel("", zapcore.WarnLevel)
+		return loggerFactory
+	}()
+)
+
+// Set flag for the test, restored on cleanup.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("cannot set flag[%v] %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, prev) })
+}
+
+func runScenario(t *testing.T, scenario *Scenario) *Report {
+	t.Helper()
+
+	report, err := Run(scenario, config.CFG, testMetrics, testLoggerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("\n%v", report)
+	return report
+}
+
+func findScenario(t *testing.T, name string) *Scenario {
+	t.Helper()
+
+	for _, scenario := range Scenarios() {
+		if scenario.Name == name {
+			return scenario
+		}
+	}
+	t.Fatalf("no scenario[%v]", name)
+	return nil
+}
+
+func TestScenarios(t *testing.T) {
+	// Bounds of the built-in scenarios with default queue flags.
+	for _, tc := range []struct {
+		name string
+
+		// Admitted clients wait at most about one dequeue interval
+		// when arrivals are within capacity.
+		maxWaitP99 time.Duration
+
+		// Queue doesn't flap.
+		maxSwitches int
+
+		// Free slots are replenished from online users reported before
+		// the latest logins, so under surge the threshold is exceeded
+		// by about what's admitted within a refresh.
+		maxOvershoot uint
+	}{
+		{name: "steady", maxWaitP99: 20 * time.Second, maxSwitches: 1},
+		{name: "surge", maxWaitP99: 25 * time.Minute, maxSwitches: 2, maxOvershoot: 250},
+		{name: "hover", maxWaitP99: 20 * time.Second, maxSwitches: 1},
+		{name: "reconnect", maxWaitP99: 15 * time.Minute, maxSwitches: 2, maxOvershoot: 250},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report := runScenario(t, findScenario(t, tc.name))
+
+			if report.Admitted == 0 {
+				t.Fatalf("nobody admitted through queue")
+			}
+			if report.MaxOvershoot > tc.maxOvershoot {
+				t.Fatalf("online users overshoot by [%v] for ratio[%v] of time, want at most [%v]", report.MaxOvershoot, report.OvershootRatio, tc.maxOvershoot)
+			}
+
+			if !(report.WaitP50 <= report.WaitP90 && report.WaitP90 <= report.WaitP99 && report.WaitP99 <= report.WaitMax) {
+				t.Fatalf("wait percentiles p50[%v] p90[%v] p99[%v] max[%v] not in order", report.WaitP50, report.WaitP90, report.WaitP99, report.WaitMax)
+			}
+			if report.WaitP99 > tc.maxWaitP99 {
+				t.Fatalf("wait p99[%v], want at most [%v]", report.WaitP99, tc.maxWaitP99)
+			}
+
+			// Only clients that disconnect lose their place.
+			if report.Overtaken > report.Disconnects {
+				t.Fatalf("overtaken[%v] more than disconnects[%v]", report.Overtaken, report.Disconnects)
+			}
+
+			if report.Switches < 1 || report.Switches > tc.maxSwitches {
+				t.Fatalf("switches[%v], want 1 to [%v]", report.Switches, tc.maxSwitches)
+			}
+		})
+	}
+}
+
+func TestFairWithoutDisconnects(t *testing.T) {
+	scenario := *findScenario(t, "surge")
+	scenario.Duration = 20 * time.Minute
+	scenario.LeaveRate = 0
+
+	report := runScenario(t, &scenario)
+	if report.Admitted == 0 || report.Disconnects != 0 || report.Abandoned != 0 {
+		t.Fatalf("admitted[%v] disconnects[%v] abandoned[%v], want admissions only", report.Admitted, report.Disconnects, report.Abandoned)
+	}
+	if report.Overtaken != 0 {
+		t.Fatalf("overtaken[%v], want admitted in order of arrival", report.Overtaken)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	scenario := *findScenario(t, "reconnect")
+	scenario.Duration = 20 * time.Minute
+
+	report := runScenario(t, &scenario)
+	if again := runScenario(t, &scenario); !reflect.DeepEqual(report, again) {
+		t.Fatalf("reports differ between runs\n%v\n%v", report, again)
+	}
+
+	scenario.Seed++
+	if other := runScenario(t, &scenario); reflect.DeepEqual(report, other) {
+		t.Fatalf("same report with another seed")
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	setFlag(t, "max-dequeue-per-interval", fmt.Sprint(maxBatch+1))
+
+	if _, err := Run(findScenario(t, "steady"), config.CFG, testMetrics, testLoggerFactory); !errors.Is(err, ErrBatchTooLarge) {
+		t.Fatalf("err[%v], want [%v]", err, ErrBatchTooLarge)
+	}
+}
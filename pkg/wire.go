@@ -4,27 +4,54 @@
 package main
 
 import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/admin"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/certs"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/challenge"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/client"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
 
 	"github.com/google/wire"
 )
 
+var providerSet = wire.NewSet(
+	ProvideServer,
+	ProvideApplication,
+	admin.ProvideServer,
+	certs.ProvideStore,
+	challenge.ProvideCaptchaVerifier,
+	challenge.ProvideIssuer,
+	client.ProvideClientFactory,
+	client.ProvideHub,
+	client.ProvideRejecter,
+	client.ProvideSseSessions,
+	client.ProvideVersionPolicy,
+	config.ProvideConfig,
+	config.ProvideMainServerConfig,
+	config.ProvideQueueConfig,
+	config.ProvideRedisConfig,
+	infra.ProvideClock,
+	infra.ProvideHttpClient,
+	infra.ProvideRedisClient,
+	infra.ProvideHealth,
+	infra.ProvideLoggerFactory,
+	infra.ProvideMainServerCircuit,
+	infra.ProvideMetrics,
+	login.ProvideRegistry,
+	queue.ProvideQueue,
+	queue.ProvideStats,
+)
+
 func Setup() (*Server, error) {
-	wire.Build(wire.NewSet(
-		ProvideServer,
-		ProvideApplication,
-		client.ProvideClientFactory,
-		client.ProvideHub,
-		config.ProvideQueueConfig,
-		wire.Value(config.CFG),
-		infra.ProvideHttpClient,
-		infra.ProvideRedisClient,
-		infra.ProvideLoggerFactory,
-		queue.ProvideQueue,
-		queue.ProvideStats,
-	))
+	wire.Build(providerSet, infra.ProvideTracerFactory)
+	return nil, nil
+}
+
+// Setup with the given tracer factory, eg. the in-memory one of e2e
+// tests.
+func SetupWithTracer(tracerFactory *infra.TracerFactory) (*Server, error) {
+	wire.Build(providerSet)
 	return nil, nil
 }
@@ -7,32 +7,112 @@
 package main
 
 import (
+	"game-soul-technology/joker/joker-login-queue-server/pkg/admin"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/certs"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/challenge"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/client"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/config"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/infra"
+	"game-soul-technology/joker/joker-login-queue-server/pkg/login"
 	"game-soul-technology/joker/joker-login-queue-server/pkg/queue"
 )
 
 // Injectors from wire.go:
 
 func Setup() (*Server, error) {
-	configConfig := _wireConfigValue
 	loggerFactory := infra.ProvideLoggerFactory()
-	redisClient, err := infra.ProvideRedisClient(loggerFactory)
+	configConfig, err := config.ProvideConfig(loggerFactory)
 	if err != nil {
 		return nil, err
 	}
-	reqClient := infra.ProvideHttpClient()
-	queueConfig := config.ProvideQueueConfig(redisClient, reqClient, loggerFactory)
+	redisConfig := config.ProvideRedisConfig(configConfig)
+	health := infra.ProvideHealth()
+	redisClient := infra.ProvideRedisClient(redisConfig, health, loggerFactory)
+	tracerFactory, err := infra.ProvideTracerFactory(loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	mainServerConfig := config.ProvideMainServerConfig(configConfig)
+	clock := infra.ProvideClock()
+	circuit := infra.ProvideMainServerCircuit(mainServerConfig, health, clock)
+	reqClient := infra.ProvideHttpClient(tracerFactory, circuit)
+	metrics := infra.ProvideMetrics()
+	queueConfig := config.ProvideQueueConfig(configConfig, redisClient, reqClient, health, metrics, clock, loggerFactory)
 	stats := queue.ProvideStats(configConfig, loggerFactory)
-	queueQueue := queue.ProvideQueue(stats, configConfig, queueConfig, loggerFactory)
-	hub := client.ProvideHub(queueQueue, reqClient, loggerFactory)
-	clientFactory := client.ProvideClientFactory(hub, loggerFactory)
-	application := ProvideApplication(configConfig, queueConfig, clientFactory, hub, queueQueue, reqClient, loggerFactory)
-	server := ProvideServer(application, reqClient, loggerFactory)
+	queueQueue := queue.ProvideQueue(stats, configConfig, queueConfig, health, clock, loggerFactory)
+	captchaVerifier := challenge.ProvideCaptchaVerifier(configConfig, reqClient, loggerFactory)
+	issuer := challenge.ProvideIssuer(queueConfig, captchaVerifier, loggerFactory)
+	registry, err := login.ProvideRegistry(configConfig, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	hub := client.ProvideHub(queueQueue, queueConfig, issuer, registry, configConfig, reqClient, metrics, tracerFactory, loggerFactory)
+	sseSessions := client.ProvideSseSessions(configConfig, metrics)
+	versionPolicy, err := client.ProvideVersionPolicy(configConfig, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	clientFactory := client.ProvideClientFactory(hub, sseSessions, versionPolicy, configConfig, loggerFactory)
+	rejecter := client.ProvideRejecter(configConfig, metrics, loggerFactory)
+	application := ProvideApplication(configConfig, queueConfig, clientFactory, hub, rejecter, sseSessions, versionPolicy, queueQueue, reqClient, metrics, tracerFactory, loggerFactory)
+	store, err := certs.ProvideStore(configConfig, metrics, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	adminServer, err := admin.ProvideServer(configConfig, store, queueConfig, metrics, reqClient, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	server, err := ProvideServer(application, adminServer, store, configConfig, health, tracerFactory, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
 	return server, nil
 }
 
-var (
-	_wireConfigValue = config.CFG
-)
+func SetupWithTracer(tracerFactory *infra.TracerFactory) (*Server, error) {
+	loggerFactory := infra.ProvideLoggerFactory()
+	configConfig, err := config.ProvideConfig(loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	redisConfig := config.ProvideRedisConfig(configConfig)
+	health := infra.ProvideHealth()
+	redisClient := infra.ProvideRedisClient(redisConfig, health, loggerFactory)
+	mainServerConfig := config.ProvideMainServerConfig(configConfig)
+	clock := infra.ProvideClock()
+	circuit := infra.ProvideMainServerCircuit(mainServerConfig, health, clock)
+	reqClient := infra.ProvideHttpClient(tracerFactory, circuit)
+	metrics := infra.ProvideMetrics()
+	queueConfig := config.ProvideQueueConfig(configConfig, redisClient, reqClient, health, metrics, clock, loggerFactory)
+	stats := queue.ProvideStats(configConfig, loggerFactory)
+	queueQueue := queue.ProvideQueue(stats, configConfig, queueConfig, health, clock, loggerFactory)
+	captchaVerifier := challenge.ProvideCaptchaVerifier(configConfig, reqClient, loggerFactory)
+	issuer := challenge.ProvideIssuer(queueConfig, captchaVerifier, loggerFactory)
+	registry, err := login.ProvideRegistry(configConfig, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	hub := client.ProvideHub(queueQueue, queueConfig, issuer, registry, configConfig, reqClient, metrics, tracerFactory, loggerFactory)
+	sseSessions := client.ProvideSseSessions(configConfig, metrics)
+	versionPolicy, err := client.ProvideVersionPolicy(configConfig, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	clientFactory := client.ProvideClientFactory(hub, sseSessions, versionPolicy, configConfig, loggerFactory)
+	rejecter := client.ProvideRejecter(configConfig, metrics, loggerFactory)
+	application := ProvideApplication(configConfig, queueConfig, clientFactory, hub, rejecter, sseSessions, versionPolicy, queueQueue, reqClient, metrics, tracerFactory, loggerFactory)
+	store, err := certs.ProvideStore(configConfig, metrics, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	adminServer, err := admin.ProvideServer(configConfig, store, queueConfig, metrics, reqClient, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	server, err := ProvideServer(application, adminServer, store, configConfig, health, tracerFactory, loggerFactory)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}